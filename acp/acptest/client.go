@@ -0,0 +1,195 @@
+// Package acptest provides a fake ACP client (an editor stand-in) for
+// driving an agent in tests.
+package acptest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"droid-acp/acp"
+	"droid-acp/types"
+)
+
+// Client records everything the agent sends and answers the agent's
+// requests the way Zed would.
+type Client struct {
+	Conn *acp.Conn
+
+	// OnPermission picks the answer to session/request_permission. By
+	// default the first option is selected.
+	OnPermission func(types.RequestPermissionParam) types.PermissionOutcome
+	// Files backs fs/read_text_file and receives fs/write_text_file.
+	Files map[string]string
+	// Disk makes fs/read_text_file and fs/write_text_file use the local
+	// disk instead of Files, as an editor saving its buffers would.
+	Disk bool
+
+	mu          sync.Mutex
+	updates     []types.SessionUpdateParam
+	permissions []types.RequestPermissionParam
+	writes      []types.FSWriteTextFileParam
+}
+
+// NewClient serves the client side of a connection, reading the agent's
+// output from r and writing to the agent's input through w.
+func NewClient(r io.Reader, w io.Writer) *Client {
+	c := &Client{
+		Files: make(map[string]string),
+	}
+	c.Conn = acp.NewConn(w, c.handle)
+	go c.Conn.Serve(context.Background(), r)
+	return c
+}
+
+// Pipe connects a new Client to an agent. The returned reader and writer
+// are the agent's input and output.
+func Pipe() (*Client, io.Reader, io.Writer) {
+	agentR, clientW := io.Pipe()
+	clientR, agentW := io.Pipe()
+	return NewClient(clientR, clientW), agentR, agentW
+}
+
+func (c *Client) handle(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "session/update":
+		var p types.SessionUpdateParam
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, acp.ErrInvalidParams(err)
+		}
+		c.mu.Lock()
+		c.updates = append(c.updates, p)
+		c.mu.Unlock()
+		return nil, nil
+
+	case "session/request_permission":
+		var p types.RequestPermissionParam
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, acp.ErrInvalidParams(err)
+		}
+		c.mu.Lock()
+		c.permissions = append(c.permissions, p)
+		pick := c.OnPermission
+		c.mu.Unlock()
+
+		outcome := types.PermissionOutcome{Outcome: "cancelled"}
+		if pick != nil {
+			outcome = pick(p)
+		} else if len(p.Options) > 0 {
+			outcome = types.PermissionOutcome{Outcome: "selected", OptionId: p.Options[0].OptionId}
+		}
+		return types.RequestPermissionResult{Outcome: outcome}, nil
+
+	case "fs/read_text_file":
+		var p types.FSReadTextFileParam
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, acp.ErrInvalidParams(err)
+		}
+		c.mu.Lock()
+		content, ok := c.Files[p.Path]
+		if c.Disk {
+			b, err := os.ReadFile(p.Path)
+			content, ok = string(b), err == nil
+		}
+		c.mu.Unlock()
+		if !ok {
+			return nil, &types.Error{Code: acp.CodeInvalidParams, Message: "file not found: " + p.Path}
+		}
+		return types.FSReadTextFileResult{Content: content}, nil
+
+	case "fs/write_text_file":
+		var p types.FSWriteTextFileParam
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, acp.ErrInvalidParams(err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.writes = append(c.writes, p)
+		if c.Disk {
+			return nil, os.WriteFile(p.Path, []byte(p.Content), 0o644)
+		}
+		c.Files[p.Path] = p.Content
+		return nil, nil
+	}
+	return nil, acp.ErrMethodNotFound(method)
+}
+
+func (c *Client) Initialize(ctx context.Context) (types.InitializeResult, error) {
+	var result types.InitializeResult
+	err := c.Conn.Call(ctx, "initialize", types.InitializeParams{ProtocolVersion: 1}, &result)
+	return result, err
+}
+
+func (c *Client) NewSession(ctx context.Context, cwd string) (types.NewSessionResult, error) {
+	var result types.NewSessionResult
+	err := c.Conn.Call(ctx, "session/new", types.NewSessionParams{Cwd: cwd}, &result)
+	return result, err
+}
+
+func (c *Client) ListSessions(ctx context.Context, cwd, cursor string) (types.ListSessionsResult, error) {
+	var result types.ListSessionsResult
+	err := c.Conn.Call(ctx, "session/list", types.ListSessionsParams{Cwd: cwd, Cursor: cursor}, &result)
+	return result, err
+}
+
+func (c *Client) ForkSession(ctx context.Context, sessionID, cwd string) (types.NewSessionResult, error) {
+	var result types.NewSessionResult
+	err := c.Conn.Call(ctx, "session/fork", types.ForkSessionParams{SessionId: sessionID, Cwd: cwd}, &result)
+	return result, err
+}
+
+// Prompt sends a single text block and waits for the turn to end.
+func (c *Client) Prompt(ctx context.Context, sessionID, text string) (types.PromptResult, error) {
+	var result types.PromptResult
+	err := c.Conn.Call(ctx, "session/prompt", types.PromptParams{
+		SessionId: sessionID,
+		Prompt:    []types.ContentBlock{{Type: "text", Text: text}},
+	}, &result)
+	return result, err
+}
+
+func (c *Client) Cancel(sessionID string) error {
+	return c.Conn.Notify("session/cancel", types.CancelParams{SessionId: sessionID})
+}
+
+func (c *Client) SetModel(ctx context.Context, sessionID, modelID string) error {
+	return c.Conn.Call(ctx, "session/set_model", types.SetModelParams{SessionId: sessionID, ModelID: types.ModelId(modelID)}, nil)
+}
+
+func (c *Client) SetMode(ctx context.Context, sessionID, modeID string) error {
+	return c.Conn.Call(ctx, "session/set_mode", types.SetModeParams{SessionId: sessionID, ModeId: modeID}, nil)
+}
+
+// Updates returns the session/update notifications received so far.
+func (c *Client) Updates() []types.SessionUpdateParam {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]types.SessionUpdateParam(nil), c.updates...)
+}
+
+// Permissions returns the permission requests received so far.
+func (c *Client) Permissions() []types.RequestPermissionParam {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]types.RequestPermissionParam(nil), c.permissions...)
+}
+
+// Writes returns the fs/write_text_file requests received so far.
+func (c *Client) Writes() []types.FSWriteTextFileParam {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]types.FSWriteTextFileParam(nil), c.writes...)
+}
+
+// AgentText concatenates every agent_message_chunk received so far.
+func (c *Client) AgentText() string {
+	var text string
+	for _, u := range c.Updates() {
+		if u.Update.SessionUpdate == "agent_message_chunk" && u.Update.Content != nil {
+			text += u.Update.Content.Text
+		}
+	}
+	return text
+}
@@ -0,0 +1,132 @@
+package acp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"droid-acp/types"
+)
+
+// Agent is implemented by anything that wants to be driven by an ACP client.
+type Agent interface {
+	Initialize(ctx context.Context, params types.InitializeParams) (types.InitializeResult, error)
+	NewSession(ctx context.Context, params types.NewSessionParams) (types.NewSessionResult, error)
+	LoadSession(ctx context.Context, params types.LoadSessionParams) (types.LoadSessionResult, error)
+	Prompt(ctx context.Context, params types.PromptParams) (types.PromptResult, error)
+	Cancel(ctx context.Context, params types.CancelParams) error
+	SetSessionMode(ctx context.Context, params types.SetModeParams) error
+	SetSessionModel(ctx context.Context, params types.SetModelParams) error
+}
+
+// ExtHandler may be implemented by an Agent to serve methods the router does
+// not know about. Returning ErrMethodNotFound keeps the default behaviour.
+type ExtHandler interface {
+	HandleExtMethod(ctx context.Context, method string, params json.RawMessage) (any, error)
+}
+
+// SessionManager may be implemented by an Agent that serves session/list
+// and session/fork.
+type SessionManager interface {
+	ListSessions(ctx context.Context, params types.ListSessionsParams) (types.ListSessionsResult, error)
+	ForkSession(ctx context.Context, params types.ForkSessionParams) (types.NewSessionResult, error)
+}
+
+// AgentConn routes ACP traffic to an Agent and exposes the client methods
+// the agent can call back into.
+type AgentConn struct {
+	*Conn
+	agent Agent
+}
+
+func NewAgentConn(agent Agent, w io.Writer) *AgentConn {
+	a := &AgentConn{agent: agent}
+	a.Conn = NewConn(w, a.handle)
+	return a
+}
+
+func (a *AgentConn) handle(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "initialize":
+		var p types.InitializeParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return a.agent.Initialize(ctx, p)
+
+	case "session/new":
+		var p types.NewSessionParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return a.agent.NewSession(ctx, p)
+
+	case "session/load":
+		var p types.LoadSessionParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return a.agent.LoadSession(ctx, p)
+
+	case "session/prompt":
+		var p types.PromptParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return a.agent.Prompt(ctx, p)
+
+	case "session/cancel":
+		var p types.CancelParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, a.agent.Cancel(ctx, p)
+
+	case "session/set_mode":
+		var p types.SetModeParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, a.agent.SetSessionMode(ctx, p)
+
+	case "session/set_model":
+		var p types.SetModelParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, a.agent.SetSessionModel(ctx, p)
+
+	case "session/list":
+		if sm, ok := a.agent.(SessionManager); ok {
+			var p types.ListSessionsParams
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			return sm.ListSessions(ctx, p)
+		}
+
+	case "session/fork":
+		if sm, ok := a.agent.(SessionManager); ok {
+			var p types.ForkSessionParams
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			return sm.ForkSession(ctx, p)
+		}
+	}
+
+	if ext, ok := a.agent.(ExtHandler); ok {
+		return ext.HandleExtMethod(ctx, method, params)
+	}
+	return nil, ErrMethodNotFound(method)
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return ErrInvalidParams(err)
+	}
+	return nil
+}
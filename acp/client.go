@@ -0,0 +1,58 @@
+package acp
+
+import (
+	"context"
+
+	"droid-acp/types"
+)
+
+// Client-side methods an agent may call on the editor.
+
+// SessionUpdate streams a session/update notification to the client.
+func (a *AgentConn) SessionUpdate(params types.SessionUpdateParam) error {
+	return a.Notify("session/update", params)
+}
+
+// RequestPermission asks the user to pick one of params.Options and waits
+// for the decision.
+func (a *AgentConn) RequestPermission(ctx context.Context, params types.RequestPermissionParam) (types.PermissionOutcome, error) {
+	var result types.RequestPermissionResult
+	err := a.Call(ctx, "session/request_permission", params, &result)
+	return result.Outcome, err
+}
+
+func (a *AgentConn) ReadTextFile(ctx context.Context, params types.FSReadTextFileParam) (string, error) {
+	var result types.FSReadTextFileResult
+	err := a.Call(ctx, "fs/read_text_file", params, &result)
+	return result.Content, err
+}
+
+func (a *AgentConn) WriteTextFile(ctx context.Context, params types.FSWriteTextFileParam) error {
+	return a.Call(ctx, "fs/write_text_file", params, nil)
+}
+
+func (a *AgentConn) CreateTerminal(ctx context.Context, params types.CreateTerminalParam) (string, error) {
+	var result types.CreateTerminalResult
+	err := a.Call(ctx, "terminal/create", params, &result)
+	return result.TerminalId, err
+}
+
+func (a *AgentConn) TerminalOutput(ctx context.Context, params types.TerminalParam) (types.TerminalOutputResult, error) {
+	var result types.TerminalOutputResult
+	err := a.Call(ctx, "terminal/output", params, &result)
+	return result, err
+}
+
+func (a *AgentConn) WaitForTerminalExit(ctx context.Context, params types.TerminalParam) (types.TerminalExitStatus, error) {
+	var result types.TerminalExitStatus
+	err := a.Call(ctx, "terminal/wait_for_exit", params, &result)
+	return result, err
+}
+
+func (a *AgentConn) KillTerminal(ctx context.Context, params types.TerminalParam) error {
+	return a.Call(ctx, "terminal/kill", params, nil)
+}
+
+func (a *AgentConn) ReleaseTerminal(ctx context.Context, params types.TerminalParam) error {
+	return a.Call(ctx, "terminal/release", params, nil)
+}
@@ -0,0 +1,279 @@
+// Package acp implements the agent side of the Agent Client Protocol (ACP)
+// over newline-delimited JSON-RPC 2.0, as spoken by Zed on stdin/stdout.
+package acp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"droid-acp/types"
+)
+
+// JSON-RPC error codes used by the router.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// HandlerFunc handles an incoming request or notification. For
+// notifications the returned result is discarded.
+type HandlerFunc func(ctx context.Context, method string, params json.RawMessage) (any, error)
+
+// TraceFunc observes every raw line read from or written to the connection.
+type TraceFunc func(outbound bool, line []byte)
+
+// Conn is a bidirectional JSON-RPC connection. Incoming requests are served
+// concurrently so a long-running handler (such as session/prompt) does not
+// block responses to requests the connection itself has sent.
+type Conn struct {
+	w       io.Writer
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan types.ACPRequest
+
+	handler HandlerFunc
+	trace   TraceFunc
+}
+
+func NewConn(w io.Writer, handler HandlerFunc) *Conn {
+	return &Conn{
+		w:       w,
+		pending: make(map[string]chan types.ACPRequest),
+		handler: handler,
+	}
+}
+
+// SetTrace installs fn as the observer of all traffic on the connection.
+func (c *Conn) SetTrace(fn TraceFunc) {
+	c.mu.Lock()
+	c.trace = fn
+	c.mu.Unlock()
+}
+
+func (c *Conn) tracer() TraceFunc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trace
+}
+
+// Serve reads messages from r until EOF or ctx is cancelled. Outstanding
+// calls are failed when Serve returns.
+func (c *Conn) Serve(ctx context.Context, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.failPending()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if trace := c.tracer(); trace != nil {
+			trace(false, line)
+		}
+
+		var msg types.ACPRequest
+		if err := json.Unmarshal(line, &msg); err != nil {
+			c.writeMessage(types.ACPResponse{
+				JSONRPC: "2.0",
+				Error:   &types.Error{Code: CodeParseError, Message: err.Error()},
+			})
+			continue
+		}
+		c.dispatch(ctx, msg)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *Conn) dispatch(ctx context.Context, msg types.ACPRequest) {
+	if msg.Method == "" {
+		key := fmt.Sprint(msg.ID)
+		c.mu.Lock()
+		ch, ok := c.pending[key]
+		delete(c.pending, key)
+		c.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+		return
+	}
+
+	if msg.ID == nil {
+		c.handler(ctx, msg.Method, msg.Params)
+		return
+	}
+
+	go func() {
+		after := &afterReply{}
+		result, err := c.handler(context.WithValue(ctx, afterReplyKey{}, after), msg.Method, msg.Params)
+		c.reply(msg.ID, result, err)
+		after.run()
+	}()
+}
+
+type afterReplyKey struct{}
+
+type afterReply struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+func (a *afterReply) run() {
+	a.mu.Lock()
+	fns := a.fns
+	a.fns = nil
+	a.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// AfterReply schedules fn to run once the response to the request handled
+// with ctx has been written, for notifications the peer can only make sense
+// of after the response, such as updates about a session it creates. Outside
+// a request handler fn runs at once.
+func AfterReply(ctx context.Context, fn func()) {
+	after, ok := ctx.Value(afterReplyKey{}).(*afterReply)
+	if !ok {
+		fn()
+		return
+	}
+	after.mu.Lock()
+	after.fns = append(after.fns, fn)
+	after.mu.Unlock()
+}
+
+func (c *Conn) reply(id any, result any, err error) error {
+	resp := types.ACPResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+	}
+	if err != nil {
+		var rpcErr *types.Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &types.Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+	} else {
+		if result == nil {
+			result = map[string]any{}
+		}
+		resp.Result = result
+	}
+	return c.writeMessage(resp)
+}
+
+// Notify sends a notification to the peer.
+func (c *Conn) Notify(method string, params any) error {
+	return c.writeMessage(types.ACPNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// Call sends a request to the peer and waits for its response. When result
+// is non-nil the response result is decoded into it.
+func (c *Conn) Call(ctx context.Context, method string, params any, result any) error {
+	c.mu.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	ch := make(chan types.ACPRequest, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req := struct {
+		JSONRPC string `json:"jsonrpc"`
+		ID      string `json:"id"`
+		Method  string `json:"method"`
+		Params  any    `json:"params,omitempty"`
+	}{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+		Params:  params,
+	}
+	if err := c.writeMessage(req); err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return io.ErrUnexpectedEOF
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Conn) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Conn) writeMessage(msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if trace := c.tracer(); trace != nil {
+		trace(true, b)
+	}
+	_, err = fmt.Fprintln(c.w, string(b))
+	return err
+}
+
+// ErrMethodNotFound reports that the agent does not implement method.
+func ErrMethodNotFound(method string) error {
+	return &types.Error{Code: CodeMethodNotFound, Message: "method not found: " + method}
+}
+
+// ErrInvalidParams reports that the request parameters could not be decoded.
+func ErrInvalidParams(err error) error {
+	return &types.Error{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+}
+
+// ErrInternal wraps err as a JSON-RPC internal error.
+func ErrInternal(err error) error {
+	return &types.Error{Code: CodeInternalError, Message: err.Error()}
+}
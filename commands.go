@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"droid-acp/types"
+)
+
+// commandsDir holds custom commands as Markdown files, both in the project
+// and in the user's home; project commands win over user commands.
+const commandsDir = ".factory/commands"
+
+// command is a slash command offered to Zed.
+type command struct {
+	Name        string
+	Description string
+	Hint        string
+	// Source is "builtin", "project" or "user".
+	Source string
+	// Template is the prompt a custom command expands to; $ARGUMENTS is
+	// replaced by what follows the command name.
+	Template string
+	// run handles a built-in command. It returns the text to send to Droid,
+	// or "" when the command was handled locally.
+	run func(a *droidAgent, ctx context.Context, args string) (string, error)
+}
+
+// reviewPrompt is what /review asks Droid to do.
+const reviewPrompt = `Review the uncommitted changes in this repository (use git diff and git status). ` +
+	`Point out bugs, risky changes, missing tests and style problems, ordered by severity, ` +
+	`with file and line references. Do not modify any files.`
+
+var builtinCommands = []command{
+	{
+		Name:        "compact",
+		Description: "Summarize the conversation to free up context",
+		run: func(a *droidAgent, ctx context.Context, args string) (string, error) {
+			return strings.TrimSpace("/compact " + args), nil
+		},
+	},
+	{
+		Name:        "review",
+		Description: "Review the uncommitted changes",
+		Hint:        "what to focus on (optional)",
+		run: func(a *droidAgent, ctx context.Context, args string) (string, error) {
+			if args == "" {
+				return reviewPrompt, nil
+			}
+			return reviewPrompt + "\n\nFocus on: " + args, nil
+		},
+	},
+	{
+		Name:        "model",
+		Description: "Switch the model of this session",
+		Hint:        "model ID",
+		run:         (*droidAgent).modelCommand,
+	},
+	{
+		Name:        "mode",
+		Description: "Switch the mode of this session",
+		Hint:        "spec, normal, auto-low, auto-medium or auto-high",
+		run:         (*droidAgent).modeCommand,
+	},
+	{
+		Name:        "undo",
+		Description: "Restore the files changed in the last turns",
+		Hint:        "number of turns (default 1), force",
+		run:         (*droidAgent).undoCommand,
+	},
+	{
+		Name:        "export",
+		Description: "Export this session as a document",
+		Hint:        "md, json or html; thoughts; file name (all optional)",
+		run:         (*droidAgent).exportCommand,
+	},
+}
+
+// loadCommands returns the built-in commands followed by the custom
+// commands found for a session rooted at cwd, sorted by name.
+func loadCommands(cwd string, log func(msg string, args ...any)) []command {
+	commands := append([]command(nil), builtinCommands...)
+	seen := make(map[string]bool)
+	for i := range commands {
+		commands[i].Source = "builtin"
+		seen[commands[i].Name] = true
+	}
+
+	var dirs []struct{ path, source string }
+	if cwd != "" {
+		dirs = append(dirs, struct{ path, source string }{filepath.Join(cwd, commandsDir), "project"})
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, struct{ path, source string }{filepath.Join(home, commandsDir), "user"})
+	}
+
+	var custom []command
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir.path)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".md" {
+				continue
+			}
+			path := filepath.Join(dir.path, entry.Name())
+			b, err := os.ReadFile(path)
+			if err != nil {
+				log("failed to read custom command", "path", path, "err", err)
+				continue
+			}
+			c := parseCommand(strings.TrimSuffix(entry.Name(), ".md"), string(b))
+			if seen[c.Name] {
+				if c.Name != "" {
+					log("ignoring custom command that is already defined", "path", path, "command", c.Name)
+				}
+				continue
+			}
+			seen[c.Name] = true
+			c.Source = dir.source
+			custom = append(custom, c)
+		}
+	}
+	sort.Slice(custom, func(i, j int) bool { return custom[i].Name < custom[j].Name })
+	return append(commands, custom...)
+}
+
+// parseCommand reads a custom command file: optional front matter with
+// description and argument-hint, followed by the prompt template.
+func parseCommand(name, src string) command {
+	c := command{Name: strings.ToLower(strings.TrimSpace(name))}
+	body := strings.ReplaceAll(src, "\r\n", "\n")
+	if rest, ok := strings.CutPrefix(body, "---\n"); ok {
+		if front, after, ok := strings.Cut(rest, "\n---"); ok {
+			body = strings.TrimPrefix(after, "\n")
+			for _, line := range strings.Split(front, "\n") {
+				key, value, ok := strings.Cut(line, ":")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"'`)
+				switch strings.TrimSpace(key) {
+				case "description":
+					c.Description = value
+				case "argument-hint":
+					c.Hint = value
+				}
+			}
+		}
+	}
+	c.Template = strings.TrimSpace(body)
+	if c.Description == "" {
+		c.Description = firstLine(c.Template)
+	}
+	return c
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	line = strings.TrimSpace(strings.TrimLeft(line, "# "))
+	if len(line) > 80 {
+		line = line[:77] + "..."
+	}
+	return line
+}
+
+// availableCommands converts commands for available_commands_update.
+func availableCommands(commands []command) []types.AvailableCommand {
+	list := make([]types.AvailableCommand, 0, len(commands))
+	for _, c := range commands {
+		ac := types.AvailableCommand{Name: c.Name, Description: c.Description}
+		if c.Hint != "" {
+			ac.Input = &types.AvailableCommandInput{Hint: c.Hint}
+		}
+		list = append(list, ac)
+	}
+	return list
+}
+
+// expandCommand turns a prompt starting with "/name" into what is sent to
+// Droid. ok is false when text is not a known command; an empty result
+// means the command was handled locally.
+func (a *droidAgent) expandCommand(ctx context.Context, text string) (result string, ok bool, err error) {
+	line := strings.TrimSpace(text)
+	if !strings.HasPrefix(line, "/") {
+		return "", false, nil
+	}
+	name, args, _ := strings.Cut(line[1:], " ")
+	args = strings.TrimSpace(args)
+
+	a.mu.Lock()
+	commands := a.commands
+	a.mu.Unlock()
+	for _, c := range commands {
+		if c.Name != name {
+			continue
+		}
+		a.acpLog.Info("running slash command", "command", name, "source", c.Source)
+		if c.run != nil {
+			result, err := c.run(a, ctx, args)
+			return result, true, err
+		}
+		if strings.Contains(c.Template, "$ARGUMENTS") {
+			return strings.ReplaceAll(c.Template, "$ARGUMENTS", args), true, nil
+		}
+		if args != "" {
+			return c.Template + "\n\n" + args, true, nil
+		}
+		return c.Template, true, nil
+	}
+	return "", false, nil
+}
+
+func (a *droidAgent) modelCommand(ctx context.Context, args string) (string, error) {
+	a.mu.Lock()
+	sessionID := a.currentSession
+	models := a.models
+	a.mu.Unlock()
+
+	if args == "" {
+		var lines []string
+		for _, m := range models {
+			lines = append(lines, fmt.Sprintf("- `%s` %s", m.ModelId, m.Name))
+		}
+		a.agentMessage("Available models:\n" + strings.Join(lines, "\n"))
+		return "", nil
+	}
+	for _, m := range models {
+		if string(m.ModelId) == args || strings.EqualFold(m.Name, args) {
+			err := a.SetSessionModel(ctx, types.SetModelParams{SessionId: sessionID, ModelID: m.ModelId})
+			if err != nil {
+				return "", err
+			}
+			a.agentMessage("Switched model to " + m.Name + ".")
+			return "", nil
+		}
+	}
+	a.agentMessage(fmt.Sprintf("Unknown model %q. Run /model to list the available models.", args))
+	return "", nil
+}
+
+func (a *droidAgent) modeCommand(ctx context.Context, args string) (string, error) {
+	a.mu.Lock()
+	sessionID := a.currentSession
+	modes := a.modes
+	a.mu.Unlock()
+
+	if !hasMode(modes, args) {
+		var ids []string
+		for _, m := range modes {
+			ids = append(ids, m.Id)
+		}
+		a.agentMessage(fmt.Sprintf("Unknown mode %q. Available modes: %s.", args, strings.Join(ids, ", ")))
+		return "", nil
+	}
+	if err := a.SetSessionMode(ctx, types.SetModeParams{SessionId: sessionID, ModeId: args}); err != nil {
+		return "", err
+	}
+	a.sessionUpdate(types.Update{
+		SessionUpdate: "current_mode_update",
+		CurrentModeId: args,
+	})
+	a.agentMessage("Switched mode to " + args + ".")
+	return "", nil
+}
+
+// agentMessage shows text from droid-acp itself in the conversation.
+func (a *droidAgent) agentMessage(text string) {
+	a.sessionUpdate(types.Update{
+		SessionUpdate: "agent_message_chunk",
+		Content:       &types.Content{Type: "text", Text: text},
+	})
+}
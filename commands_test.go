@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"droid-acp/droid"
+	"droid-acp/droid/droidtest"
+	"droid-acp/types"
+)
+
+func TestParseCommand(t *testing.T) {
+	c := parseCommand("Release-Notes", "---\ndescription: \"Draft release notes\"\nargument-hint: <version>\n---\nWrite release notes for $ARGUMENTS.\n")
+	if c.Name != "release-notes" || c.Description != "Draft release notes" || c.Hint != "<version>" {
+		t.Errorf("parseCommand = %+v", c)
+	}
+	if c.Template != "Write release notes for $ARGUMENTS." {
+		t.Errorf("template = %q", c.Template)
+	}
+
+	c = parseCommand("triage", "# Triage open issues\n\nList them.")
+	if c.Description != "Triage open issues" {
+		t.Errorf("description without front matter = %q", c.Description)
+	}
+}
+
+func TestSlashCommands(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, commandsDir), 0o755)
+	os.WriteFile(filepath.Join(dir, commandsDir, "release-notes.md"), []byte("---\ndescription: Draft release notes\n---\nWrite release notes for $ARGUMENTS."), 0o600)
+
+	_, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns:   [][]droidtest.Step{{droidtest.Idle()}},
+	})
+	session, err := client.NewSession(testContext(t), dir)
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "/mode auto-high"); err != nil {
+		t.Fatalf("/mode: %v", err)
+	}
+	if _, err := client.Prompt(testContext(t), session.SessionId, "/release-notes v1.1.0"); err != nil {
+		t.Fatalf("/release-notes: %v", err)
+	}
+
+	// Updates are read in order, so the commands sent after session/new
+	// have arrived once a prompt has returned.
+	var names []string
+	for _, u := range client.Updates() {
+		if u.Update.SessionUpdate == "available_commands_update" {
+			if u.SessionId != session.SessionId {
+				t.Errorf("commands sent for session %q", u.SessionId)
+			}
+			for _, c := range u.Update.AvailableCommands {
+				names = append(names, c.Name)
+			}
+		}
+	}
+	if got := strings.Join(names, ","); got != "compact,review,model,mode,undo,export,release-notes" {
+		t.Errorf("available commands = %s", got)
+	}
+
+	msgs := fake.Requests(droid.MethodAddUserMessage)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d add_user_message requests, want only the expanded custom command", len(msgs))
+	}
+	var params types.AddUserMessageParams
+	json.Unmarshal(msgs[0].Params, &params)
+	if params.Text != "Write release notes for v1.1.0." {
+		t.Errorf("sent text = %q", params.Text)
+	}
+	var settings types.UpdateSessionSettingsParams
+	reqs := fake.Requests(droid.MethodUpdateSessionSettings)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d update_session_settings requests, want 1", len(reqs))
+	}
+	json.Unmarshal(reqs[0].Params, &settings)
+	if settings.AutonomyLevel != "auto-high" {
+		t.Errorf("/mode sent %+v", settings)
+	}
+}
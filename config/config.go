@@ -0,0 +1,445 @@
+// Package config resolves droid-acp settings from layered sources: built-in
+// defaults, the user config file, a project file in the session cwd,
+// environment variables and command-line flags, in increasing precedence.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"droid-acp/usage"
+)
+
+// Permission policies for a class of tool use.
+const (
+	PolicyAsk   = "ask"
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// AutonomyLevels are the modes Droid is known to accept: spec mode and
+// the autonomy levels.
+var AutonomyLevels = []string{"spec", "normal", "auto-low", "auto-medium", "auto-high"}
+
+type Config struct {
+	Model       ModelConfig      `json:"model"`
+	Autonomy    AutonomyConfig   `json:"autonomy"`
+	Droid       DroidConfig      `json:"droid"`
+	Log         LogConfig        `json:"log"`
+	Redact      RedactConfig     `json:"redact"`
+	Permissions PermissionConfig `json:"permissions"`
+	Usage       UsageConfig      `json:"usage"`
+	Limits      LimitsConfig     `json:"limits"`
+	Prompts     PromptsConfig    `json:"prompts"`
+	Status      StatusConfig     `json:"status"`
+	Sessions    SessionsConfig   `json:"sessions"`
+	Undo        UndoConfig       `json:"undo"`
+	Git         GitConfig        `json:"git"`
+	// StateDir holds droid-acp's own data such as session metadata.
+	StateDir string `json:"stateDir"`
+}
+
+type ModelConfig struct {
+	// Filter selects which models are offered: all, common or custom.
+	Filter string `json:"filter"`
+	// Default is the model applied to every new session.
+	Default string `json:"default"`
+	// Providers keeps only models from these providers, e.g. anthropic.
+	Providers []string `json:"providers"`
+	// Allow keeps only these model IDs.
+	Allow []string `json:"allow"`
+	// Include and Exclude match model IDs against globs, or regular
+	// expressions written as /regex/.
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// Aliases renames models in the picker, keyed by model ID.
+	Aliases map[string]string `json:"aliases"`
+	// Pinned lists model IDs shown first, in this order.
+	Pinned []string `json:"pinned"`
+}
+
+type AutonomyConfig struct {
+	// Default is the autonomy level applied to every new session.
+	Default string `json:"default"`
+}
+
+// DroidConfig describes how the Droid subprocess is launched.
+type DroidConfig struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Env is added to droid-acp's own environment, e.g. proxy settings.
+	Env map[string]string `json:"env"`
+	// Dir is the working directory of the Droid process.
+	Dir string `json:"dir"`
+}
+
+type LogConfig struct {
+	Level        string `json:"level"`
+	File         string `json:"file"`
+	MaxSizeMB    int    `json:"maxSizeMB"`
+	PayloadLimit int    `json:"payloadLimit"`
+}
+
+type RedactConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Patterns []string `json:"patterns"`
+}
+
+// PermissionConfig decides how Droid permission requests are answered:
+// ask forwards them to the editor, allow and deny answer them directly.
+type PermissionConfig struct {
+	Edits    string `json:"edits"`
+	Commands string `json:"commands"`
+}
+
+type UsageConfig struct {
+	// Summary shows token usage and cost at the end of every turn.
+	Summary bool `json:"summary"`
+	// Ledger records every turn in usage.jsonl under the state dir.
+	Ledger bool `json:"ledger"`
+	// Prices overrides and extends usage.DefaultPrices, keyed by model ID
+	// prefix.
+	Prices map[string]usage.Price `json:"prices"`
+}
+
+// Ways to handle a prompt sent while Droid is still working on a turn.
+const (
+	// WhileBusyQueue runs the prompt as its own turn once the current one
+	// has ended.
+	WhileBusyQueue = "queue"
+	// WhileBusySteer sends the prompt to Droid right away, so it steers the
+	// running turn.
+	WhileBusySteer = "steer"
+)
+
+type PromptsConfig struct {
+	WhileBusy string `json:"whileBusy"`
+}
+
+// StatusConfig decides how Droid's working state is shown.
+type StatusConfig struct {
+	// Messages shows compaction as thoughts in the thread.
+	Messages bool `json:"messages"`
+	// SessionInfo sends the state with session_info_update, for clients
+	// that display it.
+	SessionInfo bool `json:"sessionInfo"`
+	// TurnSummary lists the files changed and commands run when a turn
+	// ends, with a combined diff.
+	TurnSummary bool `json:"turnSummary"`
+}
+
+type SessionsConfig struct {
+	// Transcripts records what happens in each session next to its
+	// metadata, for forking and export.
+	Transcripts bool `json:"transcripts"`
+}
+
+// What to record in git when a turn ends.
+const (
+	GitTurnsOff = "off"
+	// GitTurnsCommit commits the turn's changes to the current branch.
+	GitTurnsCommit = "commit"
+	// GitTurnsRef keeps the turn's changes as a commit outside any branch,
+	// under refs/droid-acp/.
+	GitTurnsRef = "ref"
+)
+
+type GitConfig struct {
+	Turns string `json:"turns"`
+}
+
+type UndoConfig struct {
+	// Snapshots keeps the previous content of every file droid-acp
+	// writes, so /undo can restore it.
+	Snapshots bool `json:"snapshots"`
+}
+
+// LimitsConfig bounds how much a session and each of its turns may use.
+type LimitsConfig struct {
+	Session Limits `json:"session"`
+	Turn    Limits `json:"turn"`
+}
+
+// Limits are guardrails for unattended work; zero values mean no limit.
+type Limits struct {
+	// MaxTokens counts all tokens except cached input.
+	MaxTokens    int64   `json:"maxTokens"`
+	MaxCostUSD   float64 `json:"maxCostUsd"`
+	MaxToolCalls int     `json:"maxToolCalls"`
+	// MaxDuration is a Go duration such as "15m"; for a session it bounds
+	// the time spent in turns, not the time the session is open.
+	MaxDuration string `json:"maxDuration"`
+}
+
+// Duration returns MaxDuration parsed, or 0 for no limit.
+func (l Limits) Duration() time.Duration {
+	d, _ := time.ParseDuration(l.MaxDuration)
+	return d
+}
+
+func (l Limits) validate(key string) error {
+	if l.MaxTokens < 0 || l.MaxCostUSD < 0 || l.MaxToolCalls < 0 {
+		return fmt.Errorf("%s: limits must not be negative", key)
+	}
+	if l.MaxDuration != "" {
+		d, err := time.ParseDuration(l.MaxDuration)
+		if _, numErr := strconv.ParseFloat(l.MaxDuration, 64); err != nil && numErr == nil {
+			return fmt.Errorf("%s.maxDuration: duration %q needs a unit; use a value such as %ss or %sm", key, l.MaxDuration, l.MaxDuration, l.MaxDuration)
+		}
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s.maxDuration: invalid duration %q; use a value such as 30m or 1h", key, l.MaxDuration)
+		}
+	}
+	return nil
+}
+
+// Layer is a partial configuration read from one source.
+type Layer struct {
+	// Source names the layer in error messages, e.g. a file path.
+	Source string
+	Values map[string]any
+}
+
+// Defaults is the lowest-precedence layer.
+func Defaults() Layer {
+	return Layer{
+		Source: "defaults",
+		Values: map[string]any{
+			"model": map[string]any{"filter": "all"},
+			"droid": map[string]any{"path": "droid"},
+			"log": map[string]any{
+				"level":        "info",
+				"maxSizeMB":    10,
+				"payloadLimit": 512,
+			},
+			"redact": map[string]any{"enabled": true},
+			"permissions": map[string]any{
+				"edits":    PolicyAsk,
+				"commands": PolicyAsk,
+			},
+			"usage": map[string]any{
+				"summary": true,
+				"ledger":  true,
+			},
+			"prompts":  map[string]any{"whileBusy": WhileBusyQueue},
+			"status":   map[string]any{"messages": true, "turnSummary": true},
+			"sessions": map[string]any{"transcripts": true},
+			"undo":     map[string]any{"snapshots": true},
+			"git":      map[string]any{"turns": GitTurnsOff},
+			"stateDir": defaultStateDir(),
+		},
+	}
+}
+
+// Set stores value at a dotted key such as "log.level".
+func (l *Layer) Set(key string, value any) {
+	parts := strings.Split(key, ".")
+	l.table(parts[:len(parts)-1])[parts[len(parts)-1]] = value
+}
+
+// SetEntry stores value under name in the table at a dotted key; name is
+// used as is, so it may contain dots.
+func (l *Layer) SetEntry(key, name string, value any) {
+	l.table(strings.Split(key, "."))[name] = value
+}
+
+// table returns the nested table at path, creating it as needed.
+func (l *Layer) table(path []string) map[string]any {
+	if l.Values == nil {
+		l.Values = make(map[string]any)
+	}
+	m := l.Values
+	for _, p := range path {
+		child, ok := m[p].(map[string]any)
+		if !ok {
+			child = make(map[string]any)
+			m[p] = child
+		}
+		m = child
+	}
+	return m
+}
+
+// Append adds value to the list at a dotted key.
+func (l *Layer) Append(key string, value any) {
+	parts := strings.Split(key, ".")
+	m := l.Values
+	for _, p := range parts[:len(parts)-1] {
+		child, _ := m[p].(map[string]any)
+		m = child
+	}
+	var list []any
+	if m != nil {
+		list, _ = m[parts[len(parts)-1]].([]any)
+	}
+	l.Set(key, append(list, value))
+}
+
+// check decodes the layer on its own so unknown keys and type mismatches
+// are reported against the source they came from.
+func (l Layer) check() error {
+	if len(l.Values) == 0 {
+		return nil
+	}
+	var c Config
+	if err := decodeStrict(l.Values, &c); err != nil {
+		return fmt.Errorf("%s: %w", l.Source, err)
+	}
+	return nil
+}
+
+// Resolve merges layers, later ones winning, and validates the result.
+func Resolve(layers ...Layer) (*Config, error) {
+	merged := map[string]any{}
+	for _, l := range layers {
+		if err := l.check(); err != nil {
+			return nil, err
+		}
+		merge(merged, l.Values)
+	}
+
+	var c Config
+	if err := decodeStrict(merged, &c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate checks values that decode fine but make no sense.
+func (c *Config) Validate() error {
+	switch c.Model.Filter {
+	case "all", "common", "custom":
+	default:
+		return fmt.Errorf("model.filter: invalid value %q; must be one of common, custom, or all", c.Model.Filter)
+	}
+	for key, patterns := range map[string][]string{
+		"model.include": c.Model.Include,
+		"model.exclude": c.Model.Exclude,
+	} {
+		for _, p := range patterns {
+			if _, err := CompilePattern(p); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	if c.Autonomy.Default != "" && !slices.Contains(AutonomyLevels, c.Autonomy.Default) {
+		return fmt.Errorf("autonomy.default: invalid value %q; must be one of %s", c.Autonomy.Default, strings.Join(AutonomyLevels, ", "))
+	}
+	if strings.TrimSpace(c.Droid.Path) == "" {
+		return fmt.Errorf("droid.path: must not be empty")
+	}
+	for name := range c.Droid.Env {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("droid.env: invalid variable name %q", name)
+		}
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		return fmt.Errorf("log.level: invalid value %q; must be one of debug, info, warn, or error", c.Log.Level)
+	}
+	if c.Log.MaxSizeMB < 0 {
+		return fmt.Errorf("log.maxSizeMB: must not be negative")
+	}
+	if c.Log.PayloadLimit < 0 {
+		return fmt.Errorf("log.payloadLimit: must not be negative; use 0 for no limit")
+	}
+	for key, policy := range map[string]string{
+		"permissions.edits":    c.Permissions.Edits,
+		"permissions.commands": c.Permissions.Commands,
+	} {
+		switch policy {
+		case PolicyAsk, PolicyAllow, PolicyDeny:
+		default:
+			return fmt.Errorf("%s: invalid value %q; must be one of ask, allow, or deny", key, policy)
+		}
+	}
+	if err := c.Limits.Session.validate("limits.session"); err != nil {
+		return err
+	}
+	if err := c.Limits.Turn.validate("limits.turn"); err != nil {
+		return err
+	}
+	switch c.Prompts.WhileBusy {
+	case WhileBusyQueue, WhileBusySteer:
+	default:
+		return fmt.Errorf("prompts.whileBusy: invalid value %q; must be queue or steer", c.Prompts.WhileBusy)
+	}
+	switch c.Git.Turns {
+	case GitTurnsOff, GitTurnsCommit, GitTurnsRef:
+	default:
+		return fmt.Errorf("git.turns: invalid value %q; must be off, commit or ref", c.Git.Turns)
+	}
+	if strings.TrimSpace(c.StateDir) == "" {
+		return fmt.Errorf("stateDir: must not be empty")
+	}
+	return nil
+}
+
+// CompilePattern compiles a model pattern: /regex/ is a regular expression,
+// anything else a glob where * and ? match any run or any one character.
+// Both must match the whole ID.
+func CompilePattern(p string) (*regexp.Regexp, error) {
+	if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		re, err := regexp.Compile("^(?:" + p[1:len(p)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		return re, nil
+	}
+	glob := regexp.QuoteMeta(p)
+	glob = strings.ReplaceAll(glob, `\*`, ".*")
+	glob = strings.ReplaceAll(glob, `\?`, ".")
+	return regexp.MustCompile("^" + glob + "$"), nil
+}
+
+func decodeStrict(values map[string]any, v any) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return cleanDecodeError(err)
+	}
+	return nil
+}
+
+// cleanDecodeError rewrites encoding/json errors in terms of config keys.
+func cleanDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("%s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	msg := err.Error()
+	if rest, ok := strings.CutPrefix(msg, "json: unknown field "); ok {
+		return fmt.Errorf("unknown setting %s", rest)
+	}
+	return err
+}
+
+func merge(dst, src map[string]any) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]any); ok {
+			dm, ok := dst[k].(map[string]any)
+			if !ok {
+				dm = make(map[string]any)
+				dst[k] = dm
+			}
+			merge(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	src := `
+# droid-acp settings
+stateDir = "/tmp/state" # trailing comment
+
+[model]
+filter = 'custom'
+
+[log]
+level = "debug"
+maxSizeMB = 5
+
+[droid]
+args = [
+  "--verbose",
+  "--flag=a#b",
+]
+
+[permissions]
+edits = "allow"
+
+[model.aliases]
+"gpt-5.1-codex" = "Codex"
+'custom:glm-4.7' = "GLM"
+
+[usage.prices."claude-sonnet-4.5"]
+input = 3.0
+`
+	got, err := parseTOML(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"stateDir": "/tmp/state",
+		"model": map[string]any{
+			"filter":  "custom",
+			"aliases": map[string]any{"gpt-5.1-codex": "Codex", "custom:glm-4.7": "GLM"},
+		},
+		"usage":       map[string]any{"prices": map[string]any{"claude-sonnet-4.5": map[string]any{"input": 3.0}}},
+		"log":         map[string]any{"level": "debug", "maxSizeMB": 5},
+		"droid":       map[string]any{"args": []any{"--verbose", "--flag=a#b"}},
+		"permissions": map[string]any{"edits": "allow"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTOML =\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	user := filepath.Join(dir, "config.json")
+	os.WriteFile(user, []byte(`{"model": {"filter": "custom"}, "log": {"level": "warn"}}`), 0o600)
+	os.WriteFile(filepath.Join(dir, ".droid-acp.toml"), []byte("[model]\nfilter = \"common\"\n[status]\nmessages = false\n"), 0o600)
+
+	userLayer, err := LoadFile(user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectLayer, err := LoadProject(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envLayer, err := FromEnv([]string{"DROID_ACP_LOG_LEVEL=error", "UNRELATED=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagLayer := Layer{Source: "flags"}
+	flagLayer.Set("permissions.commands", PolicyAsk)
+
+	c, err := Resolve(Defaults(), userLayer, projectLayer, envLayer, flagLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Model.Filter != "common" {
+		t.Errorf("model.filter = %q, want project value common", c.Model.Filter)
+	}
+	if c.Log.Level != "error" {
+		t.Errorf("log.level = %q, want env value error", c.Log.Level)
+	}
+	if c.Permissions.Commands != PolicyAsk {
+		t.Errorf("permissions.commands = %q, want flag value ask", c.Permissions.Commands)
+	}
+	if c.Permissions.Edits != PolicyAsk || c.Droid.Path != "droid" {
+		t.Errorf("defaults were lost: %+v", c)
+	}
+}
+
+func TestProjectKeys(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".droid-acp.json"), []byte(`{"model": {"filter": "common"}, "permissions": {"commands": "allow"}}`), 0o600)
+	_, err := LoadProject(dir)
+	if err == nil || !strings.Contains(err.Error(), `"permissions" cannot be set in a project file`) {
+		t.Errorf("LoadProject error = %v", err)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]any
+		want   string
+	}{
+		{"unknown key", map[string]any{"modle": map[string]any{}}, `user.json: unknown setting "modle"`},
+		{"wrong type", map[string]any{"log": map[string]any{"maxSizeMB": "ten"}}, "user.json: log.maxSizeMB: expected int"},
+		{"bad filter", map[string]any{"model": map[string]any{"filter": "some"}}, "model.filter: invalid value"},
+		{"bad policy", map[string]any{"permissions": map[string]any{"edits": "maybe"}}, "permissions.edits: invalid value"},
+		{"bad pattern", map[string]any{"model": map[string]any{"include": []any{"/gpt-(/"}}}, "model.include: invalid pattern"},
+		{"bad duration", map[string]any{"limits": map[string]any{"turn": map[string]any{"maxDuration": "10 minutes"}}}, "limits.turn.maxDuration: invalid duration"},
+		{"duration without unit", map[string]any{"limits": map[string]any{"session": map[string]any{"maxDuration": "30"}}}, `limits.session.maxDuration: duration "30" needs a unit; use a value such as 30s or 30m`},
+		{"bad while busy", map[string]any{"prompts": map[string]any{"whileBusy": "drop"}}, "prompts.whileBusy: invalid value"},
+		{"bad git turns", map[string]any{"git": map[string]any{"turns": "stash"}}, "git.turns: invalid value"},
+		{"bad autonomy", map[string]any{"autonomy": map[string]any{"default": "auto-max"}}, "autonomy.default: invalid value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Resolve(Defaults(), Layer{Source: "user.json", Values: tt.values})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Resolve error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
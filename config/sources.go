@@ -0,0 +1,208 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ProjectFiles are looked up in the session cwd, first match wins.
+var ProjectFiles = []string{".droid-acp.json", ".droid-acp.toml"}
+
+// ProjectKeys are the top-level keys a project file may set. A cloned
+// repository must not be able to change permissions, redaction, where
+// data is written or what runs, so everything else is left to the user
+// file, environment and flags. Custom slash commands come from
+// .factory/commands rather than the config.
+var ProjectKeys = []string{"model", "autonomy", "status"}
+
+// envVars maps environment variables to config keys.
+var envVars = []struct {
+	name string
+	key  string
+	kind string
+}{
+	{"DROID_ACP_MODEL_FILTER", "model.filter", "string"},
+	{"DROID_ACP_DEFAULT_MODEL", "model.default", "string"},
+	{"DROID_ACP_MODEL_PROVIDERS", "model.providers", "list"},
+	{"DROID_ACP_MODEL_ALLOW", "model.allow", "list"},
+	{"DROID_ACP_MODEL_INCLUDE", "model.include", "list"},
+	{"DROID_ACP_MODEL_EXCLUDE", "model.exclude", "list"},
+	{"DROID_ACP_MODEL_PINNED", "model.pinned", "list"},
+	{"DROID_ACP_DEFAULT_AUTONOMY", "autonomy.default", "string"},
+	{"DROID_ACP_DROID_PATH", "droid.path", "string"},
+	{"DROID_ACP_DROID_ARGS", "droid.args", "list"},
+	{"DROID_ACP_DROID_DIR", "droid.dir", "string"},
+	{"DROID_ACP_LOG_LEVEL", "log.level", "string"},
+	{"DROID_ACP_LOG_FILE", "log.file", "string"},
+	{"DROID_ACP_LOG_MAX_SIZE_MB", "log.maxSizeMB", "int"},
+	{"DROID_ACP_LOG_PAYLOAD_LIMIT", "log.payloadLimit", "int"},
+	{"DROID_ACP_REDACT", "redact.enabled", "bool"},
+	{"DROID_ACP_PERMISSIONS_EDITS", "permissions.edits", "string"},
+	{"DROID_ACP_PERMISSIONS_COMMANDS", "permissions.commands", "string"},
+	{"DROID_ACP_USAGE_SUMMARY", "usage.summary", "bool"},
+	{"DROID_ACP_USAGE_LEDGER", "usage.ledger", "bool"},
+	{"DROID_ACP_SESSION_MAX_TOKENS", "limits.session.maxTokens", "int"},
+	{"DROID_ACP_SESSION_MAX_COST_USD", "limits.session.maxCostUsd", "float"},
+	{"DROID_ACP_SESSION_MAX_TOOL_CALLS", "limits.session.maxToolCalls", "int"},
+	{"DROID_ACP_SESSION_MAX_DURATION", "limits.session.maxDuration", "string"},
+	{"DROID_ACP_TURN_MAX_TOKENS", "limits.turn.maxTokens", "int"},
+	{"DROID_ACP_TURN_MAX_COST_USD", "limits.turn.maxCostUsd", "float"},
+	{"DROID_ACP_TURN_MAX_TOOL_CALLS", "limits.turn.maxToolCalls", "int"},
+	{"DROID_ACP_TURN_MAX_DURATION", "limits.turn.maxDuration", "string"},
+	{"DROID_ACP_PROMPTS_WHILE_BUSY", "prompts.whileBusy", "string"},
+	{"DROID_ACP_STATUS_MESSAGES", "status.messages", "bool"},
+	{"DROID_ACP_STATUS_SESSION_INFO", "status.sessionInfo", "bool"},
+	{"DROID_ACP_STATUS_TURN_SUMMARY", "status.turnSummary", "bool"},
+	{"DROID_ACP_SESSION_TRANSCRIPTS", "sessions.transcripts", "bool"},
+	{"DROID_ACP_UNDO_SNAPSHOTS", "undo.snapshots", "bool"},
+	{"DROID_ACP_GIT_TURNS", "git.turns", "string"},
+	{"DROID_ACP_STATE_DIR", "stateDir", "string"},
+}
+
+// UserFile returns the path of the user config file: $DROID_ACP_CONFIG if
+// set, otherwise config.json or config.toml under the user config dir
+// (honouring XDG_CONFIG_HOME).
+func UserFile() string {
+	if path := os.Getenv("DROID_ACP_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{"config.json", "config.toml"} {
+		path := filepath.Join(dir, "droid-acp", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, "droid-acp", "config.json")
+}
+
+// LoadFile reads a JSON or TOML layer. A missing file yields an empty
+// layer when optional is true.
+func LoadFile(path string, optional bool) (Layer, error) {
+	layer := Layer{Source: path}
+	if path == "" {
+		return layer, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return layer, nil
+		}
+		return layer, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		layer.Values, err = parseTOML(string(b))
+	default:
+		err = json.Unmarshal(b, &layer.Values)
+	}
+	if err != nil {
+		return layer, fmt.Errorf("%s: %w", path, err)
+	}
+	return layer, nil
+}
+
+// LoadProject reads the project layer from cwd, if there is one. Keys
+// outside ProjectKeys are an error.
+func LoadProject(cwd string) (Layer, error) {
+	for _, name := range ProjectFiles {
+		path := filepath.Join(cwd, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		layer, err := LoadFile(path, false)
+		if err != nil {
+			return layer, err
+		}
+		for _, key := range slices.Sorted(maps.Keys(layer.Values)) {
+			if !slices.Contains(ProjectKeys, key) {
+				return layer, fmt.Errorf("%s: %q cannot be set in a project file, only %s; set it in the user config file, the environment or a flag",
+					path, key, strings.Join(ProjectKeys, ", "))
+			}
+		}
+		return layer, nil
+	}
+	return Layer{Source: "project"}, nil
+}
+
+// FromEnv builds the environment layer from environ ("KEY=value" pairs).
+func FromEnv(environ []string) (Layer, error) {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	layer := Layer{Source: "environment"}
+	for _, ev := range envVars {
+		raw, ok := env[ev.name]
+		if !ok {
+			continue
+		}
+		value, err := parseValue(ev.kind, raw)
+		if err != nil {
+			return layer, fmt.Errorf("%s: %w", ev.name, err)
+		}
+		layer.Set(ev.key, value)
+	}
+	return layer, nil
+}
+
+func parseValue(kind, raw string) (any, error) {
+	switch kind {
+	case "int":
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", raw)
+		}
+		return n, nil
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", raw)
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", raw)
+		}
+		return b, nil
+	case "list":
+		var list []any
+		for _, f := range strings.Fields(raw) {
+			list = append(list, f)
+		}
+		return list, nil
+	}
+	return raw, nil
+}
+
+func defaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "droid-acp")
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "droid-acp")
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "droid-acp")
+	}
+	return filepath.Join(os.TempDir(), "droid-acp")
+}
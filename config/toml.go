@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML that config files need: tables,
+// dotted keys, strings, integers, floats, booleans and arrays of those.
+func parseTOML(src string) (map[string]any, error) {
+	root := map[string]any{}
+	table := root
+
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: arrays of tables are not supported", lineNo)
+			}
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineNo)
+			}
+			keys, rest, err := parseKey(line[1 : len(line)-1])
+			if err == nil && strings.TrimSpace(rest) != "" {
+				err = fmt.Errorf("unexpected %q in table header", rest)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			table, err = descend(root, keys)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			continue
+		}
+
+		keys, rawValue, err := parseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rawValue = strings.TrimSpace(rawValue)
+		if !strings.HasPrefix(rawValue, "=") {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		rawValue = strings.TrimSpace(rawValue[1:])
+
+		// Arrays may span several lines.
+		if strings.HasPrefix(rawValue, "[") {
+			for !balanced(rawValue) && i+1 < len(lines) {
+				i++
+				rawValue += " " + strings.TrimSpace(stripComment(lines[i]))
+			}
+		}
+
+		value, rest, err := parseTOMLValue(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", lineNo, rest)
+		}
+
+		parent, err := descend(table, keys[:len(keys)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		last := keys[len(keys)-1]
+		if _, exists := parent[last]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineNo, last)
+		}
+		parent[last] = value
+	}
+	return root, nil
+}
+
+func descend(m map[string]any, keys []string) (map[string]any, error) {
+	for _, k := range keys {
+		switch child := m[k].(type) {
+		case nil:
+			next := map[string]any{}
+			m[k] = next
+			m = next
+		case map[string]any:
+			m = child
+		default:
+			return nil, fmt.Errorf("key %q is not a table", k)
+		}
+	}
+	return m, nil
+}
+
+// parseKey parses a dotted key from the start of s and returns its parts
+// and the unconsumed remainder. A quoted part is one key even if it
+// contains dots, as in "gpt-5.1-codex".
+func parseKey(s string) ([]string, string, error) {
+	var keys []string
+	rest := s
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		var key string
+		if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'") {
+			value, after, err := parseTOMLValue(rest)
+			if err != nil {
+				return nil, "", fmt.Errorf("key in %q: %w", s, err)
+			}
+			key, rest = value.(string), after
+		} else {
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, "", fmt.Errorf("empty key in %q", s)
+			}
+			key, rest = rest[:end], rest[end:]
+		}
+		keys = append(keys, key)
+		rest = strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(rest, ".") {
+			return keys, rest, nil
+		}
+		rest = rest[1:]
+	}
+}
+
+// stripComment removes a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// parseTOMLValue parses one value from the start of s and returns the
+// unconsumed remainder.
+func parseTOMLValue(s string) (any, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch s[0] {
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			switch c {
+			case '"':
+				return b.String(), s[i+1:], nil
+			case '\\':
+				if i+1 >= len(s) {
+					return nil, "", fmt.Errorf("unterminated string")
+				}
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case '"', '\\':
+					b.WriteByte(s[i])
+				default:
+					return nil, "", fmt.Errorf("unsupported escape \\%c", s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+
+	case '[':
+		list := []any{}
+		rest := strings.TrimLeft(s[1:], " \t")
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return list, rest[1:], nil
+			}
+			var v any
+			var err error
+			v, rest, err = parseTOMLValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			list = append(list, v)
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimLeft(rest[1:], " \t")
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, ",] \t")
+	if end < 0 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	clean := strings.ReplaceAll(token, "_", "")
+	if n, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return int(n), rest, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		return f, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q", token)
+}
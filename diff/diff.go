@@ -0,0 +1,196 @@
+// Package diff compares texts line by line and writes unified diffs.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// maxTable bounds the size of the table used to find common lines. Larger
+// changes are shown as every old line removed and every new line added.
+const maxTable = 4_000_000
+
+// op is one line of a diff: ' ' kept, '-' removed or '+' added.
+type op struct {
+	kind byte
+	text string
+}
+
+// Stat returns the number of lines added and removed from old to new.
+func Stat(old, new string) (added, removed int) {
+	for _, o := range lineOps(old, new) {
+		switch o.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// Unified returns the unified diff from old to new, with from and to as the
+// file names in its header, or "" if they are equal. Pass /dev/null as the
+// name of the missing side for a created or deleted file.
+func Unified(from, to, old, new string) string {
+	ops := lineOps(old, new)
+	var b strings.Builder
+	for start := 0; start < len(ops); {
+		first := nextChange(ops, start)
+		if first < 0 {
+			break
+		}
+		// Extend the hunk while the next change is close enough for their
+		// context to touch.
+		end := first
+		for {
+			next := nextChange(ops, end+1)
+			if next < 0 || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		lo := max(first-context, start)
+		hi := min(end+context+1, len(ops))
+
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n", from, to)
+		}
+		oldStart, newStart := position(ops, lo)
+		oldLen, newLen := 0, 0
+		for _, o := range ops[lo:hi] {
+			if o.kind != '+' {
+				oldLen++
+			}
+			if o.kind != '-' {
+				newLen++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLen), hunkRange(newStart, newLen))
+		for _, o := range ops[lo:hi] {
+			b.WriteByte(o.kind)
+			b.WriteString(o.text)
+			b.WriteByte('\n')
+		}
+		start = hi
+	}
+	return b.String()
+}
+
+func nextChange(ops []op, from int) int {
+	for i := from; i < len(ops); i++ {
+		if ops[i].kind != ' ' {
+			return i
+		}
+	}
+	return -1
+}
+
+// position returns the 1-based old and new line numbers of ops[i].
+func position(ops []op, i int) (oldLine, newLine int) {
+	oldLine, newLine = 1, 1
+	for _, o := range ops[:i] {
+		if o.kind != '+' {
+			oldLine++
+		}
+		if o.kind != '-' {
+			newLine++
+		}
+	}
+	return oldLine, newLine
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if n == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, n)
+}
+
+// lines splits text into lines without their line endings.
+func lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// lineOps lists the lines of old and new as kept, removed or added, using
+// the longest common subsequence of the lines that differ.
+func lineOps(old, new string) []op {
+	a, b := lines(old), lines(new)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []op
+	for _, line := range a[:prefix] {
+		ops = append(ops, op{' ', line})
+	}
+	ops = append(ops, middleOps(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, op{' ', line})
+	}
+	return ops
+}
+
+func middleOps(a, b []string) []op {
+	var ops []op
+	if len(a)*len(b) > maxTable {
+		for _, line := range a {
+			ops = append(ops, op{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, op{'+', line})
+		}
+		return ops
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, op{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, op{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{'+', b[j]})
+	}
+	return ops
+}
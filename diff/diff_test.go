@@ -0,0 +1,49 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	new := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	want := `--- a/x.txt
++++ b/x.txt
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if got := Unified("a/x.txt", "b/x.txt", old, new); got != want {
+		t.Errorf("Unified =\n%s\nwant\n%s", got, want)
+	}
+	if got := Unified("a", "b", old, old); got != "" {
+		t.Errorf("Unified of equal texts = %q", got)
+	}
+	if got, want := Unified("/dev/null", "b/new", "", "x\ny\n"), "--- /dev/null\n+++ b/new\n@@ -0,0 +1,2 @@\n+x\n+y\n"; got != want {
+		t.Errorf("Unified of a created file = %q, want %q", got, want)
+	}
+}
+
+func TestStat(t *testing.T) {
+	for _, tc := range []struct {
+		old, new       string
+		added, removed int
+	}{
+		{"", "a\nb\n", 2, 0},
+		{"a\nb\n", "", 0, 2},
+		{"a\nb\nc\n", "a\nx\nc\n", 1, 1},
+		{"a\n", "a\n", 0, 0},
+	} {
+		added, removed := Stat(tc.old, tc.new)
+		if added != tc.added || removed != tc.removed {
+			t.Errorf("Stat(%q, %q) = +%d -%d, want +%d -%d", tc.old, tc.new, added, removed, tc.added, tc.removed)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+// Package droid is a typed client for the stream-jsonrpc protocol spoken by
+// `droid exec --input-format stream-jsonrpc --output-format stream-jsonrpc`.
+package droid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"droid-acp/types"
+
+	"github.com/google/uuid"
+)
+
+// APIVersion is the factoryApiVersion sent with every message.
+const APIVersion = "1.0.0"
+
+// Methods understood by Droid.
+const (
+	MethodInitializeSession     = "droid.initialize_session"
+	MethodAddUserMessage        = "droid.add_user_message"
+	MethodUpdateSessionSettings = "droid.update_session_settings"
+	MethodInterruptSession      = "droid.interrupt_session"
+	MethodSessionNotification   = "droid.session_notification"
+	MethodRequestPermission     = "droid.request_permission"
+)
+
+// ErrClosed is returned for calls that cannot complete because the Droid
+// stream has ended.
+var ErrClosed = errors.New("droid: connection closed")
+
+// Handler receives the messages Droid pushes to the client.
+type Handler interface {
+	// HandleNotification is called, in stream order, for every
+	// droid.session_notification.
+	HandleNotification(n types.DroidNotification)
+	// RequestPermission is called for every droid.request_permission and
+	// returns the option value sent back as selectedOption; an empty value
+	// sends no answer. It runs on its own goroutine, so it may block until
+	// the user decides.
+	RequestPermission(ctx context.Context, req types.DroidNotification) (string, error)
+}
+
+// TraceFunc observes every raw line read from or written to Droid.
+type TraceFunc func(outbound bool, line []byte)
+
+// Options configures the Droid subprocess started by Start.
+type Options struct {
+	// Path is the droid executable; "droid" from PATH when empty.
+	Path string
+	// Args are appended after the stream-jsonrpc arguments.
+	Args []string
+	// Env holds KEY=VALUE pairs added to droid-acp's own environment.
+	Env []string
+	// Dir is the working directory of the subprocess; droid-acp's own when
+	// empty.
+	Dir string
+	// Stderr receives the subprocess stderr; os.Stderr when nil.
+	Stderr io.Writer
+}
+
+// Client owns a stream-jsonrpc conversation with Droid.
+type Client struct {
+	w       io.Writer
+	writeMu sync.Mutex
+	handler Handler
+	trace   TraceFunc
+	log     *slog.Logger
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan types.DroidMessage
+
+	cmd     *exec.Cmd
+	stderr  *tailBuffer
+	exited  chan struct{}
+	exitErr error
+	done    chan struct{}
+	err     error
+
+	// protoErr is set, and badOutput closed, when Droid writes something
+	// that is not JSON-RPC before any valid message.
+	protoErr  error
+	badOutput chan struct{}
+	sawOutput bool
+}
+
+// Start launches Droid in stream-jsonrpc mode and returns a client bound
+// to its stdin and stdout.
+func Start(opts Options, h Handler) (*Client, error) {
+	path := opts.Path
+	if path == "" {
+		path = "droid"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, &StartupError{Path: path, Err: notFoundError(err)}
+	}
+	args := []string{
+		"exec",
+		"--input-format", "stream-jsonrpc",
+		"--output-format", "stream-jsonrpc",
+	}
+	cmd := exec.Command(resolved, append(args, opts.Args...)...)
+	cmd.Dir = opts.Dir
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("create stdout pipe: %w", err)
+	}
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	tail := &tailBuffer{max: stderrTailSize}
+	cmd.Stderr = io.MultiWriter(stderr, tail)
+	if err := cmd.Start(); err != nil {
+		return nil, &StartupError{Path: path, Err: err}
+	}
+
+	c := newClient(stdin, h)
+	c.cmd = cmd
+	c.stderr = tail
+	go c.readLoop(stdout)
+	go func() {
+		<-c.done
+		c.exitErr = cmd.Wait()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+// NewClient speaks the Droid protocol over an existing stream, which is
+// useful for fakes and in-process transports.
+func NewClient(r io.Reader, w io.Writer, h Handler) *Client {
+	c := newClient(w, h)
+	go c.readLoop(r)
+	return c
+}
+
+func newClient(w io.Writer, h Handler) *Client {
+	return &Client{
+		w:         w,
+		handler:   h,
+		log:       slog.Default().With("component", "droid"),
+		pending:   make(map[string]chan types.DroidMessage),
+		exited:    make(chan struct{}),
+		done:      make(chan struct{}),
+		badOutput: make(chan struct{}),
+	}
+}
+
+// SetTrace installs fn as the observer of all traffic with Droid.
+func (c *Client) SetTrace(fn TraceFunc) {
+	c.mu.Lock()
+	c.trace = fn
+	c.mu.Unlock()
+}
+
+func (c *Client) tracer() TraceFunc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trace
+}
+
+// SetLogger replaces the logger used for protocol errors. It should be
+// called before any traffic flows.
+func (c *Client) SetLogger(log *slog.Logger) {
+	c.log = log
+}
+
+// Done is closed once Droid's output stream has ended.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports why the stream ended; it is only meaningful after Done.
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Wait waits for the subprocess started by Start to exit.
+func (c *Client) Wait() error {
+	<-c.done
+	if c.cmd == nil {
+		return c.err
+	}
+	<-c.exited
+	return c.exitErr
+}
+
+// Close closes Droid's input, which makes it exit once the current work is
+// flushed.
+func (c *Client) Close() error {
+	if closer, ok := c.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// InitializeSession starts a new Droid session rooted at cwd and returns
+// its settings and the models Droid offers.
+func (c *Client) InitializeSession(ctx context.Context, cwd string) (*types.ResultModel, error) {
+	params := types.InitializeSessionParams{
+		MachineId: uuid.New().String(),
+		Cwd:       cwd,
+	}
+	var result types.ResultModel
+	if err := c.Call(ctx, MethodInitializeSession, params, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) AddUserMessage(ctx context.Context, params types.AddUserMessageParams) error {
+	return c.Call(ctx, MethodAddUserMessage, params, nil)
+}
+
+func (c *Client) UpdateSessionSettings(ctx context.Context, params types.UpdateSessionSettingsParams) error {
+	return c.Call(ctx, MethodUpdateSessionSettings, params, nil)
+}
+
+// Interrupt stops the turn Droid is currently working on.
+func (c *Client) Interrupt(ctx context.Context, sessionID string) error {
+	return c.Call(ctx, MethodInterruptSession, types.InterruptSessionParams{SessionId: sessionID}, nil)
+}
+
+// Call sends a request to Droid and waits for the response. When result is
+// non-nil the response result is decoded into it.
+func (c *Client) Call(ctx context.Context, method string, params any, result any) error {
+	c.mu.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	ch := make(chan types.DroidMessage, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req := types.DroidMessage{
+		JSONRPC:           "2.0",
+		Type:              "request",
+		FactoryApiVersion: APIVersion,
+		ID:                id,
+		Method:            method,
+	}
+	if err := c.write(req, params); err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return ErrClosed
+		}
+		if len(resp.Error) > 0 && string(resp.Error) != "null" {
+			return decodeError(resp.Error)
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	case <-c.done:
+		c.forget(id)
+		return ErrClosed
+	}
+}
+
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// respond answers a request Droid sent to the client.
+func (c *Client) respond(id string, result any) error {
+	if id == "" {
+		return nil
+	}
+	resp := types.DroidMessage{
+		JSONRPC:           "2.0",
+		Type:              "response",
+		FactoryApiVersion: APIVersion,
+		ID:                id,
+	}
+	return c.write(resp, result)
+}
+
+func (c *Client) ack(id string) error {
+	return c.respond(id, map[string]bool{"ok": true})
+}
+
+func (c *Client) write(msg types.DroidMessage, payload any) error {
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		if msg.Type == "response" {
+			msg.Result = raw
+		} else {
+			msg.Params = raw
+		}
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if trace := c.tracer(); trace != nil {
+		trace(true, b)
+	}
+	_, err = fmt.Fprintln(c.w, string(b))
+	return err
+}
+
+func (c *Client) readLoop(r io.Reader) {
+	defer func() {
+		c.mu.Lock()
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		close(c.done)
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if trace := c.tracer(); trace != nil {
+			trace(false, line)
+		}
+
+		var msg types.DroidMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			c.log.Warn("failed to parse droid message", "err", err)
+			c.mu.Lock()
+			if !c.sawOutput {
+				c.protoErr = fmt.Errorf("droid does not speak stream-jsonrpc; its first output was %q", truncate(line, 200))
+				close(c.badOutput)
+			}
+			c.sawOutput = true
+			c.mu.Unlock()
+			continue
+		}
+		c.mu.Lock()
+		c.sawOutput = true
+		c.mu.Unlock()
+		c.dispatch(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		c.err = err
+	} else {
+		c.err = io.EOF
+	}
+}
+
+func (c *Client) dispatch(msg types.DroidMessage) {
+	if msg.Method == "" {
+		if msg.Type != "response" {
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+		return
+	}
+
+	switch msg.Method {
+	case MethodSessionNotification:
+		var params types.DroidNotification
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			c.log.Warn("failed to parse droid.session_notification", "err", err)
+		} else {
+			c.handler.HandleNotification(params)
+		}
+		c.ack(msg.ID)
+
+	case MethodRequestPermission:
+		var params types.DroidNotification
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			c.log.Warn("failed to parse droid.request_permission", "request", msg.ID, "err", err)
+			return
+		}
+		id := msg.ID
+		if id == "" && len(params.ToolUses) > 0 {
+			id = params.ToolUses[0].ToolUse.ID
+		}
+		go func() {
+			option, err := c.handler.RequestPermission(context.Background(), params)
+			if err != nil {
+				c.log.Error("permission request failed", "request", id, "err", err)
+				return
+			}
+			if option == "" {
+				return
+			}
+			if err := c.respond(id, types.PermissionResult{SelectedOption: option}); err != nil {
+				c.log.Error("failed to send permission result to droid", "request", id, "err", err)
+			}
+		}()
+
+	default:
+		c.ack(msg.ID)
+	}
+}
+
+// errResponse marks an error response that is not a JSON-RPC error object.
+var errResponse = errors.New("droid error")
+
+func decodeError(raw json.RawMessage) error {
+	var rpcErr types.Error
+	if err := json.Unmarshal(raw, &rpcErr); err == nil && rpcErr.Message != "" {
+		return &rpcErr
+	}
+	return fmt.Errorf("%w: %s", errResponse, string(raw))
+}
@@ -0,0 +1,422 @@
+// Package droidtest provides a scriptable fake Droid that speaks the
+// stream-jsonrpc protocol, so the bridge can be exercised offline.
+package droidtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"droid-acp/droid"
+	"droid-acp/types"
+)
+
+// Scenario describes what the fake reports on initialize_session and what
+// it plays back for each user message, in order. It can be loaded from JSON.
+type Scenario struct {
+	Session types.ResultModel `json:"session"`
+	Turns   [][]Step          `json:"turns"`
+}
+
+// Step is one scripted action within a turn. Exactly one field is set.
+type Step struct {
+	// Notification is sent as a droid.session_notification.
+	Notification *types.DroidNotificationData `json:"notification,omitempty"`
+	// Permission is sent as a droid.request_permission; the turn waits for
+	// the answer before continuing.
+	Permission *types.DroidNotification `json:"permission,omitempty"`
+	// Sleep pauses the turn.
+	Sleep time.Duration `json:"sleep,omitempty"`
+	// Crash closes the stream as if Droid had died.
+	Crash bool `json:"crash,omitempty"`
+	// Run stands in for work Droid does on its own, such as a tool that
+	// changes files without asking.
+	Run func() `json:"-"`
+}
+
+func TextDelta(text string) Step {
+	return Step{Notification: &types.DroidNotificationData{Type: "assistant_text_delta", TextDelta: text}}
+}
+
+func Thinking(text string) Step {
+	return Step{Notification: &types.DroidNotificationData{Type: "thinking_text_delta", TextDelta: text}}
+}
+
+func WorkingState(state string) Step {
+	return Step{Notification: &types.DroidNotificationData{Type: "droid_working_state_changed", NewState: state}}
+}
+
+func Idle() Step {
+	return WorkingState("idle")
+}
+
+// TokenUsage reports the cumulative token usage of the session.
+func TokenUsage(input, output, cacheRead, thinking int64) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type: "token_usage_updated",
+		TokenUsage: &types.TokenUsage{
+			InputTokens:     input,
+			OutputTokens:    output,
+			CacheReadTokens: cacheRead,
+			ThinkingTokens:  thinking,
+		},
+	}}
+}
+
+// Stop ends the assistant message with the model's stop reason, e.g.
+// "refusal" or "max_tokens".
+func Stop(reason string) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type:       "create_message",
+		Message:    types.Message{Role: "assistant"},
+		StopReason: reason,
+	}}
+}
+
+// Error reports that the turn failed.
+func Error(message string) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type:  "error",
+		Error: &types.DroidError{Message: message},
+	}}
+}
+
+// ToolInput streams part of the JSON input of a tool use while the model
+// writes it. Only the first delta of a tool use needs id and name.
+func ToolInput(index int, id, name, delta string) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type:        "tool_input_delta",
+		Index:       index,
+		ToolUseID:   id,
+		ToolUseName: name,
+		InputDelta:  delta,
+	}}
+}
+
+// Subagent marks a notification step as sent by the sub-agent working for
+// tool use parent.
+func Subagent(parent string, step Step) Step {
+	n := *step.Notification
+	n.ParentToolUseID = parent
+	return Step{Notification: &n}
+}
+
+// ToolResult reports the result of a tool use, such as a sub-agent's
+// summary.
+func ToolResult(toolUseID, text string, isError bool) Step {
+	raw, _ := json.Marshal(text)
+	return Step{Notification: &types.DroidNotificationData{
+		Type:      "tool_result",
+		ToolUseID: toolUseID,
+		Content:   raw,
+		IsError:   isError,
+	}}
+}
+
+// Title reports the session title Droid generated.
+func Title(title string) Step {
+	return Step{Notification: &types.DroidNotificationData{Type: "session_title_updated", Title: title}}
+}
+
+// Patch announces an apply_patch tool use through create_message.
+func Patch(toolUseID, patch string) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type: "create_message",
+		Message: types.Message{
+			Role: "assistant",
+			Content: []types.DroidContent{
+				{Id: toolUseID, Input: &types.InputApplyPatch{Input: patch}},
+			},
+		},
+	}}
+}
+
+// FileTool announces a file tool use such as Create or Edit through
+// create_message.
+func FileTool(toolUseID, name, path string) Step {
+	return Step{Notification: &types.DroidNotificationData{
+		Type: "create_message",
+		Message: types.Message{
+			Role: "assistant",
+			Content: []types.DroidContent{
+				{Id: toolUseID, Name: name, Input: &types.InputApplyPatch{FilePath: path}},
+			},
+		},
+	}}
+}
+
+// Permission asks for confirmation of toolUses with Droid's usual options.
+func Permission(toolUses ...types.ToolUseParent) Step {
+	return Step{Permission: &types.DroidNotification{
+		ToolUses: toolUses,
+		Options: []types.ToolUseOption{
+			{Label: "Yes, allow", Value: "proceed_once"},
+			{Label: "Yes, always allow", Value: "proceed_always"},
+			{Label: "No, cancel", Value: "cancel"},
+		},
+	}}
+}
+
+// SpecPlan asks for approval of a plan written in spec mode.
+func SpecPlan(toolUseID, title, plan string) Step {
+	return Step{Permission: &types.DroidNotification{
+		ToolUses: []types.ToolUseParent{{
+			ToolUse:          types.ToolUse{Type: "tool_use", ID: toolUseID, Name: "ExitSpecMode"},
+			ConfirmationType: "exit_spec_mode",
+			Details:          &types.ToolUseDetail{Type: "exit_spec_mode", Title: title, Content: plan},
+		}},
+		Options: []types.ToolUseOption{
+			{Label: "Proceed with implementation", Value: "proceed_once"},
+			{Label: "Proceed, allow low-risk commands", Value: "proceed_auto_run_low"},
+			{Label: "Proceed, allow medium-risk commands", Value: "proceed_auto_run_medium"},
+			{Label: "No, keep iterating on spec", Value: "cancel"},
+		},
+	}}
+}
+
+func Crash() Step {
+	return Step{Crash: true}
+}
+
+// Fake plays a Scenario against a single client connection.
+type Fake struct {
+	scenario Scenario
+
+	writeMu sync.Mutex
+	w       io.WriteCloser
+
+	mu          sync.Mutex
+	nextID      int
+	turn        int
+	interrupted bool
+	closed      bool
+	pending     map[string]chan types.DroidMessage
+	requests    []types.DroidMessage
+	answers     []string
+}
+
+func New(scenario Scenario) *Fake {
+	return &Fake{
+		scenario: scenario,
+		pending:  make(map[string]chan types.DroidMessage),
+	}
+}
+
+// Connect starts serving over in-memory pipes and returns the client ends,
+// ready to be passed to droid.NewClient.
+func (f *Fake) Connect() (io.Reader, io.WriteCloser) {
+	clientR, fakeW := io.Pipe()
+	fakeR, clientW := io.Pipe()
+	go f.Serve(fakeR, fakeW)
+	return clientR, clientW
+}
+
+// Serve reads client messages from r and writes Droid messages to w until
+// either side closes.
+func (f *Fake) Serve(r io.Reader, w io.WriteCloser) error {
+	f.w = w
+	defer f.close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var msg types.DroidMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return fmt.Errorf("droidtest: bad message %q: %w", scanner.Text(), err)
+		}
+		if f.isClosed() {
+			return nil
+		}
+		f.handle(msg)
+	}
+	return scanner.Err()
+}
+
+func (f *Fake) handle(msg types.DroidMessage) {
+	if msg.Type == "response" {
+		f.mu.Lock()
+		ch, ok := f.pending[msg.ID]
+		delete(f.pending, msg.ID)
+		f.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, msg)
+	f.mu.Unlock()
+
+	switch msg.Method {
+	case droid.MethodInitializeSession:
+		f.respond(msg.ID, f.scenario.Session)
+
+	case droid.MethodUpdateSessionSettings:
+		var params types.UpdateSessionSettingsParams
+		json.Unmarshal(msg.Params, &params)
+		f.mu.Lock()
+		if params.ModelId != "" {
+			f.scenario.Session.Settings.ModelID = params.ModelId
+		}
+		if params.AutonomyLevel != "" {
+			f.scenario.Session.Settings.AutonomyLevel = params.AutonomyLevel
+		}
+		if params.SpecMode != nil {
+			f.scenario.Session.Settings.SpecMode = *params.SpecMode
+		}
+		f.mu.Unlock()
+		f.respond(msg.ID, map[string]bool{"ok": true})
+
+	case droid.MethodAddUserMessage:
+		f.respond(msg.ID, map[string]bool{"ok": true})
+		f.mu.Lock()
+		var steps []Step
+		if f.turn < len(f.scenario.Turns) {
+			steps = f.scenario.Turns[f.turn]
+		}
+		f.turn++
+		f.interrupted = false
+		f.mu.Unlock()
+		go f.play(steps)
+
+	case droid.MethodInterruptSession:
+		f.mu.Lock()
+		f.interrupted = true
+		f.mu.Unlock()
+		f.respond(msg.ID, map[string]bool{"ok": true})
+
+	default:
+		f.respond(msg.ID, map[string]bool{"ok": true})
+	}
+}
+
+func (f *Fake) play(steps []Step) {
+	for _, step := range steps {
+		f.mu.Lock()
+		interrupted := f.interrupted
+		f.mu.Unlock()
+		if interrupted {
+			f.notify(types.DroidNotificationData{Type: "droid_working_state_changed", NewState: "idle"})
+			return
+		}
+
+		switch {
+		case step.Crash:
+			f.close()
+			return
+		case step.Sleep > 0:
+			time.Sleep(step.Sleep)
+		case step.Run != nil:
+			step.Run()
+		case step.Notification != nil:
+			f.notify(*step.Notification)
+		case step.Permission != nil:
+			f.requestPermission(*step.Permission)
+		}
+	}
+}
+
+func (f *Fake) notify(n types.DroidNotificationData) {
+	f.write(types.DroidMessage{
+		Type:   "notification",
+		Method: droid.MethodSessionNotification,
+	}, types.DroidNotification{Notification: n})
+}
+
+func (f *Fake) requestPermission(params types.DroidNotification) {
+	f.mu.Lock()
+	f.nextID++
+	id := "fake-" + strconv.Itoa(f.nextID)
+	ch := make(chan types.DroidMessage, 1)
+	f.pending[id] = ch
+	f.mu.Unlock()
+
+	f.write(types.DroidMessage{
+		Type:   "request",
+		ID:     id,
+		Method: droid.MethodRequestPermission,
+	}, params)
+
+	resp, ok := <-ch
+	if !ok {
+		return
+	}
+	var result types.PermissionResult
+	json.Unmarshal(resp.Result, &result)
+	f.mu.Lock()
+	f.answers = append(f.answers, result.SelectedOption)
+	f.mu.Unlock()
+}
+
+func (f *Fake) respond(id string, result any) {
+	f.write(types.DroidMessage{Type: "response", ID: id}, result)
+}
+
+func (f *Fake) write(msg types.DroidMessage, payload any) {
+	raw, _ := json.Marshal(payload)
+	if msg.Type == "response" {
+		msg.Result = raw
+	} else {
+		msg.Params = raw
+	}
+	msg.JSONRPC = "2.0"
+	msg.FactoryApiVersion = droid.APIVersion
+	b, _ := json.Marshal(msg)
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	if f.isClosed() {
+		return
+	}
+	fmt.Fprintln(f.w, string(b))
+}
+
+func (f *Fake) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *Fake) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for id, ch := range f.pending {
+		close(ch)
+		delete(f.pending, id)
+	}
+	f.mu.Unlock()
+
+	f.writeMu.Lock()
+	f.w.Close()
+	f.writeMu.Unlock()
+}
+
+// Requests returns the requests received so far for method, or all of them
+// when method is empty.
+func (f *Fake) Requests(method string) []types.DroidMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []types.DroidMessage
+	for _, req := range f.requests {
+		if method == "" || req.Method == method {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// Answers returns the options selected for each permission request.
+func (f *Fake) Answers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.answers...)
+}
@@ -0,0 +1,140 @@
+package droid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"droid-acp/types"
+)
+
+// stderrTailSize is how much of Droid's stderr is kept for startup errors.
+const stderrTailSize = 4096
+
+// StartupError explains why Droid could not be started or did not come up
+// as a stream-jsonrpc server.
+type StartupError struct {
+	Path string
+	Err  error
+	// Stderr is the end of what Droid printed before it failed.
+	Stderr string
+}
+
+func (e *StartupError) Error() string {
+	msg := fmt.Sprintf("could not start droid (%s): %v", e.Path, e.Err)
+	if e.Stderr != "" {
+		msg += "\n" + e.Stderr
+	}
+	return msg
+}
+
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+func notFoundError(err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return errors.New("executable not found; install Droid or set droid.path to its location")
+	}
+	return err
+}
+
+// CheckStartup makes sure Droid came up as a stream-jsonrpc server.
+// Droid has no ping, so it asks Droid to interrupt a session that does not
+// exist: any answer, even an error, shows that Droid reads and writes
+// JSON-RPC. It fails as soon as Droid exits or writes anything else, and
+// when Droid has not answered within timeout.
+func (c *Client) CheckStartup(timeout time.Duration) error {
+	path := ""
+	if c.cmd != nil {
+		path = c.cmd.Path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	answered := make(chan error, 1)
+	go func() {
+		answered <- c.Interrupt(ctx, "")
+	}()
+
+	var err error
+	select {
+	case err = <-answered:
+		var rpcErr *types.Error
+		if err == nil || errors.As(err, &rpcErr) || errors.Is(err, errResponse) {
+			return nil
+		}
+		if c.cmd != nil {
+			// Droid may have closed its input or output on its way
+			// out; wait for its exit status.
+			select {
+			case <-c.exited:
+			case <-ctx.Done():
+			}
+		}
+	case <-c.exited:
+	case <-c.badOutput:
+	}
+
+	select {
+	case <-c.badOutput:
+		c.mu.Lock()
+		err = c.protoErr
+		c.mu.Unlock()
+	case <-c.exited:
+		if c.exitErr == nil {
+			err = errors.New("exited immediately")
+		} else {
+			err = fmt.Errorf("exited immediately: %w", c.exitErr)
+		}
+	default:
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no answer to a stream-jsonrpc request within %s", timeout)
+		}
+	}
+	return &StartupError{Path: path, Err: err, Stderr: c.StderrTail()}
+}
+
+// StderrTail returns the last lines Droid wrote to stderr, which usually
+// explain why it failed.
+func (c *Client) StderrTail() string {
+	if c.stderr == nil {
+		return ""
+	}
+	return strings.TrimSpace(c.stderr.String())
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(bytes.ToValidUTF8(t.buf, nil))
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) > n {
+		return string(b[:n]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,118 @@
+package droid
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"droid-acp/types"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) HandleNotification(types.DroidNotification) {}
+
+func (nopHandler) RequestPermission(context.Context, types.DroidNotification) (string, error) {
+	return "", nil
+}
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not executable on windows")
+	}
+	path := filepath.Join(t.TempDir(), "droid")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStartMissingBinary(t *testing.T) {
+	_, err := Start(Options{Path: filepath.Join(t.TempDir(), "no-such-droid")}, nopHandler{})
+	var startErr *StartupError
+	if !errors.As(err, &startErr) {
+		t.Fatalf("Start error = %v, want a StartupError", err)
+	}
+}
+
+func TestCheckStartupReportsEarlyExit(t *testing.T) {
+	path := writeScript(t, "echo \"error: unknown option '--input-format'\" >&2\nexit 2\n")
+	c, err := Start(Options{Path: path, Stderr: &strings.Builder{}}, nopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CheckStartup(5 * time.Second)
+	if err == nil || !strings.Contains(err.Error(), "unknown option") {
+		t.Errorf("CheckStartup error = %v, want it to include droid's stderr", err)
+	}
+}
+
+func TestCheckStartupRejectsNonJSONOutput(t *testing.T) {
+	path := writeScript(t, "echo 'Usage: droid [options]'\nsleep 5\n")
+	c, err := Start(Options{Path: path, Stderr: &strings.Builder{}}, nopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.cmd.Process.Kill() })
+	err = c.CheckStartup(500 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "stream-jsonrpc") {
+		t.Errorf("CheckStartup error = %v, want a protocol error", err)
+	}
+}
+
+func TestCheckStartupRejectsSilentBinary(t *testing.T) {
+	path := writeScript(t, "sleep 5\n")
+	c, err := Start(Options{Path: path, Stderr: &strings.Builder{}}, nopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.cmd.Process.Kill() })
+	err = c.CheckStartup(200 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no answer") {
+		t.Errorf("CheckStartup error = %v, want a timeout", err)
+	}
+}
+
+func TestCheckStartupAcceptsErrorAnswer(t *testing.T) {
+	answer := `{"jsonrpc":"2.0","type":"response","id":"1","error":{"code":-32602,"message":"unknown session"}}`
+	path := writeScript(t, "read line\necho '"+answer+"'\nsleep 5\n")
+	c, err := Start(Options{Path: path, Stderr: &strings.Builder{}}, nopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.cmd.Process.Kill() })
+	start := time.Now()
+	if err := c.CheckStartup(5 * time.Second); err != nil {
+		t.Fatalf("CheckStartup: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CheckStartup took %s after droid answered", elapsed)
+	}
+}
+
+func TestStartPassesArgsEnvAndDir(t *testing.T) {
+	dir := t.TempDir()
+	path := writeScript(t, "echo \"$@|$DROID_TEST_VAR|$(pwd)\" > \"$DROID_TEST_OUT\"\n")
+	out := filepath.Join(dir, "out")
+	c, err := Start(Options{
+		Path: path,
+		Args: []string{"--extra"},
+		Env:  []string{"DROID_TEST_VAR=proxy", "DROID_TEST_OUT=" + out},
+		Dir:  dir,
+	}, nopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Wait()
+	b, _ := os.ReadFile(out)
+	want := "exec --input-format stream-jsonrpc --output-format stream-jsonrpc --extra|proxy|"
+	if got := string(b); !strings.HasPrefix(got, want) || !strings.Contains(got, filepath.Base(dir)) {
+		t.Errorf("droid saw %q, want prefix %q and cwd %s", got, want, dir)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"droid-acp/config"
+	"droid-acp/export"
+	"droid-acp/redact"
+	"droid-acp/sessions"
+)
+
+// exportRedactor is the redactor applied to exports: the configured one,
+// unless redaction is turned off.
+func exportRedactor(cfg *config.Config) (*redact.Redactor, error) {
+	if !cfg.Redact.Enabled {
+		return nil, nil
+	}
+	return redact.New(cfg.Redact.Patterns)
+}
+
+// exportSession writes the document of session id from store to w.
+func exportSession(w io.Writer, store *sessions.Store, id, format string, opts export.Options) error {
+	if !slices.Contains(export.Formats, format) {
+		return fmt.Errorf("unknown export format %q; must be one of %s", format, strings.Join(export.Formats, ", "))
+	}
+	meta, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	events, err := store.Events(id)
+	if err != nil {
+		return err
+	}
+	return export.Write(w, format, export.Build(meta, events, opts))
+}
+
+// runExport implements "droid-acp export <session-id>".
+func runExport(args []string, out io.Writer) error {
+	const usage = "usage: droid-acp export <session-id> [--format md|json|html] [--thoughts] [--output file]"
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(usage)
+	}
+	id, args := args[0], args[1:]
+	format, output := "md", ""
+	var thoughts bool
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if val, ok := flagValue(args, &i, "--format"); ok {
+			format = val
+		} else if val, ok := flagValue(args, &i, "--output"); ok {
+			output = val
+		} else if args[i] == "--thoughts" {
+			thoughts = true
+		} else {
+			rest = append(rest, args[i])
+		}
+	}
+	cli, err := parseArgs(rest)
+	if err != nil {
+		return err
+	}
+	_, cfg, err := loadSettings(cli)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	redactor, err := exportRedactor(cfg)
+	if err != nil {
+		return err
+	}
+	opts := export.Options{Thoughts: thoughts, Redactor: redactor}
+	store := sessions.Open(sessionsDir(cfg.StateDir))
+
+	if output == "" {
+		return exportSession(out, store, id, format, opts)
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := exportSession(f, store, id, format, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportCommand implements /export [md|json|html] [thoughts] [file]: it
+// writes the current session to a file in the session's directory.
+func (a *droidAgent) exportCommand(ctx context.Context, args string) (string, error) {
+	a.mu.Lock()
+	id := a.sessionMeta.ID
+	cwd := a.sessionMeta.Cwd
+	cfg := a.cfg
+	a.mu.Unlock()
+	if a.sessions == nil || id == "" || !cfg.Sessions.Transcripts {
+		a.agentMessage("This session is not recorded, so there is nothing to export. Session transcripts are turned off by `sessions.transcripts`.")
+		return "", nil
+	}
+
+	format, path := "md", ""
+	var opts export.Options
+	for _, arg := range strings.Fields(args) {
+		switch {
+		case slices.Contains(export.Formats, arg):
+			format = arg
+		case arg == "thoughts":
+			opts.Thoughts = true
+		default:
+			path = arg
+		}
+	}
+	if path == "" {
+		path = fmt.Sprintf("droid-session-%.8s.%s", id, format)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+	redactor, err := exportRedactor(cfg)
+	if err != nil {
+		return "", err
+	}
+	opts.Redactor = redactor
+
+	var b strings.Builder
+	if err := exportSession(&b, a.sessions, id, format, opts); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		a.agentMessage(fmt.Sprintf("Could not export this session: %v", err))
+		return "", nil
+	}
+	a.acpLog.Info("exported session", "session", id, "path", path, "format", format)
+	a.agentMessage("Exported this session to `" + path + "`.")
+	return "", nil
+}
@@ -0,0 +1,216 @@
+// Package export turns a recorded session into a document to share: the
+// conversation with its tool calls, diffs, command output and permission
+// decisions, as Markdown, JSON or HTML.
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"droid-acp/diff"
+	"droid-acp/redact"
+	"droid-acp/sessions"
+)
+
+// Formats are the document formats Write supports.
+var Formats = []string{"md", "json", "html"}
+
+// Options select what goes into a document.
+type Options struct {
+	// Thoughts includes the agent's thoughts.
+	Thoughts bool
+	// Redactor masks secrets in every text of the document; nil keeps the
+	// transcript as recorded.
+	Redactor *redact.Redactor
+}
+
+// Document is an exported session.
+type Document struct {
+	Session sessions.Meta `json:"session"`
+	Entries []Entry       `json:"entries"`
+}
+
+// Entry is one step of the conversation.
+type Entry struct {
+	// Type is "user", "agent", "thought" or "tool_call".
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text,omitempty"`
+	Tool *ToolCall `json:"toolCall,omitempty"`
+}
+
+// ToolCall is a tool call with everything recorded about it.
+type ToolCall struct {
+	ID     string `json:"id"`
+	Title  string `json:"title,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Diffs are unified diffs of the files the call changes.
+	Diffs []FileDiff `json:"diffs,omitempty"`
+	// Output is what the tool returned, e.g. the output of a command.
+	Output     string                    `json:"output,omitempty"`
+	Permission *sessions.PermissionEvent `json:"permission,omitempty"`
+}
+
+// FileDiff is the change a tool call makes to one file.
+type FileDiff struct {
+	Path string `json:"path"`
+	Diff string `json:"diff"`
+}
+
+// Build assembles the document of session meta from its transcript.
+func Build(meta sessions.Meta, events []sessions.Event, opts Options) Document {
+	doc := Document{Session: meta, Entries: []Entry{}}
+	tools := make(map[string]*ToolCall)
+	tool := func(id string, at time.Time) *ToolCall {
+		if t := tools[id]; t != nil {
+			return t
+		}
+		t := &ToolCall{ID: id}
+		tools[id] = t
+		doc.Entries = append(doc.Entries, Entry{Type: "tool_call", Time: at, Tool: t})
+		return t
+	}
+	text := func(typ, s string, at time.Time) {
+		if n := len(doc.Entries); n > 0 && doc.Entries[n-1].Type == typ && typ != "user" {
+			doc.Entries[n-1].Text += s
+			return
+		}
+		doc.Entries = append(doc.Entries, Entry{Type: typ, Time: at, Text: s})
+	}
+
+	for _, e := range events {
+		switch e.Type {
+		case "prompt":
+			text("user", e.Text, e.Time)
+		case "permission":
+			if e.Permission != nil {
+				t := tool(e.Permission.ToolCallID, e.Time)
+				if t.Title == "" {
+					t.Title = e.Permission.Title
+				}
+				p := *e.Permission
+				t.Permission = &p
+			}
+		case "result":
+			if e.Result != nil {
+				t := tool(e.Result.ToolCallID, e.Time)
+				t.Output = e.Result.Text
+				if e.Result.IsError {
+					t.Status = "failed"
+				} else if t.Status != "failed" {
+					t.Status = "completed"
+				}
+			}
+		case "update":
+			u := e.Update
+			if u == nil {
+				continue
+			}
+			switch u.SessionUpdate {
+			case "agent_message_chunk":
+				if u.Content != nil {
+					text("agent", u.Content.Text, e.Time)
+				}
+			case "agent_thought_chunk":
+				if u.Content != nil && opts.Thoughts {
+					text("thought", u.Content.Text, e.Time)
+				}
+			case "tool_call", "tool_call_update":
+				t := tool(u.ToolCallId, e.Time)
+				if u.Title != "" {
+					t.Title = u.Title
+				}
+				if u.Kind != "" {
+					t.Kind = u.Kind
+				}
+				if u.Status != "" {
+					t.Status = u.Status
+				}
+				if c := u.Content; c != nil {
+					switch c.Type {
+					case "diff":
+						t.setDiff(c.Path, opts.Redactor.String(c.OldText), opts.Redactor.String(c.NewText))
+					case "text":
+						t.Output = c.Text
+					}
+				}
+			}
+		}
+	}
+
+	r := opts.Redactor
+	doc.Session.Title = r.String(doc.Session.Title)
+	for i := range doc.Entries {
+		e := &doc.Entries[i]
+		e.Text = r.String(strings.TrimSpace(e.Text))
+		if t := e.Tool; t != nil {
+			t.Title = r.String(t.Title)
+			t.Output = r.String(t.Output)
+			if t.Permission != nil {
+				t.Permission.Title = r.String(t.Permission.Title)
+			}
+		}
+	}
+	return doc
+}
+
+// setDiff records the change to path, replacing an earlier diff of the
+// same file as the tool input was streamed.
+func (t *ToolCall) setDiff(path, oldText, newText string) {
+	from, to := "a/"+path, "b/"+path
+	if oldText == "" {
+		from = "/dev/null"
+	}
+	d := FileDiff{Path: path, Diff: diff.Unified(from, to, oldText, newText)}
+	for i := range t.Diffs {
+		if t.Diffs[i].Path == path {
+			t.Diffs[i] = d
+			return
+		}
+	}
+	t.Diffs = append(t.Diffs, d)
+}
+
+// Decision describes a permission decision, e.g. "allowed once by the
+// user".
+func Decision(p *sessions.PermissionEvent) string {
+	var what string
+	switch {
+	case p.Option == "proceed_once":
+		what = "allowed once"
+	case p.Option == "proceed_always":
+		what = "always allowed"
+	case strings.HasPrefix(p.Option, "proceed"):
+		what = "approved (" + p.Option + ")"
+	default:
+		what = "rejected"
+	}
+	if p.Policy != "" {
+		return what + " by the " + p.Policy + " policy"
+	}
+	return what + " by the user"
+}
+
+// Write writes doc in format, one of Formats.
+func Write(w io.Writer, format string, doc Document) error {
+	switch format {
+	case "md":
+		return writeMarkdown(w, doc)
+	case "json":
+		return writeJSON(w, doc)
+	case "html":
+		return writeHTML(w, doc)
+	}
+	return fmt.Errorf("unknown export format %q; must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// title is the heading of doc.
+func title(doc Document) string {
+	if doc.Session.Title != "" {
+		return doc.Session.Title
+	}
+	return "Droid session " + doc.Session.ID
+}
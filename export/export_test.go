@@ -0,0 +1,135 @@
+package export
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"droid-acp/redact"
+	"droid-acp/sessions"
+	"droid-acp/types"
+)
+
+func testEvents() []sessions.Event {
+	update := func(u types.Update) sessions.Event {
+		return sessions.Event{Type: "update", Update: &u}
+	}
+	text := func(kind, s string) sessions.Event {
+		return update(types.Update{SessionUpdate: kind, Content: &types.Content{Type: "text", Text: s}})
+	}
+	return []sessions.Event{
+		{Type: "prompt", Text: "Set the API token and run the tests"},
+		text("agent_thought_chunk", "The token goes into .env."),
+		text("agent_message_chunk", "Writing "),
+		text("agent_message_chunk", "the config."),
+		update(types.Update{SessionUpdate: "tool_call", ToolCallId: "t1", Title: ".env", Kind: "edit", Status: "pending",
+			Content: &types.Content{Type: "diff", Path: ".env", OldText: "DEBUG=1\n", NewText: "DEBUG=1\nAPI_TOKEN=abcd1234efgh\n"}}),
+		{Type: "permission", Permission: &sessions.PermissionEvent{ToolCallID: "t1", Title: ".env", Option: "proceed_once"}},
+		update(types.Update{SessionUpdate: "tool_call", ToolCallId: "t2", Title: "go test ./...", Kind: "execute", Status: "in_progress"}),
+		{Type: "permission", Permission: &sessions.PermissionEvent{ToolCallID: "t2", Title: "go test ./...", Option: "proceed_once", Policy: "allow"}},
+		{Type: "result", Result: &sessions.ResultEvent{ToolCallID: "t2", Text: "ok  \tdroid-acp\t0.5s\n"}},
+		text("agent_message_chunk", "All tests pass."),
+	}
+}
+
+func TestBuild(t *testing.T) {
+	r, _ := redact.New(nil)
+	doc := Build(sessions.Meta{ID: "s1", Title: "Tests"}, testEvents(), Options{Redactor: r})
+	var types []string
+	for _, e := range doc.Entries {
+		types = append(types, e.Type)
+	}
+	if got := strings.Join(types, ","); got != "user,agent,tool_call,tool_call,agent" {
+		t.Fatalf("entries = %s", got)
+	}
+	if doc.Entries[1].Text != "Writing the config." {
+		t.Errorf("agent text = %q", doc.Entries[1].Text)
+	}
+	edit := doc.Entries[2].Tool
+	if len(edit.Diffs) != 1 || !strings.Contains(edit.Diffs[0].Diff, "+API_TOKEN=[REDACTED]") || strings.Contains(edit.Diffs[0].Diff, "abcd1234efgh") {
+		t.Errorf("edit diffs = %+v", edit.Diffs)
+	}
+	run := doc.Entries[3].Tool
+	if run.Status != "completed" || !strings.Contains(run.Output, "ok") || Decision(run.Permission) != "allowed once by the allow policy" {
+		t.Errorf("command = %+v", run)
+	}
+
+	withThoughts := Build(sessions.Meta{ID: "s1"}, testEvents(), Options{Thoughts: true})
+	if withThoughts.Entries[1].Type != "thought" {
+		t.Errorf("second entry with thoughts = %+v", withThoughts.Entries[1])
+	}
+}
+
+func TestBuildFromRedactedTranscript(t *testing.T) {
+	// Even a pattern that matches the tool call IDs must leave them alone.
+	r, _ := redact.New([]string{`toolu_[0-9A-Za-z]+`})
+	store := sessions.Open(t.TempDir())
+	store.SetRedactor(r)
+	ids := []string{"toolu_01HvKq8ZxW3nR5tP7yLm2cJd", "toolu_01Bq7WmX4sLp9TzR2vYk6NhF"}
+	var events []sessions.Event
+	for i, id := range ids {
+		events = append(events,
+			sessions.Event{Type: "update", Update: &types.Update{SessionUpdate: "tool_call", ToolCallId: id, Title: "Run step", Kind: "execute", Status: "in_progress"}},
+			sessions.Event{Type: "result", Result: &sessions.ResultEvent{ToolCallID: id, Text: strings.Repeat("ok\n", i+1) + "GITHUB_TOKEN=abc123secret\n"}},
+		)
+	}
+	if err := store.Append("s1", events...); err != nil {
+		t.Fatal(err)
+	}
+	events, err := store.Events("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := Build(sessions.Meta{ID: "s1"}, events, Options{})
+	var tools []*ToolCall
+	for _, e := range doc.Entries {
+		if e.Tool != nil {
+			tools = append(tools, e.Tool)
+		}
+	}
+	if len(tools) != 2 || tools[0].ID != ids[0] || tools[1].ID != ids[1] {
+		t.Fatalf("tool calls = %+v", tools)
+	}
+	for _, tool := range tools {
+		if strings.Contains(tool.Output, "abc123secret") || !strings.Contains(tool.Output, "GITHUB_TOKEN=[REDACTED]") {
+			t.Errorf("output of %s = %q", tool.ID, tool.Output)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	r, _ := redact.New(nil)
+	doc := Build(sessions.Meta{ID: "s1", Title: "Tests", Cwd: "/work"}, testEvents(), Options{Redactor: r})
+
+	var md strings.Builder
+	if err := Write(&md, "md", doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Tests\n", "## User\n\nSet the API token", "### Tool: go test ./... (completed)", "Permission: allowed once by the user.", "```diff\n--- a/.env\n+++ b/.env\n"} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("Markdown lacks %q:\n%s", want, md.String())
+		}
+	}
+
+	var html strings.Builder
+	if err := Write(&html, "html", doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html.String(), `<span class="add">&#43;API_TOKEN=[REDACTED]</span>`) {
+		t.Errorf("HTML diff not highlighted:\n%s", html.String())
+	}
+
+	var out strings.Builder
+	if err := Write(&out, "json", doc); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Document
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil || len(decoded.Entries) != len(doc.Entries) {
+		t.Errorf("JSON round trip = %+v, %v", decoded, err)
+	}
+
+	if err := Write(&out, "pdf", doc); err == nil {
+		t.Error("Write accepted an unknown format")
+	}
+}
@@ -0,0 +1,153 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+func writeJSON(w io.Writer, doc Document) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func writeMarkdown(w io.Writer, doc Document) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title(doc))
+	fmt.Fprintf(&b, "_%s_\n", sessionLine(doc))
+	for _, e := range doc.Entries {
+		switch e.Type {
+		case "user":
+			fmt.Fprintf(&b, "\n## User\n\n%s\n", e.Text)
+		case "agent":
+			fmt.Fprintf(&b, "\n## Droid\n\n%s\n", e.Text)
+		case "thought":
+			fmt.Fprintf(&b, "\n<details><summary>Thinking</summary>\n\n%s\n\n</details>\n", e.Text)
+		case "tool_call":
+			t := e.Tool
+			fmt.Fprintf(&b, "\n### %s", toolHeading(t))
+			if t.Status != "" {
+				fmt.Fprintf(&b, " (%s)", t.Status)
+			}
+			b.WriteString("\n")
+			if t.Permission != nil {
+				fmt.Fprintf(&b, "\nPermission: %s.\n", Decision(t.Permission))
+			}
+			for _, d := range t.Diffs {
+				if d.Diff != "" {
+					fmt.Fprintf(&b, "\n%s\n", CodeBlock("diff", d.Diff))
+				}
+			}
+			if t.Output != "" {
+				fmt.Fprintf(&b, "\n%s\n", CodeBlock("text", t.Output))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// CodeBlock fences text with more backticks than it contains in a row.
+func CodeBlock(lang, text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + strings.TrimSuffix(text, "\n") + "\n" + fence
+}
+
+func toolHeading(t *ToolCall) string {
+	if t.Title != "" {
+		return "Tool: " + t.Title
+	}
+	return "Tool call " + t.ID
+}
+
+// sessionLine describes where and when the session ran.
+func sessionLine(doc Document) string {
+	s := doc.Session
+	parts := []string{"Session " + s.ID}
+	if s.Cwd != "" {
+		parts = append(parts, s.Cwd)
+	}
+	if s.Model != "" {
+		parts = append(parts, s.Model)
+	}
+	if !s.Created.IsZero() {
+		parts = append(parts, s.Created.Local().Format(time.DateTime))
+	}
+	return strings.Join(parts, " · ")
+}
+
+var htmlTemplate = template.Must(template.New("session").Funcs(template.FuncMap{
+	"heading":  toolHeading,
+	"decision": Decision,
+	"lines":    func(s string) []string { return strings.Split(strings.TrimSuffix(s, "\n"), "\n") },
+	"lineClass": func(line string) string {
+		switch {
+		case strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "):
+			return "file"
+		case strings.HasPrefix(line, "@@"):
+			return "hunk"
+		case strings.HasPrefix(line, "+"):
+			return "add"
+		case strings.HasPrefix(line, "-"):
+			return "del"
+		}
+		return ""
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font: 15px/1.5 -apple-system, "Segoe UI", sans-serif; max-width: 56rem; margin: 2rem auto; padding: 0 1rem; color: #1f2328; }
+.meta { color: #656d76; }
+.entry { margin: 1.25rem 0; }
+.role { font-weight: 600; }
+.text { white-space: pre-wrap; }
+.tool { border: 1px solid #d0d7de; border-radius: 6px; padding: .5rem .75rem; }
+.status { color: #656d76; font-weight: normal; }
+pre { background: #f6f8fa; padding: .5rem; overflow-x: auto; font-size: 13px; }
+.add { color: #116329; background: #dafbe1; }
+.del { color: #82071e; background: #ffebe9; }
+.hunk { color: #0550ae; }
+.file { font-weight: 600; }
+details { color: #656d76; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">{{.Meta}}</p>
+{{range .Doc.Entries}}<div class="entry">
+{{- if eq .Type "user"}}
+<div class="role">User</div><div class="text">{{.Text}}</div>
+{{- else if eq .Type "agent"}}
+<div class="role">Droid</div><div class="text">{{.Text}}</div>
+{{- else if eq .Type "thought"}}
+<details><summary>Thinking</summary><div class="text">{{.Text}}</div></details>
+{{- else if eq .Type "tool_call"}}{{with .Tool}}
+<div class="tool"><div class="role">{{heading .}}{{if .Status}} <span class="status">({{.Status}})</span>{{end}}</div>
+{{- if .Permission}}<div>Permission: {{decision .Permission}}.</div>{{end}}
+{{- range .Diffs}}{{if .Diff}}<pre>{{range lines .Diff}}<span class="{{lineClass .}}">{{.}}</span>
+{{end}}</pre>{{end}}{{end}}
+{{- if .Output}}<pre>{{.Output}}</pre>{{end}}
+</div>{{end}}
+{{- end}}
+</div>
+{{end}}</body>
+</html>
+`))
+
+func writeHTML(w io.Writer, doc Document) error {
+	return htmlTemplate.Execute(w, struct {
+		Title string
+		Meta  string
+		Doc   Document
+	}{title(doc), sessionLine(doc), doc})
+}
@@ -0,0 +1,199 @@
+// Package git runs the git commands droid-acp needs to record each turn in
+// a repository and to undo it again.
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNotRepo is returned by Open for a directory outside any git work tree.
+var ErrNotRepo = errors.New("not a git repository")
+
+// Timeout bounds each git command. Turns are recorded while Droid waits
+// for its next message, so a hung hook or credential prompt must not
+// stall the session.
+var Timeout = 30 * time.Second
+
+// noSign turns off commit signing for commands that create commits: a
+// pinentry or signing agent prompt has nobody to answer it.
+var noSign = []string{"-c", "commit.gpgsign=false"}
+
+// Repo is the work tree of a git repository.
+type Repo struct {
+	dir string
+}
+
+// Open returns the repository whose work tree contains dir.
+func Open(dir string) (*Repo, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, err
+	}
+	top, err := (&Repo{dir: dir}).run(nil, "", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotRepo, dir)
+	}
+	return &Repo{dir: top}, nil
+}
+
+// Dir returns the top directory of the work tree.
+func (r *Repo) Dir() string {
+	return r.dir
+}
+
+// run runs git in the work tree and returns its trimmed output.
+func (r *Repo) run(env []string, stdin string, args ...string) (string, error) {
+	out, err := r.output(env, stdin, args...)
+	return strings.TrimSpace(out), err
+}
+
+// output runs git in the work tree and returns its output as is.
+func (r *Repo) output(env []string, stdin string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	// Hooks started by git may keep its output open after it is killed.
+	cmd.WaitDelay = time.Second
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		name := args[0]
+		if name == "-c" {
+			name = args[2]
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("git %s: timed out after %s", name, Timeout)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", name, msg)
+	}
+	return stdout.String(), nil
+}
+
+// Head returns the commit checked out, or "" on a branch without commits.
+func (r *Repo) Head() (string, error) {
+	head, err := r.run(nil, "", "rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		if _, symErr := r.run(nil, "", "symbolic-ref", "HEAD"); symErr == nil {
+			return "", nil
+		}
+		return "", err
+	}
+	return head, nil
+}
+
+// Dirty reports whether the work tree or index differ from HEAD, counting
+// untracked files that are not ignored.
+func (r *Repo) Dirty() (bool, error) {
+	out, err := r.run(nil, "", "status", "--porcelain")
+	return out != "", err
+}
+
+// Snapshot writes the current content of the work tree, as git add -A
+// would stage it, to a tree object without touching the index.
+func (r *Repo) Snapshot() (string, error) {
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "droid-acp-index-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	// The temporary index starts from HEAD without the stat data of the
+	// real one, so every file is read again: a copied index would make an
+	// edit that keeps the size and mtime of a file look unchanged.
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(dir, "index")}
+	if head != "" {
+		if _, err := r.run(env, "", "read-tree", head); err != nil {
+			return "", err
+		}
+	}
+	if _, err := r.run(env, "", "add", "-A", "--", "."); err != nil {
+		return "", err
+	}
+	return r.run(env, "", "write-tree")
+}
+
+// Tree returns the tree of commit.
+func (r *Repo) Tree(commit string) (string, error) {
+	return r.run(nil, "", "rev-parse", commit+"^{tree}")
+}
+
+// CommitTree creates an unsigned commit of tree with message, on top of
+// parent unless it is "", without changing any branch.
+func (r *Repo) CommitTree(tree, parent, message string) (string, error) {
+	args := slices.Concat(noSign, []string{"commit-tree", tree})
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return r.run(nil, message, append(args, "-F", "-")...)
+}
+
+// UpdateRef points ref at commit.
+func (r *Repo) UpdateRef(ref, commit string) error {
+	_, err := r.run(nil, "", "update-ref", ref, commit)
+	return err
+}
+
+// CommitAll stages every change in the work tree and commits it with
+// message to the current branch. It returns the new commit. The commit is
+// unsigned and skips the pre-commit and commit-msg hooks, which may be
+// slow or interactive; it records what the agent did, not a change ready
+// to share.
+func (r *Repo) CommitAll(message string) (string, error) {
+	if _, err := r.run(nil, "", "add", "-A", "--", "."); err != nil {
+		return "", err
+	}
+	args := slices.Concat(noSign, []string{"commit", "--quiet", "--no-verify", "-F", "-"})
+	if _, err := r.run(nil, message, args...); err != nil {
+		return "", err
+	}
+	return r.run(nil, "", "rev-parse", "HEAD")
+}
+
+// Revert commits the reverse of commits, in the order given, unsigned
+// like CommitAll. If any of them does not apply cleanly nothing is
+// changed.
+func (r *Repo) Revert(commits ...string) error {
+	args := slices.Concat(noSign, []string{"revert", "--no-edit"}, commits)
+	if _, err := r.run(nil, "", args...); err != nil {
+		r.run(nil, "", "revert", "--abort")
+		return err
+	}
+	return nil
+}
+
+// Unapply takes the changes from parent to commit back out of the work
+// tree, leaving the index alone. It fails without changing anything if
+// the files involved changed since.
+func (r *Repo) Unapply(parent, commit string) error {
+	patch, err := r.output(nil, "", "diff", "--binary", "--no-renames", parent, commit)
+	if err != nil || patch == "" {
+		return err
+	}
+	if _, err := r.run(nil, patch, "apply", "--reverse", "--check"); err != nil {
+		return err
+	}
+	_, err = r.run(nil, patch, "apply", "--reverse")
+	return err
+}
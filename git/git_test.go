@@ -0,0 +1,214 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRepo creates a repository with one commit of a.txt.
+func newRepo(t *testing.T) (*Repo, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "Test"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, err := repo.Head(); err != nil || head != "" {
+		t.Fatalf("Head of a new repository = %q, %v", head, err)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v0\n")
+	if _, err := repo.CommitAll("initial"); err != nil {
+		t.Fatal(err)
+	}
+	return repo, dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	if _, err := Open(t.TempDir()); !errors.Is(err, ErrNotRepo) {
+		t.Errorf("Open outside a repository error = %v", err)
+	}
+}
+
+func TestCommitAndRevert(t *testing.T) {
+	repo, dir := newRepo(t)
+	a := filepath.Join(dir, "a.txt")
+	if dirty, err := repo.Dirty(); err != nil || dirty {
+		t.Fatalf("Dirty after commit = %v, %v", dirty, err)
+	}
+
+	writeFile(t, a, "v1\n")
+	if dirty, _ := repo.Dirty(); !dirty {
+		t.Error("Dirty after editing a.txt = false")
+	}
+	commit, err := repo.CommitAll("edit a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Revert(commit); err != nil {
+		t.Fatalf("Revert: %v", err)
+	}
+	if got := readFile(t, a); got != "v0\n" {
+		t.Errorf("a.txt after Revert = %q", got)
+	}
+}
+
+func TestSnapshotAndUnapply(t *testing.T) {
+	repo, dir := newRepo(t)
+	a, b, c := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), filepath.Join(dir, "c.txt")
+	head, _ := repo.Head()
+
+	// The user's uncommitted change is part of the starting tree.
+	writeFile(t, b, "user\n")
+	start, err := repo.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An edit that keeps the size and mtime of a file is still seen, even
+	// when the index holds trusted stat data for it.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(a, past, past); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"config", "core.trustctime", "false"},
+		{"update-index", "--refresh"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	writeFile(t, a, "v1\n")
+	if err := os.Chtimes(a, past, past); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, c, "agent\n")
+	end, err := repo.Snapshot()
+	if err != nil || end == start {
+		t.Fatalf("Snapshot after edits = %q, %v", end, err)
+	}
+	if dirty, _ := repo.Dirty(); !dirty {
+		t.Error("Snapshot staged the changes in the index")
+	}
+
+	before, err := repo.CommitTree(start, head, "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitTree(end, before, "turn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateRef("refs/droid-acp/s/1", commit); err != nil {
+		t.Fatal(err)
+	}
+	if tree, _ := repo.Tree("refs/droid-acp/s/1"); tree != end {
+		t.Errorf("Tree of the ref = %q, want %q", tree, end)
+	}
+	if out, _ := exec.Command("git", "-C", dir, "show", "refs/droid-acp/s/1:a.txt").Output(); string(out) != "v1\n" {
+		t.Errorf("a.txt in the turn = %q, want v1", out)
+	}
+
+	// Changes made since block Unapply.
+	writeFile(t, c, "edited\n")
+	if err := repo.Unapply(before, commit); err == nil {
+		t.Fatal("Unapply over a later change succeeded")
+	}
+	if got := readFile(t, a); got != "v1\n" {
+		t.Errorf("failed Unapply changed a.txt to %q", got)
+	}
+
+	writeFile(t, c, "agent\n")
+	if err := repo.Unapply(before, commit); err != nil {
+		t.Fatalf("Unapply: %v", err)
+	}
+	if got := readFile(t, a); got != "v0\n" {
+		t.Errorf("a.txt after Unapply = %q", got)
+	}
+	if _, err := os.Stat(c); !errors.Is(err, os.ErrNotExist) {
+		t.Error("c.txt created by the turn still exists")
+	}
+	if got := readFile(t, b); got != "user\n" {
+		t.Errorf("Unapply changed the user's b.txt to %q", got)
+	}
+}
+
+func TestCommitAllSkipsHooksAndSigning(t *testing.T) {
+	repo, dir := newRepo(t)
+	hooks := filepath.Join(dir, ".git", "hooks")
+	os.MkdirAll(hooks, 0o755)
+	if err := os.WriteFile(filepath.Join(hooks, "pre-commit"), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "-C", dir, "config", "commit.gpgsign", "true").CombinedOutput(); err != nil {
+		t.Fatalf("git config: %v\n%s", err, out)
+	}
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "v1\n")
+	commit, err := repo.CommitAll("turn 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Revert(commit); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); got != "v0\n" {
+		t.Errorf("a.txt after Revert = %q", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	repo, dir := newRepo(t)
+	hooks := filepath.Join(dir, ".git", "hooks")
+	os.MkdirAll(hooks, 0o755)
+	if err := os.WriteFile(filepath.Join(hooks, "post-commit"), []byte("#!/bin/sh\nsleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { Timeout = d }(Timeout)
+	Timeout = 200 * time.Millisecond
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "v1\n")
+	start := time.Now()
+	_, err := repo.CommitAll("turn 1")
+	if err == nil || !strings.Contains(err.Error(), "git commit: timed out") {
+		t.Errorf("CommitAll error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("CommitAll took %s", elapsed)
+	}
+}
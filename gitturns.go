@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"droid-acp/config"
+	"droid-acp/git"
+	"droid-acp/snapshots"
+)
+
+// gitTurn is the state of the repository when the running turn started.
+type gitTurn struct {
+	repo *git.Repo
+	head string
+	// dirty is whether the work tree had uncommitted changes; tree is its
+	// content, including them.
+	dirty bool
+	tree  string
+}
+
+// startGitTurn records HEAD and the work tree of the session's repository
+// at the start of a turn, when git.turns is enabled.
+func (a *droidAgent) startGitTurn() {
+	a.mu.Lock()
+	mode, cwd := a.cfg.Git.Turns, a.lastSessionCwd
+	a.gitTurn = nil
+	a.mu.Unlock()
+	if mode == config.GitTurnsOff || cwd == "" {
+		return
+	}
+
+	repo, err := git.Open(cwd)
+	if err != nil {
+		a.acpLog.Info("not recording the turn in git", "cwd", cwd, "err", err)
+		return
+	}
+	turn := &gitTurn{repo: repo}
+	if turn.head, err = repo.Head(); err == nil {
+		if turn.dirty, err = repo.Dirty(); err == nil {
+			turn.tree, err = repo.Snapshot()
+		}
+	}
+	if err != nil {
+		a.acpLog.Error("failed to record the repository state", "dir", repo.Dir(), "err", err)
+		return
+	}
+	a.mu.Lock()
+	a.gitTurn = turn
+	a.mu.Unlock()
+}
+
+// finishGitTurn records what the turn that just ended changed in the
+// repository: as a commit on the current branch in commit mode, or as a
+// commit under refs/droid-acp/ in ref mode. Commit mode falls back to a
+// ref when the work tree was dirty or HEAD moved, so that the commit
+// holds only the agent's changes.
+func (a *droidAgent) finishGitTurn() {
+	a.mu.Lock()
+	turn := a.gitTurn
+	a.gitTurn = nil
+	mode := a.cfg.Git.Turns
+	sessionID, id, prompt := a.currentSession, a.turnID, a.turnPrompt
+	a.mu.Unlock()
+	if turn == nil {
+		return
+	}
+
+	record, err := recordGitTurn(turn, mode, sessionID, id, prompt)
+	if err != nil {
+		a.acpLog.Error("failed to record the turn in git", "dir", turn.repo.Dir(), "err", err)
+		a.agentMessage("\n\nCould not record this turn in git: " + err.Error())
+		return
+	}
+	if record == nil {
+		return
+	}
+	if a.snapshots != nil {
+		if err := a.snapshots.RecordGit(sessionID, id, prompt, *record); err != nil {
+			a.acpLog.Error("failed to save the git record of the turn", "session", sessionID, "err", err)
+		}
+	}
+	if record.Mode == config.GitTurnsCommit {
+		a.agentMessage(fmt.Sprintf("\n\nCommitted this turn as `%s`.", shortHash(record.Commit)))
+		return
+	}
+	why := ""
+	if mode == config.GitTurnsCommit {
+		why = " The work tree had other changes, so it was not committed to the branch."
+	}
+	a.agentMessage(fmt.Sprintf("\n\nSaved this turn's changes as `%s` (`%s`).%s", record.Ref, shortHash(record.Commit), why))
+}
+
+// recordGitTurn commits the changes since turn started. It returns nil
+// when there are none.
+func recordGitTurn(turn *gitTurn, mode, sessionID string, id int, prompt string) (*snapshots.GitRecord, error) {
+	repo := turn.repo
+	tree, err := repo.Snapshot()
+	if err != nil || tree == turn.tree {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	message := strings.TrimSpace(prompt)
+	if message == "" {
+		message = fmt.Sprintf("droid-acp turn %d", id)
+	}
+	message += fmt.Sprintf("\n\nDroid-ACP-Session: %s\nDroid-ACP-Turn: %d\n", sessionID, id)
+	record := &snapshots.GitRecord{Dir: repo.Dir(), Head: turn.head, Dirty: turn.dirty}
+
+	if mode == config.GitTurnsCommit && !turn.dirty && head == turn.head {
+		record.Mode = config.GitTurnsCommit
+		record.Parent = head
+		record.Commit, err = repo.CommitAll(message)
+		return record, err
+	}
+
+	// The turn's commit sits on top of a commit of the work tree as the
+	// turn found it, so that it holds only the agent's changes.
+	before, err := repo.CommitTree(turn.tree, turn.head, fmt.Sprintf("droid-acp: work tree before turn %d", id))
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitTree(tree, before, message)
+	if err != nil {
+		return nil, err
+	}
+	record.Mode = config.GitTurnsRef
+	record.Parent = before
+	record.Commit = commit
+	record.Ref = fmt.Sprintf("refs/droid-acp/%s/%d", sessionID, id)
+	return record, repo.UpdateRef(record.Ref, commit)
+}
+
+// undoGitTurns undoes the last n turns of session through git when every
+// one of them was recorded there: commits are reverted and the changes of
+// refs are taken out of the work tree. ok is false when the turns were not
+// all recorded in git, so the file snapshots have to be used instead. On
+// an error, summary still describes the turns that were undone.
+func undoGitTurns(store *snapshots.Store, session string, n int) (summary string, ok bool, err error) {
+	turns, err := store.Turns(session)
+	if err != nil || len(turns) == 0 {
+		return "", false, err
+	}
+	n = min(max(n, 1), len(turns))
+	undone := turns[len(turns)-n:]
+	for _, turn := range undone {
+		if turn.Git == nil {
+			return "", false, nil
+		}
+	}
+
+	var lines []string
+	for i := len(undone) - 1; i >= 0; i-- {
+		record := undone[i].Git
+		repo, err := git.Open(record.Dir)
+		if err == nil {
+			if record.Mode == config.GitTurnsCommit {
+				err = repo.Revert(record.Commit)
+			} else {
+				err = repo.Unapply(record.Parent, record.Commit)
+			}
+		}
+		if err != nil {
+			if popErr := store.Pop(session, len(lines)); popErr != nil {
+				err = errors.Join(err, popErr)
+			}
+			return gitUndoSummary(lines), true, err
+		}
+		if record.Mode == config.GitTurnsCommit {
+			lines = append(lines, fmt.Sprintf("- reverted commit `%s`", shortHash(record.Commit)))
+		} else {
+			lines = append(lines, fmt.Sprintf("- took the changes of `%s` out of the work tree", record.Ref))
+		}
+	}
+	return gitUndoSummary(lines), true, store.Pop(session, len(lines))
+}
+
+func gitUndoSummary(lines []string) string {
+	switch len(lines) {
+	case 0:
+		return ""
+	case 1:
+		return "Undid the last turn through git:\n" + lines[0]
+	}
+	return fmt.Sprintf("Undid the last %d turns through git:\n%s", len(lines), strings.Join(lines, "\n"))
+}
+
+// printGitUndo reports the result of undoGitTurns to the undo subcommand.
+func printGitUndo(out io.Writer, summary string, err error) error {
+	if summary != "" {
+		fmt.Fprintln(out, summary)
+	}
+	if err != nil {
+		return fmt.Errorf("undo through git stopped: %w", err)
+	}
+	return nil
+}
+
+func shortHash(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"droid-acp/usage"
+)
+
+// Stop reasons for turns ended by a limit.
+const (
+	stopMaxTokens       = "max_tokens"
+	stopMaxTurnRequests = "max_turn_requests"
+)
+
+// exceededLimit reports the first configured limit the session or its
+// current turn has reached, with an explanation for the user. a.mu must be
+// held.
+func (a *droidAgent) exceededLimit() (stopReason, why string) {
+	session, turn := a.cfg.Limits.Session, a.cfg.Limits.Turn
+
+	turnTokens := a.sessionTokens.Sub(a.turnStart)
+	turnCost, _ := usage.Cost(a.cfg.Usage.Prices, a.modelId, turnTokens)
+	turnCount := turnTokens.Total() - turnTokens.CacheRead
+	sessionCount := a.sessionTokens.Total() - a.sessionTokens.CacheRead
+	turnTools := len(a.turnToolUses)
+	turnTime := time.Duration(0)
+	if !a.turnStarted.IsZero() {
+		turnTime = time.Since(a.turnStarted)
+	}
+
+	switch {
+	case turn.MaxTokens > 0 && turnCount >= turn.MaxTokens:
+		return stopMaxTokens, fmt.Sprintf("This turn used %s tokens, reaching the limit of %s per turn.",
+			usage.FormatTokens(turnCount), usage.FormatTokens(turn.MaxTokens))
+	case session.MaxTokens > 0 && sessionCount >= session.MaxTokens:
+		return stopMaxTokens, fmt.Sprintf("This session used %s tokens, reaching the limit of %s per session.",
+			usage.FormatTokens(sessionCount), usage.FormatTokens(session.MaxTokens))
+	case turn.MaxCostUSD > 0 && turnCost >= turn.MaxCostUSD:
+		return stopMaxTokens, fmt.Sprintf("This turn cost about %s, reaching the limit of %s per turn.",
+			usage.FormatCost(turnCost), usage.FormatCost(turn.MaxCostUSD))
+	case session.MaxCostUSD > 0 && a.sessionCost+turnCost >= session.MaxCostUSD:
+		return stopMaxTokens, fmt.Sprintf("This session cost about %s, reaching the limit of %s per session.",
+			usage.FormatCost(a.sessionCost+turnCost), usage.FormatCost(session.MaxCostUSD))
+	case turn.MaxToolCalls > 0 && turnTools >= turn.MaxToolCalls:
+		return stopMaxTurnRequests, fmt.Sprintf("This turn made %d tool calls, reaching the limit of %d per turn.",
+			turnTools, turn.MaxToolCalls)
+	case session.MaxToolCalls > 0 && a.sessionToolCalls+turnTools >= session.MaxToolCalls:
+		return stopMaxTurnRequests, fmt.Sprintf("This session made %d tool calls, reaching the limit of %d per session.",
+			a.sessionToolCalls+turnTools, session.MaxToolCalls)
+	case turn.Duration() > 0 && turnTime >= turn.Duration():
+		return stopMaxTurnRequests, fmt.Sprintf("This turn ran for %s, reaching the limit of %s per turn.",
+			turnTime.Round(time.Second), turn.Duration())
+	case session.Duration() > 0 && a.sessionActive+turnTime >= session.Duration():
+		return stopMaxTurnRequests, fmt.Sprintf("This session ran for %s, reaching the limit of %s per session.",
+			(a.sessionActive + turnTime).Round(time.Second), session.Duration())
+	}
+	return "", ""
+}
+
+// startTurnLimits starts the limit accounting of a new turn. If the
+// session has already used up a limit it returns the stop reason and
+// explanation instead, and the turn must not be started.
+func (a *droidAgent) startTurnLimits() (stopReason, why string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.turnStarted = time.Time{}
+	a.turnToolUses = make(map[string]bool)
+	a.limitStop = ""
+	if stopReason, why := a.exceededLimit(); stopReason != "" {
+		return stopReason, why
+	}
+	a.turnStarted = time.Now()
+
+	var wait time.Duration
+	if d := a.cfg.Limits.Turn.Duration(); d > 0 {
+		wait = d
+	}
+	if d := a.cfg.Limits.Session.Duration(); d > 0 && (wait == 0 || d-a.sessionActive < wait) {
+		wait = d - a.sessionActive
+	}
+	if wait > 0 {
+		a.limitTimer = time.AfterFunc(wait, a.enforceLimits)
+	}
+	return "", ""
+}
+
+// unpricedCostWarning explains, once per session and model, that the
+// configured cost limits cannot be enforced because the current model has
+// no known price and so always costs 0.
+func (a *droidAgent) unpricedCostWarning() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	session, turn := a.cfg.Limits.Session, a.cfg.Limits.Turn
+	if session.MaxCostUSD <= 0 && turn.MaxCostUSD <= 0 || a.costWarned == a.modelId {
+		return ""
+	}
+	if _, ok := usage.Cost(a.cfg.Usage.Prices, a.modelId, usage.Tokens{}); ok {
+		return ""
+	}
+	a.costWarned = a.modelId
+	a.acpLog.Warn("cost limit set for a model without a price", "session", a.currentSession, "model", a.modelId)
+	return fmt.Sprintf("droid-acp has no price for %s, so the cost limit is not enforced for it. Add the model under usage.prices in the droid-acp configuration to enforce it.", a.modelId)
+}
+
+// endTurnLimits closes the limit accounting of the turn that just ended
+// and returns the stop reason of a limit that ended it, if any. a.mu must
+// be held.
+func (a *droidAgent) endTurnLimits() string {
+	if a.limitTimer != nil {
+		a.limitTimer.Stop()
+		a.limitTimer = nil
+	}
+	if !a.turnStarted.IsZero() {
+		a.sessionActive += time.Since(a.turnStarted)
+		a.turnStarted = time.Time{}
+	}
+	a.sessionToolCalls += len(a.turnToolUses)
+	a.turnToolUses = nil
+	stop := a.limitStop
+	a.limitStop = ""
+	return stop
+}
+
+// countToolUse records a tool use of the current turn and enforces the
+// tool call limits.
+func (a *droidAgent) countToolUse(id string) {
+	if id == "" {
+		return
+	}
+	a.mu.Lock()
+	if a.turnToolUses != nil {
+		a.turnToolUses[id] = true
+	}
+	a.mu.Unlock()
+	a.enforceLimits()
+}
+
+// enforceLimits interrupts the running turn once it reaches a limit and
+// tells the user why; the turn then ends with the limit's stop reason.
+func (a *droidAgent) enforceLimits() {
+	a.mu.Lock()
+	if a.pendingPrompt == nil || a.limitStop != "" || a.turnStarted.IsZero() {
+		a.mu.Unlock()
+		return
+	}
+	stopReason, why := a.exceededLimit()
+	if stopReason == "" {
+		a.mu.Unlock()
+		return
+	}
+	a.limitStop = stopReason
+	droidSession := a.droidSession
+	sessionID := a.currentSession
+	a.mu.Unlock()
+
+	a.acpLog.Warn("limit reached, interrupting droid", "session", sessionID, "stopReason", stopReason, "reason", why)
+	a.agentMessage("\n\n" + why + " Droid was stopped; raise the limit in the droid-acp configuration to continue.")
+	go func() {
+		if err := a.droid.Interrupt(context.Background(), droidSession); err != nil {
+			a.droidLog.Error("failed to interrupt droid", "session", sessionID, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,196 @@
+// Package logging configures droid-acp's structured logger: leveled slog
+// output to stderr or a rotating file, with protocol payloads truncated
+// unless asked otherwise.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"droid-acp/redact"
+)
+
+// DefaultPayloadLimit is how many bytes of a protocol message are logged
+// when no explicit limit is configured.
+const DefaultPayloadLimit = 512
+
+type Options struct {
+	// Level is one of debug, info, warn or error; info when empty.
+	Level string
+	// File, when set, receives the log instead of stderr.
+	File string
+	// MaxSizeMB is the size at which File is rotated; 10 when zero.
+	MaxSizeMB int
+	// MaxBackups is how many rotated files are kept; 3 when zero.
+	MaxBackups int
+	// PayloadLimit caps logged message payloads in bytes; negative means
+	// unlimited and zero means DefaultPayloadLimit.
+	PayloadLimit int
+	// Redactor, when non-nil, masks secrets in every logged string.
+	Redactor *redact.Redactor
+}
+
+var (
+	payloadLimit    atomic.Int64
+	payloadRedactor atomic.Pointer[redact.Redactor]
+)
+
+func init() {
+	payloadLimit.Store(DefaultPayloadLimit)
+}
+
+// ParseLevel converts a level name to a slog.Level.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q; must be one of debug, info, warn, or error", name)
+}
+
+// Setup installs the default slog logger described by opts. The returned
+// closer releases the log file, if any.
+func Setup(opts Options) (io.Closer, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if opts.File != "" {
+		maxSize := opts.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = 10
+		}
+		backups := opts.MaxBackups
+		if backups <= 0 {
+			backups = 3
+		}
+		f, err := OpenRotating(opts.File, int64(maxSize)<<20, backups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	switch {
+	case opts.PayloadLimit < 0:
+		payloadLimit.Store(0)
+	case opts.PayloadLimit == 0:
+		payloadLimit.Store(DefaultPayloadLimit)
+	default:
+		payloadLimit.Store(int64(opts.PayloadLimit))
+	}
+
+	payloadRedactor.Store(opts.Redactor)
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr(opts.Redactor),
+	})))
+	return closer, nil
+}
+
+func redactAttr(r *redact.Redactor) func([]string, slog.Attr) slog.Attr {
+	if r == nil {
+		return nil
+	}
+	return func(_ []string, a slog.Attr) slog.Attr {
+		switch a.Value.Kind() {
+		case slog.KindString:
+			a.Value = slog.StringValue(r.String(a.Value.String()))
+		case slog.KindAny:
+			if err, ok := a.Value.Any().(error); ok {
+				a.Value = slog.StringValue(r.String(err.Error()))
+			}
+		}
+		return a
+	}
+}
+
+// Component returns the default logger tagged with a component name such
+// as acp, droid or permission.
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
+
+// Payload returns a log attribute holding a protocol message, truncated to
+// the configured payload limit. Secrets are masked before truncating so a
+// cut cannot leave part of one behind.
+func Payload(b []byte) slog.Attr {
+	b = payloadRedactor.Load().Bytes(b)
+	limit := int(payloadLimit.Load())
+	if limit > 0 && len(b) > limit {
+		return slog.String("payload", fmt.Sprintf("%s… (%d bytes)", b[:limit], len(b)))
+	}
+	return slog.String("payload", string(b))
+}
+
+// Traffic logs one protocol message at debug level with its direction,
+// method and id broken out as fields.
+func Traffic(log *slog.Logger, outbound bool, line []byte) {
+	if !log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	var head struct {
+		ID     any    `json:"id"`
+		Method string `json:"method"`
+	}
+	json.Unmarshal(line, &head)
+
+	dir := "in"
+	if outbound {
+		dir = "out"
+	}
+	attrs := []slog.Attr{slog.String("dir", dir)}
+	if head.Method != "" {
+		attrs = append(attrs, slog.String("method", head.Method))
+	}
+	if head.ID != nil {
+		attrs = append(attrs, slog.Any("request", head.ID))
+	}
+	attrs = append(attrs, Payload(line))
+	log.LogAttrs(context.Background(), slog.LevelDebug, "message", attrs...)
+}
+
+// Writer returns an io.Writer that logs each line written to it, which is
+// used to capture a subprocess's stderr.
+func Writer(log *slog.Logger, level slog.Level) io.Writer {
+	return &lineWriter{log: log, level: level}
+}
+
+type lineWriter struct {
+	log   *slog.Logger
+	level slog.Level
+	buf   []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := strings.IndexByte(string(w.buf), '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.log.Log(context.Background(), w.level, line)
+		}
+	}
+	return len(p), nil
+}
@@ -2,18 +2,28 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
-	"os/exec"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"droid-acp/acp"
+	"droid-acp/config"
+	"droid-acp/droid"
+	"droid-acp/logging"
+	"droid-acp/record"
+	"droid-acp/redact"
+	"droid-acp/sessions"
+	"droid-acp/snapshots"
 	"droid-acp/types"
+	"droid-acp/usage"
 	"droid-acp/utils"
 
 	"github.com/google/uuid"
@@ -23,888 +33,1152 @@ const (
 	version                = "1.0.5"
 	modelUpdateMaxAttempts = 3
 	modelUpdateRetryDelay  = 200 * time.Millisecond
+	droidStartupTimeout    = 15 * time.Second
 )
 
-var (
-	writeMu              sync.Mutex
-	droidMsgID           int
-	acpMsgID             int
-	modelId              string
-	modelFilter          string = "all"
-	currentSession       string
-	lastSessionCwd       string
-	droidIn              io.Writer
-	acpOut               io.Writer
-	pendingPromptID      any
-	pendingPromptMu      sync.Mutex
-	pendingSessionID     any
-	pendingSessionMu     sync.Mutex
-	permissionRequestMu  sync.Mutex
-	permissionRequestMap = make(map[string]permissionRequest)
-)
-
-type permissionRequest struct {
-	DroidRequestID string
-	ToolCallID     string
-	WritePath      string
-	WriteContent   string
+// droidAgent implements acp.Agent on top of a single Droid process.
+type droidAgent struct {
+	conn  *acp.AgentConn
+	droid *droid.Client
+	// droidErr is why Droid is unavailable; it is reported to Zed on
+	// session/new instead of exiting.
+	droidErr error
+
+	acpLog   *slog.Logger
+	droidLog *slog.Logger
+	permLog  *slog.Logger
+
+	settings settings
+
+	mu             sync.Mutex
+	modelId        string
+	currentSession string
+	droidSession   string
+	lastSessionCwd string
+	cfg            *config.Config
+	modes          []types.AvailableMode
+	modeId         string
+	models         []types.ModelInfo
+	commands       []command
+
+	// pendingPrompt is the prompt the running turn reports to, and
+	// steered are prompts that joined it in steer mode. turnBusy stays set
+	// from the start of a turn until Droid is handed to the next of the
+	// queued prompts.
+	pendingPrompt chan promptOutcome
+	steered       []chan promptOutcome
+	queued        []queuedPrompt
+	turnBusy      bool
+	cancelled     bool
+	// modelStop and turnErr are what Droid reported about the running
+	// turn: the model's stop reason and a failure.
+	modelStop string
+	turnErr   error
+	// streamedTools are the tool uses of the turn whose input was streamed,
+	// keyed by ID; streamIndex finds the ID of a content block index.
+	streamedTools map[string]*streamedTool
+	streamIndex   map[int]string
+	// workingState is the last state Droid reported.
+	workingState string
+	// misread are the notification shapes already warned about; see
+	// notificationMisread.
+	misread map[string]bool
+	// subagents are the sub-agents working in this turn, keyed by the tool
+	// use that started them.
+	subagents map[string]*subagent
+	// changes are the files and commands of this turn; see summary.go.
+	changes turnChanges
+
+	// Token usage is cumulative for the Droid session; turnStart is the
+	// count when the current turn began.
+	sessionTokens   usage.Tokens
+	turnStart       usage.Tokens
+	sessionCost     float64
+	sessionUnpriced bool
+	// costWarned is the model last warned about having no price while a
+	// cost limit is set.
+	costWarned string
+	// ledger records the usage of every turn; nil disables it.
+	ledger *usage.Ledger
+
+	// sessions stores the metadata of every session; nil disables it.
+	sessions    *sessions.Store
+	sessionMeta sessions.Meta
+	// snapshots keeps the previous content of the files written in each
+	// turn; nil disables it. turnID and turnPrompt identify the running
+	// turn.
+	snapshots  *snapshots.Store
+	turnID     int
+	turnPrompt string
+	// gitTurn is the repository state at the start of the running turn,
+	// when it is recorded in git.
+	gitTurn *gitTurn
+	// forkSeed is the earlier conversation of a forked session, sent with
+	// its first prompt.
+	forkSeed string
+
+	// Limit accounting; see limits.go.
+	turnStarted      time.Time
+	turnToolUses     map[string]bool
+	sessionToolCalls int
+	sessionActive    time.Duration
+	limitStop        string
+	limitTimer       *time.Timer
 }
 
-func sendACPResponse(id any, result any) error {
-	writeMu.Lock()
-	defer writeMu.Unlock()
-
-	resp := types.ACPResponse{
-		JSONRPC: "2.0",
-		ID:      id,
-		Result:  result,
+// newDroidAgent returns an agent that writes ACP traffic to out. cfg is
+// the configuration before any project file is read; each session resolves
+// its own from s. The Droid client must be attached before the connection
+// is served.
+func newDroidAgent(out io.Writer, s settings, cfg *config.Config) *droidAgent {
+	a := &droidAgent{
+		acpLog:   logging.Component("acp"),
+		droidLog: logging.Component("droid"),
+		permLog:  logging.Component("permission"),
+		settings: s,
+		cfg:      cfg,
 	}
-
-	b, err := json.Marshal(resp)
-	if err != nil {
-		return err
-	}
-	fmt.Fprintf(os.Stderr, "[->ZED] %s\n", string(b))
-	_, err = fmt.Fprintln(acpOut, string(b))
-	return err
+	a.conn = acp.NewAgentConn(a, out)
+	return a
 }
 
-func sendACPNotification(method string, params any) error {
-	writeMu.Lock()
-	defer writeMu.Unlock()
+func (a *droidAgent) Initialize(ctx context.Context, params types.InitializeParams) (types.InitializeResult, error) {
+	return types.InitializeResult{
+		ProtocolVersion: 1,
+		AgentCapabilities: types.AgentCapabilities{
+			LoadSession: false,
+			PromptCapabilities: types.PromptCapabilities{
+				Image:           false,
+				Audio:           false,
+				EmbeddedContext: true,
+			},
+			MCP: types.McpInfo{
+				Http: false,
+				Sse:  false,
+			},
+			SessionCapabilities: &types.SessionCapabilities{
+				List: &struct{}{},
+				Fork: &struct{}{},
+			},
+			Meta: map[string]any{"droidAcp": map[string]any{
+				"sessionList":   listSessionsMethod,
+				"sessionDelete": deleteSessionMethod,
+			}},
+		},
+		AgentInfo: types.AgentInfo{
+			Name:    "droid-acp",
+			Title:   "Droid ACP",
+			Version: version,
+		},
+	}, nil
+}
 
-	notif := types.ACPNotification{
-		JSONRPC: "2.0",
-		Method:  method,
-		Params:  params,
+func (a *droidAgent) NewSession(ctx context.Context, params types.NewSessionParams) (types.NewSessionResult, error) {
+	cwd := params.Cwd
+	if cwd == "" {
+		cwd = "."
 	}
-
-	b, err := json.Marshal(notif)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] Failed to marshal notification: %v\n", err)
-		return err
+	if err := a.droidUnavailable(); err != nil {
+		return types.NewSessionResult{}, err
 	}
-	fmt.Fprintf(os.Stderr, "[->ZED NOTIF] %s\n", string(b))
-	_, err = fmt.Fprintln(acpOut, string(b))
+	cfg, err := a.settings.resolve(params.Cwd)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] Failed to write notification: %v\n", err)
-	}
-	return err
-}
-
-func sendACPRequest(method string, params any) (string, error) {
-	writeMu.Lock()
-	defer writeMu.Unlock()
-
-	acpMsgID++
-	id := strconv.Itoa(acpMsgID)
-
-	req := struct {
-		JSONRPC string `json:"jsonrpc"`
-		ID      string `json:"id"`
-		Method  string `json:"method"`
-		Params  any    `json:"params,omitempty"`
-	}{
-		JSONRPC: "2.0",
-		ID:      id,
-		Method:  method,
-		Params:  params,
+		a.acpLog.Error("invalid project configuration", "cwd", cwd, "err", err)
+		return types.NewSessionResult{}, &types.Error{
+			Code:    acp.CodeInvalidParams,
+			Message: "Invalid droid-acp configuration: " + err.Error(),
+		}
 	}
+	a.mu.Lock()
+	a.lastSessionCwd = cwd
+	a.cfg = cfg
+	a.mu.Unlock()
 
-	b, err := json.Marshal(req)
+	result, err := a.droid.InitializeSession(ctx, cwd)
 	if err != nil {
-		return "", err
+		a.droidLog.Error("failed to initialize droid session", "cwd", cwd, "err", err)
+		return types.NewSessionResult{}, err
 	}
-	fmt.Fprintf(os.Stderr, "[->ZED REQ] %s\n", string(b))
-	_, err = fmt.Fprintln(acpOut, string(b))
-	return id, err
-}
 
-func sendDroidResponseWithID(id any, result any) error {
-	writeMu.Lock()
-	defer writeMu.Unlock()
+	models := offeredModels(cfg.Model, result.AvailableModels)
 
-	resp := map[string]any{
-		"jsonrpc":           "2.0",
-		"factoryApiVersion": "1.0.0",
-		"type":              "response",
-		"id":                id,
-		"result":            result,
+	listMode := sessionModes(result)
+
+	currentModelId, currentMode := a.applyDefaults(ctx, cfg, result, models, listMode.AvailableModes)
+	listMode.CurrentModeId = currentMode
+
+	var listModel = types.Models{
+		AvailableModels: models,
+		CurrentModelId:  currentModelId,
 	}
 
-	b, err := json.Marshal(resp)
-	if err != nil {
-		return err
+	a.mu.Lock()
+	a.currentSession = uuid.New().String()
+	a.droidSession = result.SessionID
+	a.modes = listMode.AvailableModes
+	a.modeId = currentMode
+	a.models = models
+	a.modelId = string(currentModelId)
+	a.sessionTokens = usage.Tokens{}
+	a.turnStart = usage.Tokens{}
+	a.sessionCost = 0
+	a.sessionUnpriced = false
+	a.costWarned = ""
+	a.sessionToolCalls = 0
+	a.sessionActive = 0
+	a.commands = loadCommands(params.Cwd, a.acpLog.Warn)
+	a.forkSeed = ""
+	a.sessionMeta = sessions.Meta{
+		ID:             a.currentSession,
+		DroidSessionID: result.SessionID,
+		Cwd:            cwd,
+		Model:          a.modelId,
+		Created:        time.Now(),
 	}
-	_, err = fmt.Fprintln(droidIn, string(b))
-	return err
+	sessionID := a.currentSession
+	commands := availableCommands(a.commands)
+	a.mu.Unlock()
+	a.updateSessionMeta(func(*sessions.Meta) {})
+
+	acp.AfterReply(ctx, func() {
+		a.sessionUpdate(types.Update{
+			SessionUpdate:     "available_commands_update",
+			AvailableCommands: commands,
+		})
+	})
+
+	return types.NewSessionResult{
+		SessionId: sessionID,
+		Models:    listModel,
+		Modes:     listMode,
+	}, nil
 }
 
-func sendDroidOK(id any) error {
-	switch v := id.(type) {
-	case nil:
-		return nil
-	case string:
-		if v == "" {
-			return nil
+// applyDefaults switches a fresh Droid session to the configured default
+// model and mode and returns the model and mode now in effect. Invalid
+// defaults are logged and left out so the session still opens.
+func (a *droidAgent) applyDefaults(ctx context.Context, cfg *config.Config, result *types.ResultModel, models []types.ModelInfo, modes []types.AvailableMode) (types.ModelId, string) {
+	modelId := types.ModelId(result.Settings.ModelID)
+	mode := currentMode(result.Settings)
+
+	update := types.UpdateSessionSettingsParams{SessionId: result.SessionID}
+	if want := types.ModelId(cfg.Model.Default); want != "" && want != modelId {
+		found := false
+		var ids []string
+		for _, model := range models {
+			found = found || model.ModelId == want
+			ids = append(ids, string(model.ModelId))
+		}
+		if found {
+			update.ModelId = string(want)
+		} else {
+			a.acpLog.Warn("ignoring default model that droid does not offer", "model", want, "filter", cfg.Model.Filter, "available", strings.Join(ids, ", "))
 		}
 	}
-	return sendDroidResponseWithID(id, map[string]bool{"ok": true})
-}
-
-func initializeDroidSession(cwd string) error {
-	writeMu.Lock()
-	defer writeMu.Unlock()
-
-	req := map[string]any{
-		"jsonrpc":           "2.0",
-		"factoryApiVersion": "1.0.0",
-		"type":              "request",
-		"id":                "0",
-		"method":            "droid.initialize_session",
-		"params": map[string]any{
-			"machineId": uuid.New().String(),
-			"cwd":       cwd,
-		},
+	newMode := ""
+	if want := cfg.Autonomy.Default; want != "" && want != mode {
+		if hasMode(modes, want) {
+			newMode = want
+			modeUpdate := modeSettings(result.SessionID, want)
+			update.AutonomyLevel = modeUpdate.AutonomyLevel
+			update.SpecMode = modeUpdate.SpecMode
+		} else {
+			a.acpLog.Warn("ignoring default mode that droid does not offer", "mode", want)
+		}
+	}
+	if update.ModelId == "" && newMode == "" {
+		return modelId, mode
 	}
 
-	b, err := json.Marshal(req)
-	if err != nil {
-		return err
+	if err := a.droid.UpdateSessionSettings(ctx, update); err != nil {
+		a.droidLog.Error("failed to apply default session settings", "model", update.ModelId, "mode", newMode, "err", err)
+		return modelId, mode
 	}
-	fmt.Fprintf(os.Stderr, "[->DROID] %s\n", string(b))
-	_, err = fmt.Fprintln(droidIn, string(b))
-	return err
+	if update.ModelId != "" {
+		modelId = types.ModelId(update.ModelId)
+		a.mu.Lock()
+		a.modelId = update.ModelId
+		a.mu.Unlock()
+	}
+	if newMode != "" {
+		mode = newMode
+	}
+	return modelId, mode
 }
 
-func sendDroidUserMessage(params map[string]any) error {
-	writeMu.Lock()
-	defer writeMu.Unlock()
-
-	droidMsgID++
-	id := strconv.Itoa(droidMsgID)
+func (a *droidAgent) LoadSession(ctx context.Context, params types.LoadSessionParams) (types.LoadSessionResult, error) {
+	return types.LoadSessionResult{}, acp.ErrMethodNotFound("session/load")
+}
 
-	req := map[string]any{
-		"jsonrpc":           "2.0",
-		"factoryApiVersion": "1.0.0",
-		"type":              "request",
-		"id":                id,
-		"method":            "droid.add_user_message",
-		"params":            params,
+// droidUnavailable is the error for requests made when Droid did not
+// start, or nil if it did.
+func (a *droidAgent) droidUnavailable() error {
+	if a.droidErr == nil && a.droid != nil {
+		return nil
 	}
-
-	b, err := json.Marshal(req)
-	if err != nil {
-		return err
+	msg := "Droid is not available"
+	if a.droidErr != nil {
+		msg += ": " + a.droidErr.Error()
 	}
-	fmt.Fprintf(os.Stderr, "[->DROID] %s\n", string(b))
-	_, err = fmt.Fprintln(droidIn, string(b))
-	return err
+	return &types.Error{Code: acp.CodeInternalError, Message: msg}
 }
 
-func sendDroidRequest(method string, params any) (string, error) {
-	writeMu.Lock()
-	defer writeMu.Unlock()
-
-	droidMsgID++
-	id := strconv.Itoa(droidMsgID)
-
-	req := map[string]any{
-		"jsonrpc":           "2.0",
-		"factoryApiVersion": "1.0.0",
-		"type":              "request",
-		"id":                id,
-		"method":            method,
-		"params":            params,
+// checkSession fails for any session but the current one. droid-acp
+// drives a single Droid session, so a session replaced by a new or forked
+// one can no longer be used.
+func (a *droidAgent) checkSession(sessionID string) error {
+	if err := a.droidUnavailable(); err != nil {
+		return err
 	}
-
-	b, err := json.Marshal(req)
-	if err != nil {
-		return "", err
+	a.mu.Lock()
+	current := a.currentSession
+	a.mu.Unlock()
+	if sessionID == "" {
+		return &types.Error{Code: acp.CodeInvalidParams, Message: "sessionId is required"}
+	}
+	if sessionID == current {
+		return nil
+	}
+	return &types.Error{
+		Code:    acp.CodeInvalidParams,
+		Message: fmt.Sprintf("Session %s is no longer active: droid-acp runs one session at a time and a newer session replaced it. Continue in the newer session or fork this one.", sessionID),
 	}
-	fmt.Fprintf(os.Stderr, "[->DROID] %s\n", string(b))
-	_, err = fmt.Fprintln(droidIn, string(b))
-	return id, err
 }
 
-func handleACPRequest(req types.ACPRequest) {
-	if req.Method == "" {
-		if req.Error != nil {
-			fmt.Fprintf(os.Stderr, "[ACP ERROR] id=%v code=%d message=%s\n", req.ID, req.Error.Code, req.Error.Message)
-			return
-		}
-		if len(req.Result) > 0 {
-			var permissionResp struct {
-				Outcome struct {
-					Outcome  string `json:"outcome"`
-					OptionId string `json:"optionId"`
-				} `json:"outcome"`
-			}
-			if err := json.Unmarshal(req.Result, &permissionResp); err != nil {
-				fmt.Fprintf(os.Stderr, "[ERROR] Failed to parse ACP result: %v\n", err)
-				return
+func (a *droidAgent) Prompt(ctx context.Context, params types.PromptParams) (types.PromptResult, error) {
+	if err := a.checkSession(params.SessionId); err != nil {
+		return types.PromptResult{}, err
+	}
+	var message types.AddUserMessageParams
+	for _, block := range params.Prompt {
+		a.acpLog.Debug("prompt block", "session", params.SessionId, "type", block.Type)
+		switch block.Type {
+		case "text":
+			message.Text = block.Text
+		case "resource":
+			fileName, err := utils.GetFilenameFromUri(block.ClientResources.Uri)
+			if err != nil {
+				a.acpLog.Warn("failed to get filename", "uri", block.ClientResources.Uri, "err", err)
 			}
-			if permissionResp.Outcome.OptionId != "" {
-				reqID := fmt.Sprint(req.ID)
-				permissionRequestMu.Lock()
-				request, ok := permissionRequestMap[reqID]
-				if ok {
-					delete(permissionRequestMap, reqID)
-				}
-				permissionRequestMu.Unlock()
-				if !ok {
-					fmt.Fprintf(os.Stderr, "[WARN] Missing permission request state for ACP id=%s\n", reqID)
-					return
-				}
-
-				responseID := request.DroidRequestID
-				if responseID == "" {
-					responseID = request.ToolCallID
-				}
-				if responseID == "" {
-					fmt.Fprintf(os.Stderr, "[WARN] Missing droid request id for permission response (acp id=%s)\n", reqID)
-					return
-				}
-
-				allowed := permissionResp.Outcome.OptionId == "proceed_once" || permissionResp.Outcome.OptionId == "proceed_always"
-				if allowed && request.WritePath != "" {
-					update := types.FSWriteTextFileParam{
-						SessionId: currentSession,
-						Path:      request.WritePath,
-						Content:   request.WriteContent,
-					}
-
-					if _, err := sendACPRequest("fs/write_text_file", update); err != nil {
-						fmt.Fprintf(os.Stderr, "[ERROR] Failed to send fs/write_text_file request: %v\n", err)
-					}
-				}
-
-				result := map[string]any{
-					"selectedOption": permissionResp.Outcome.OptionId,
-				}
-				if err := sendDroidResponseWithID(responseID, result); err != nil {
-					fmt.Fprintf(os.Stderr, "[ERROR] Failed to send permission result to droid: %v\n", err)
-				}
-				return
+			message.Text = block.ClientResources.Text
+			message.Attachments = []types.Attachment{
+				{
+					Name:     fileName,
+					MimeType: block.ClientResources.MimeType,
+					Path:     block.ClientResources.Uri,
+				},
 			}
 		}
-		return
 	}
 
-	switch req.Method {
-	case "initialize":
-		result := types.InitializeResult{
-			ProtocolVersion: 1,
-			AgentCapabilities: types.AgentCapabilities{
-				LoadSession: false,
-				PromptCapabilities: types.PromptCapabilities{
-					Image:           false,
-					Audio:           false,
-					EmbeddedContext: true,
-				},
-				MCP: types.McpInfo{
-					Http: false,
-					Sse:  false,
-				},
-			},
-			AgentInfo: types.AgentInfo{
-				Name:    "droid-acp",
-				Title:   "Droid ACP",
-				Version: version,
-			},
+	userText := message.Text
+	title := promptTitle(message.Text)
+	if text, ok, err := a.expandCommand(ctx, message.Text); ok {
+		if err != nil {
+			return types.PromptResult{}, err
 		}
-		sendACPResponse(req.ID, result)
-
-	case "session/new":
-		var params types.NewSessionParams
-		if err := json.Unmarshal(req.Params, &params); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse session/new params: %v\n", err)
-			return
+		if text == "" {
+			return types.PromptResult{StopReason: "end_turn"}, nil
 		}
+		message.Text = text
+	}
 
-		pendingSessionMu.Lock()
-		if pendingSessionID != nil {
-			fmt.Fprintf(os.Stderr, "[WARN] Overwriting pending session/new ID\n")
-		}
-		pendingSessionID = req.ID
-		pendingSessionMu.Unlock()
+	a.setSessionTitle(title, false)
+	a.updateSessionMeta(func(*sessions.Meta) {})
+	a.recordEvent(sessions.Event{Type: "prompt", Text: userText})
 
-		cwd := params.Cwd
-		if cwd == "" {
-			cwd = "."
-		}
-		lastSessionCwd = cwd
+	done, steered, cancelled, err := a.acquireTurn(ctx, params.SessionId)
+	if err != nil {
+		return types.PromptResult{}, err
+	}
+	if cancelled {
+		return types.PromptResult{StopReason: "cancelled"}, nil
+	}
 
-		if err := initializeDroidSession(cwd); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to initialize droid session: %v\n", err)
+	a.mu.Lock()
+	if !steered {
+		a.turnPrompt = userText
+	}
+	message.Text = a.forkSeed + message.Text
+	a.forkSeed = ""
+	a.mu.Unlock()
+
+	if !steered {
+		if stopReason, why := a.startTurnLimits(); stopReason != "" {
+			a.clearPrompt(done)
+			a.agentMessage(why + " Raise the limit in the droid-acp configuration to continue.")
+			return types.PromptResult{StopReason: stopReason}, nil
 		}
-
-	case "session/prompt":
-		var params types.PromptParams
-		if err := json.Unmarshal(req.Params, &params); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse session/prompt params: %v\n", err)
-			return
+		if warning := a.unpricedCostWarning(); warning != "" {
+			a.agentMessage(warning + "\n\n")
 		}
+		a.startGitTurn()
+	}
 
-		pendingPromptMu.Lock()
-		if pendingPromptID != nil {
-			fmt.Fprintf(os.Stderr, "[WARN] Overwriting pending prompt ID\n")
-		}
-		pendingPromptID = req.ID
-		pendingPromptMu.Unlock()
+	// Droid may not answer add_user_message before the turn is over, so the
+	// turn's end is signalled by the idle state rather than the response.
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- a.droid.AddUserMessage(ctx, message)
+	}()
 
-		data := make(map[string]any)
-		for _, block := range params.Prompt {
-			fmt.Fprintf(os.Stderr, "BLOCK TYPE: %s", block.Type)
-			switch block.Type {
-			case "text":
-				data["text"] = block.Text
-			case "resource":
-				fileName, err := utils.GetFilenameFromUri(block.ClientResources.Uri)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to get filename : %v\n", err)
-				}
-				data["text"] = block.ClientResources.Text
-				data["attachments"] = []map[string]any{
-					{
-						"name":     fileName,
-						"mimeType": block.ClientResources.MimeType,
-						"path":     block.ClientResources.Uri,
-					},
+	for {
+		select {
+		case outcome := <-done:
+			return outcome.result, outcome.err
+		case err := <-sendErr:
+			if err != nil {
+				a.droidLog.Error("failed to send message to droid", "session", params.SessionId, "err", err)
+				a.clearPrompt(done)
+				if errors.Is(err, droid.ErrClosed) {
+					return types.PromptResult{}, a.droidGone()
 				}
+				return types.PromptResult{}, err
 			}
+			sendErr = nil
+		case <-a.droid.Done():
+			a.droidLog.Error("droid exited during a turn", "session", params.SessionId, "err", a.droid.Err())
+			a.clearPrompt(done)
+			return types.PromptResult{}, a.droidGone()
+		case <-ctx.Done():
+			a.clearPrompt(done)
+			return types.PromptResult{}, ctx.Err()
 		}
+	}
+}
 
-		if err := sendDroidUserMessage(data); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to send message to droid: %v\n", err)
-		}
-	case "session/set_model":
-		var params types.SetModelParams
-		if err := json.Unmarshal(req.Params, &params); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse session/set_model params: %v\n", err)
-			sendACPResponse(req.ID, map[string]any{})
-			return
-		}
-
-		sessionID := strings.TrimSpace(params.SessionId)
-		if sessionID == "" {
-			sessionID = currentSession
-		}
-
-		modelId = strings.TrimSpace(string(params.ModelID))
-		if modelId == "" {
-			fmt.Fprintf(os.Stderr, "[WARN] Missing modelId in session/set_model params\n")
-		}
+// promptOutcome ends a pending session/prompt with a result or an error.
+type promptOutcome struct {
+	result types.PromptResult
+	err    error
+}
 
-		updateParams := map[string]any{
-			"sessionId": sessionID,
-			"modelId":   modelId,
-		}
+// droidGone is the error for a request that Droid can no longer serve
+// because it exited.
+func (a *droidAgent) droidGone() error {
+	msg := "Droid exited unexpectedly"
+	if err := a.droid.Err(); err != nil && !errors.Is(err, io.EOF) {
+		msg += ": " + err.Error()
+	}
+	if tail := a.droid.StderrTail(); tail != "" {
+		msg += "\n" + tail
+	}
+	return &types.Error{
+		Code:    acp.CodeInternalError,
+		Message: msg + "\nRestart the agent to continue.",
+	}
+}
 
-		var sendErr error
-		for attempt := 1; attempt <= modelUpdateMaxAttempts; attempt++ {
-			if _, sendErr = sendDroidRequest("droid.update_session_settings", updateParams); sendErr == nil {
+// clearPrompt withdraws done from the running turn. If it was the prompt
+// the turn reports to, a steered prompt takes its place or the turn's
+// limits are closed and Droid moves on to the next queued prompt.
+func (a *droidAgent) clearPrompt(done chan promptOutcome) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pendingPrompt != done {
+		for i, ch := range a.steered {
+			if ch == done {
+				a.steered = append(a.steered[:i:i], a.steered[i+1:]...)
 				break
 			}
-			fmt.Fprintf(os.Stderr, "Failed to send model update to droid (attempt %d/%d): %v\n", attempt, modelUpdateMaxAttempts, sendErr)
-			if attempt < modelUpdateMaxAttempts {
-				time.Sleep(modelUpdateRetryDelay)
-			}
-		}
-		if sendErr != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Failed to send model update to droid after %d attempts: %v\n", modelUpdateMaxAttempts, sendErr)
 		}
+		return
+	}
+	if len(a.steered) > 0 {
+		a.pendingPrompt = a.steered[0]
+		a.steered = a.steered[1:]
+		return
+	}
+	// The duration timer must not outlive the turn and stop a later one.
+	a.endTurnLimits()
+	a.nextTurn()
+}
 
-	case "session/set_mode":
-		var params types.SetModeParams
-		if err := json.Unmarshal(req.Params, &params); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse session/set_model params: %v\n", err)
-			sendACPResponse(req.ID, map[string]any{})
-			return
-		}
+func (a *droidAgent) Cancel(ctx context.Context, params types.CancelParams) error {
+	if a.checkSession(params.SessionId) != nil {
+		// Nothing runs in a replaced session.
+		return nil
+	}
+	a.mu.Lock()
+	a.cancelQueued()
+	if a.pendingPrompt == nil {
+		a.mu.Unlock()
+		return nil
+	}
+	a.cancelled = true
+	droidSession := a.droidSession
+	a.mu.Unlock()
 
-		sessionID := strings.TrimSpace(params.SessionId)
-		if sessionID == "" {
-			sessionID = currentSession
+	go func() {
+		if err := a.droid.Interrupt(context.Background(), droidSession); err != nil {
+			a.droidLog.Error("failed to interrupt droid", "session", params.SessionId, "err", err)
 		}
+	}()
+	return nil
+}
 
-		autonomyLevel := strings.TrimSpace(string(params.ModeId))
-		if autonomyLevel == "" {
-			fmt.Fprintf(os.Stderr, "[WARN] Missing modelId in session/set_model params\n")
-		}
+func (a *droidAgent) SetSessionModel(ctx context.Context, params types.SetModelParams) error {
+	if err := a.checkSession(params.SessionId); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.modelId = strings.TrimSpace(string(params.ModelID))
+	modelId := a.modelId
+	droidSession := a.droidSession
+	a.mu.Unlock()
+	if modelId == "" {
+		a.acpLog.Warn("missing modelId in session/set_model params", "session", params.SessionId)
+	}
+
+	updateParams := types.UpdateSessionSettingsParams{
+		SessionId: droidSession,
+		ModelId:   modelId,
+	}
 
-		updateParams := map[string]any{
-			"sessionId":     sessionID,
-			"autonomyLevel": autonomyLevel,
+	var sendErr error
+	for attempt := 1; attempt <= modelUpdateMaxAttempts; attempt++ {
+		if sendErr = a.droid.UpdateSessionSettings(ctx, updateParams); sendErr == nil {
+			break
 		}
+		a.droidLog.Warn("failed to send model update to droid", "session", params.SessionId, "attempt", attempt, "maxAttempts", modelUpdateMaxAttempts, "err", sendErr)
+		if attempt < modelUpdateMaxAttempts {
+			time.Sleep(modelUpdateRetryDelay)
+		}
+	}
+	if sendErr != nil {
+		a.droidLog.Error("giving up on model update", "session", params.SessionId, "attempts", modelUpdateMaxAttempts, "err", sendErr)
+		return sendErr
+	}
+	a.updateSessionMeta(func(m *sessions.Meta) { m.Model = modelId })
+	return nil
+}
 
-		sendDroidRequest("droid.update_session_settings", updateParams)
+func (a *droidAgent) SetSessionMode(ctx context.Context, params types.SetModeParams) error {
+	if err := a.checkSession(params.SessionId); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	droidSession := a.droidSession
+	modes := a.modes
+	a.mu.Unlock()
+
+	mode := strings.TrimSpace(string(params.ModeId))
+	if !hasMode(modes, mode) {
+		a.acpLog.Warn("unknown mode in session/set_mode params", "session", params.SessionId, "mode", mode)
+		return acp.ErrInvalidParams(fmt.Errorf("unknown mode %q", mode))
+	}
 
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown ACP method: %s\n", req.Method)
-		sendACPResponse(req.ID, map[string]any{})
+	if err := a.droid.UpdateSessionSettings(ctx, modeSettings(droidSession, mode)); err != nil {
+		return err
 	}
+	a.mu.Lock()
+	a.modeId = mode
+	a.mu.Unlock()
+	return nil
 }
 
-func handleDroidMessage(msg types.DroidMessage) {
-	if msg.Method == "" {
-		if msg.Type == "response" {
-			pendingSessionMu.Lock()
-			hasPendingSession := pendingSessionID != nil
-			pendingSessionMu.Unlock()
-			if !hasPendingSession {
-				return
-			}
+func (a *droidAgent) sessionUpdate(update types.Update) {
+	a.mu.Lock()
+	sessionID := a.currentSession
+	a.mu.Unlock()
+	if transcriptUpdates[update.SessionUpdate] {
+		a.recordEvent(sessions.Event{Type: "update", Update: &update})
+	}
 
-			var result types.ResultModel
-			if err := json.Unmarshal(msg.Result, &result); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to parse response from droid: %v\n", err)
-				return
-			}
+	param := types.SessionUpdateParam{
+		SessionId: sessionID,
+		Update:    update,
+	}
+	if err := a.conn.SessionUpdate(param); err != nil {
+		a.acpLog.Error("failed to send session/update notification", "session", sessionID, "err", err)
+	}
+}
 
-			var models []types.ModelInfo
+// HandleNotification implements droid.Handler.
+func (a *droidAgent) HandleNotification(params types.DroidNotification) {
+	parent := params.Notification.ParentToolUseID
+	if reason := params.Notification.StopReason; reason != "" && parent == "" {
+		a.mu.Lock()
+		a.modelStop = reason
+		a.mu.Unlock()
+	}
+	// Tool input deltas are recognised by their fields: they stream the
+	// JSON input of a tool use while the model writes it.
+	if n := params.Notification; n.InputDelta != "" || (n.Type != "tool_result" && n.ToolUseID != "" && n.ToolUseName != "") {
+		a.streamToolInput(n)
+		return
+	}
+	// A sub-agent's messages go to the tool call that started it, and its
+	// own turns do not end the main agent's turn.
+	if parent != "" {
+		switch params.Notification.Type {
+		case "assistant_text_delta":
+			a.subagentText(parent, params.Notification.TextDelta)
+			return
+		case "create_message", "tool_result":
+			a.startSubagent(parent)
+		default:
+			return
+		}
+	}
 
-			currentModelId := types.ModelId(result.Settings.ModelID)
-			currentAnatomyLevel := result.Settings.AutonomyLevel
+	switch params.Notification.Type {
+	case "assistant_text_delta":
+		a.sessionUpdate(types.Update{
+			SessionUpdate: "agent_message_chunk",
+			Content: &types.Content{
+				Type: "text",
+				Text: params.Notification.TextDelta,
+			},
+		})
+
+	case "thinking_text_delta":
+		a.sessionUpdate(types.Update{
+			SessionUpdate: "agent_thought_chunk",
+			Content: &types.Content{
+				Type: "text",
+				Text: params.Notification.TextDelta,
+			},
+		})
 
-			for _, model := range result.AvailableModels {
-				if modelFilter == "custom" && !model.IsCustom {
-					continue
-				}
-				if modelFilter == "common" && model.IsCustom {
-					continue
-				}
-				models = append(models, types.ModelInfo{
-					ModelId:     types.ModelId(model.ID),
-					Name:        model.DisplayName,
-					Description: model.DisplayName,
-				})
+	case "create_message":
+		for _, content := range params.Notification.Message.Content {
+			if content.Input != nil {
+				a.countToolUse(content.Id)
+				a.trackToolInput(content.Id, "", a.editedPaths(content))
 			}
+			a.flushToolInput(content.Id)
+		}
 
-			var listModel = types.Models{
-				AvailableModels: models,
-				CurrentModelId:  currentModelId,
-			}
+		var input string
 
-			var availableModes []types.AvailableMode = []types.AvailableMode{}
-			availableModes = append(availableModes, types.AvailableMode{
-				Id:          "normal",
-				Name:        "Normal",
-				Description: "Safe for reviewing what changes would be made",
-			})
-			availableModes = append(availableModes, types.AvailableMode{
-				Id:          "auto-low",
-				Name:        "Auto Low",
-				Description: "Documentation updates, code formatting, adding comments",
-			})
-			availableModes = append(availableModes, types.AvailableMode{
-				Id:          "auto-medium",
-				Name:        "Auto Medium",
-				Description: "Local development, testing, dependency management",
-			})
-			availableModes = append(availableModes, types.AvailableMode{
-				Id:          "auto-high",
-				Name:        "Auto High",
-				Description: "CI/CD pipelines, automated deployments",
-			})
-			listMode := types.Modes{
-				CurrentModeId:  currentAnatomyLevel,
-				AvailableModes: availableModes,
-			}
+		if len(params.Notification.Message.Content) > 0 && params.Notification.Message.Content[0].Input != nil {
+			input = params.Notification.Message.Content[0].Input.Input
+		}
 
-			currentSession = uuid.New().String()
-			payloadListModel := types.NewSessionResult{
-				SessionId: currentSession,
-				Models:    listModel,
-				Modes:     listMode,
-			}
-			pendingSessionMu.Lock()
-			acpID := pendingSessionID
-			pendingSessionID = nil
-			pendingSessionMu.Unlock()
-			if acpID == nil {
-				fmt.Fprintf(os.Stderr, "[WARN] Missing pending session/new ID; cannot respond\n")
-				return
-			}
-			sendACPResponse(acpID, payloadListModel)
+		a.droidLog.Debug("create_message", logging.Payload([]byte(input)))
 
-		}
-	} else {
-		switch msg.Method {
-		case "droid.initialize_session":
-			sendDroidOK(msg.ID)
+		patch, _ := utils.GetPatchResult(input)
 
-		case "droid.update_session_settings":
-			sendDroidOK(msg.ID)
+		if len(patch.URI) > 0 {
 
-		case "droid.session_notification":
-			var params types.DroidNotification
-			if err := json.Unmarshal(msg.Params, &params); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to parse droid.session_notification: %v\n", err)
-				return
+			content := types.Content{
+				Type:    "diff",
+				Path:    patch.URI,
+				OldText: patch.Before,
+				NewText: patch.After,
 			}
 
-			switch params.Notification.Type {
-			case "assistant_text_delta":
-				content := &types.Content{
-					Type: "text",
-					Text: params.Notification.TextDelta,
-				}
-				update := types.SessionUpdateParam{
-					SessionId: currentSession,
-					Update: types.Update{
-						SessionUpdate: "agent_message_chunk",
-						Content:       content,
-					},
-				}
+			var locations []types.ToolCallLocation
 
-				if err := sendACPNotification("session/update", update); err != nil {
-					fmt.Fprintf(os.Stderr, "[ERROR] Failed to send session/update notification: %v\n", err)
-				}
+			locations = []types.ToolCallLocation{{Path: patch.URI}}
+
+			a.sessionUpdate(types.Update{
+				SessionUpdate: a.toolCallUpdateType(params.Notification.Message.Content[0].Id),
+				ToolCallId:    params.Notification.Message.Content[0].Id,
+				Kind:          "edit",
+				Status:        "pending",
+				Title:         patch.URI,
+				Content:       &content,
+				Locations:     locations,
+				Meta:          parentMeta(parent),
+			})
+		}
 
-			case "thinking_text_delta":
-				content := &types.Content{
-					Type: "text",
-					Text: params.Notification.TextDelta,
+	case "droid_working_state_changed":
+		a.showWorkingState(params.Notification.NewState)
+		switch params.Notification.NewState {
+		case "idle":
+			a.mu.Lock()
+			done := a.pendingPrompt
+			steered := a.steered
+			stopReason := "end_turn"
+			switch a.modelStop {
+			case "refusal":
+				stopReason = "refusal"
+			case "max_tokens", "model_context_window_exceeded":
+				stopReason = "max_tokens"
+			}
+			if limitStop := a.endTurnLimits(); limitStop != "" {
+				stopReason = limitStop
+			}
+			cancelled := a.cancelled
+			if cancelled {
+				stopReason = "cancelled"
+			}
+			turnErr := a.turnErr
+			a.pendingPrompt = nil
+			a.steered = nil
+			a.cancelled = false
+			a.modelStop = ""
+			a.turnErr = nil
+			a.mu.Unlock()
+			if done != nil {
+				result := types.PromptResult{
+					StopReason: stopReason,
 				}
-				update := types.SessionUpdateParam{
-					SessionId: currentSession,
-					Update: types.Update{
-						SessionUpdate: "agent_thought_chunk",
-						Content:       content,
-					},
+				a.sendTurnSummary()
+				a.finishGitTurn()
+				a.finishTurn(&result)
+				a.updateSessionMeta(func(m *sessions.Meta) {
+					m.Tokens = a.sessionTokens
+					m.Model = a.modelId
+				})
+				// A failed turn is an error unless the user cancelled it.
+				// Steered prompts end with the turn they joined; its usage
+				// is reported once, on the prompt that started it.
+				outcome := promptOutcome{result: result}
+				if turnErr != nil && !cancelled {
+					outcome = promptOutcome{err: turnErr}
 				}
-
-				if err := sendACPNotification("session/update", update); err != nil {
-					fmt.Fprintf(os.Stderr, "[ERROR] Failed to send session/update notification: %v\n", err)
+				done <- outcome
+				for _, ch := range steered {
+					ch <- promptOutcome{result: types.PromptResult{StopReason: stopReason}, err: outcome.err}
 				}
 
-			case "create_message":
+				a.mu.Lock()
+				a.nextTurn()
+				a.mu.Unlock()
+			}
+		}
 
-				var input string
+	case "session_title_updated":
+		if params.Notification.Title == "" {
+			a.notificationMisread(params.Notification.Type, "no title")
+		}
+		a.setSessionTitle(params.Notification.Title, true)
+
+	case "tool_result":
+		n := params.Notification
+		if !a.finishSubagent(n.ToolUseID, n.Content, n.IsError) {
+			text := toolResultText(n.Content)
+			a.trackToolResult(n.ToolUseID, text, n.IsError)
+			a.recordEvent(sessions.Event{Type: "result", Result: &sessions.ResultEvent{
+				ToolCallID: n.ToolUseID,
+				Text:       text,
+				IsError:    n.IsError,
+			}})
+		}
 
-				if len(params.Notification.Message.Content) > 0 && params.Notification.Message.Content[0].Input != nil {
-					input = params.Notification.Message.Content[0].Input.Input
-				}
+	case "error":
+		msg := "Droid reported an error"
+		if params.Notification.Error != nil && params.Notification.Error.Message != "" {
+			msg = params.Notification.Error.Message
+		} else {
+			a.notificationMisread(params.Notification.Type, "no error.message")
+		}
+		a.droidLog.Error("droid turn failed", "err", msg)
+		a.mu.Lock()
+		a.turnErr = &types.Error{Code: acp.CodeInternalError, Message: msg}
+		a.mu.Unlock()
+
+	case "token_usage_updated":
+		if params.Notification.TokenUsage == nil {
+			a.notificationMisread(params.Notification.Type, "no tokenUsage")
+			break
+		}
+		a.mu.Lock()
+		a.sessionTokens = tokensFromDroid(params.Notification.TokenUsage)
+		a.mu.Unlock()
+		a.enforceLimits()
 
-				fmt.Fprintf(os.Stderr, "CREATE_MESSAGE: %v\n", input)
+	case "mcp_status_changed":
 
-				patch, _ := utils.GetPatchResult(input)
+	case "settings_updated":
+		a.mu.Lock()
+		cwd := strings.TrimSpace(a.lastSessionCwd)
+		a.mu.Unlock()
+		if cwd == "" {
+			cwd = "."
+		}
 
-				if len(patch.URI) > 0 {
+		go func() {
+			result, err := a.droid.InitializeSession(context.Background(), cwd)
+			if err != nil {
+				a.droidLog.Error("failed to initialize droid session after settings update", "cwd", cwd, "err", err)
+				return
+			}
+			a.mu.Lock()
+			a.droidSession = result.SessionID
+			a.mu.Unlock()
+		}()
 
-					content := types.Content{
-						Type:    "diff",
-						Path:    patch.URI,
-						OldText: patch.Before,
-						NewText: patch.After,
-					}
+	default:
+		a.notificationMisread(params.Notification.Type, "unknown type")
+	}
+}
 
-					var locations []types.ToolCallLocation
+// notificationMisread warns, once per problem, that a Droid notification
+// did not have the shape the bridge expects. Usage, limits, titles and
+// errors depend on these names, so a Droid that renames them must not go
+// unnoticed.
+func (a *droidAgent) notificationMisread(notificationType, problem string) {
+	key := notificationType + ": " + problem
+	a.mu.Lock()
+	if a.misread == nil {
+		a.misread = make(map[string]bool)
+	}
+	seen := a.misread[key]
+	a.misread[key] = true
+	a.mu.Unlock()
+	if !seen {
+		a.droidLog.Warn("droid notification not understood", "type", notificationType, "problem", problem)
+	}
+}
 
-					locations = []types.ToolCallLocation{{Path: patch.URI}}
+// RequestPermission implements droid.Handler by forwarding the prompt to the
+// client, one tool use at a time, and relaying the user's decision.
+func (a *droidAgent) RequestPermission(ctx context.Context, params types.DroidNotification) (string, error) {
+	a.mu.Lock()
+	sessionID := a.currentSession
+	policies := a.cfg.Permissions
+	a.mu.Unlock()
+
+	var options []types.PermissionOption = []types.PermissionOption{}
+	var kind, label string
+	for _, option := range params.Options {
+		switch option.Value {
+		case "proceed_once":
+			kind = "allow_once"
+			label = option.Label
+		case "proceed_always":
+			kind = "allow_always"
+			label = "Yes, always"
+		case "cancel":
+			kind = "reject_once"
+			label = option.Label
+		default:
+			// Plan approvals offer several ways to proceed, e.g.
+			// proceed_auto_run_low.
+			kind = "reject_once"
+			if strings.HasPrefix(option.Value, "proceed") {
+				kind = "allow_once"
+			}
+			label = option.Label
+		}
+		options = append(options, types.PermissionOption{
+			OptionId: option.Value,
+			Kind:     kind,
+			Name:     label,
+		})
+	}
 
-					update := types.SessionUpdateParam{
-						SessionId: currentSession,
-						Update: types.Update{
-							SessionUpdate: "tool_call",
-							ToolCallId:    params.Notification.Message.Content[0].Id,
-							Kind:          "edit",
-							Status:        "pending",
-							Title:         patch.URI,
-							Content:       &content,
-							Locations:     locations,
-						},
-					}
+	var selected string
+	for _, toolUses := range params.ToolUses {
+		a.countToolUse(toolUses.ToolUse.ID)
 
-					if err := sendACPNotification("session/update", update); err != nil {
-						fmt.Fprintf(os.Stderr, "[ERROR] Failed to send session/update notification: %v\n", err)
-					}
-				}
+		details := toolUses.Details
+		if details == nil {
+			details = &types.ToolUseDetail{}
+		}
 
-			case "droid_working_state_changed":
-				switch params.Notification.NewState {
-				case "idle":
-					if pendingPromptID != nil {
-						result := types.PromptResult{
-							StopReason: "end_turn",
-						}
-						pendingPromptMu.Lock()
-						promptID := pendingPromptID
-						pendingPromptID = nil
-						pendingPromptMu.Unlock()
-						if promptID == nil {
-							fmt.Fprintf(os.Stderr, "[WARN] Missing pending prompt ID; cannot respond\n")
-							break
-						}
-						sendACPResponse(promptID, result)
-					}
-				case "compacting_conversation":
-					sendDroidOK(msg.ID)
-				}
+		if toolUses.ConfirmationType == "exit_spec_mode" {
+			option, err := a.reviewPlan(ctx, sessionID, toolUses.ToolUse.ID, details, options)
+			if err != nil || specExitMode(option) == "" {
+				return option, err
+			}
+			selected = option
+			continue
+		}
 
-			case "mcp_status_changed":
-				sendDroidOK(msg.ID)
+		var title string
+		if len(details.FullCommand) > 0 {
+			title = details.FullCommand
+		} else if toolUses.ConfirmationType == "create" {
+			title = "create " + details.FilePath + "?"
+		} else {
+			title = "update"
+		}
 
-			case "settings_updated":
-				sendDroidOK(msg.ID)
-				cwd := strings.TrimSpace(lastSessionCwd)
-				if cwd == "" {
-					cwd = "."
-				}
+		policy := policies.Edits
+		if len(details.FullCommand) > 0 {
+			policy = policies.Commands
+		}
 
-				if err := initializeDroidSession(cwd); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to initialize droid session after settings update: %v\n", err)
+		var request types.RequestPermissionParam
+		var filePath, oldText, newText string
+		var writePath, writeContent string
+		if len(details.FullCommand) == 0 {
+			var contents []types.DiffContent = []types.DiffContent{}
+
+			inputRaw := toolUses.ToolUse.Input
+			switch toolUses.ConfirmationType {
+			case "create":
+				filePath = details.FilePath
+				newText = details.Content
+				writePath = filePath
+				writeContent = newText
+			case "apply_patch":
+				var input types.InputApplyPatch
+				if err := json.Unmarshal(inputRaw, &input); err != nil {
+					return "", fmt.Errorf("parse apply_patch input: %w", err)
 				}
+				patch, _ := utils.GetPatchResult(input.Input)
+				filePath = patch.URI
+				oldText = patch.Before
+				newText = patch.After
+
+				writePath = filePath
+				writeContent = details.NewContent
+			case "edit":
+				var input types.InputEdit
+				if err := json.Unmarshal(inputRaw, &input); err != nil {
+					return "", fmt.Errorf("parse edit input: %w", err)
+				}
+				filePath = input.FilePath
+				oldText = input.OldStr
+				newText = input.NewString
 
-			default:
-				fmt.Fprintf(os.Stderr, "Unknown droid Notification.Type: %s\n", params.Notification.Type)
-				sendDroidOK(msg.ID)
+				writePath = filePath
+				writeContent = details.NewContent
 			}
-
-		case "droid.add_user_message":
-			sendDroidOK(msg.ID)
-
-		case "droid.request_permission":
-			var params types.DroidNotification
-			if err := json.Unmarshal(msg.Params, &params); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to parse droid.session_notification: %v\n", err)
-				return
+			contents = append(contents, types.DiffContent{
+				Type:    "diff",
+				Path:    filePath,
+				OldText: oldText,
+				NewText: newText,
+			})
+			var locations []types.ToolCallLocation
+
+			locations = []types.ToolCallLocation{{Path: filePath}}
+
+			request = types.RequestPermissionParam{
+				SessionId: sessionID,
+				ToolCall: types.ToolCall{
+					ToolCallId: toolUses.ToolUse.ID,
+					Title:      filePath,
+					Kind:       "edit",
+					Status:     "pending",
+					Content:    contents,
+					Locations:  locations,
+				},
+				Options: options,
 			}
-			fmt.Fprintf(os.Stderr, "[DROID REQUEST PERMISSION] %v\n", string(msg.Params))
-
-			toolUsesParent := params.ToolUses
-			var options []types.PermissionOption = []types.PermissionOption{}
-			var kind, label string
-			for _, option := range params.Options {
-				switch option.Value {
-				case "proceed_once":
-					kind = "allow_once"
-					label = option.Label
-				case "proceed_always":
-					kind = "allow_always"
-					label = "Yes, always"
-				case "cancel":
-					kind = "reject_once"
-					label = option.Label
-				}
-				options = append(options, types.PermissionOption{
-					OptionId: option.Value,
-					Kind:     kind,
-					Name:     label,
+
+			if policy != config.PolicyAsk {
+				a.sessionUpdate(types.Update{
+					SessionUpdate: a.toolCallUpdateType(toolUses.ToolUse.ID),
+					ToolCallId:    toolUses.ToolUse.ID,
+					Kind:          "edit",
+					Status:        "pending",
+					Title:         filePath,
+					Content:       &types.Content{Type: "diff", Path: filePath, OldText: oldText, NewText: newText},
+					Locations:     locations,
 				})
 			}
 
-			for _, toolUses := range toolUsesParent {
-				var title string
-				if len(toolUses.Details.FullCommand) > 0 {
-					title = toolUses.Details.FullCommand
-				} else if toolUses.ConfirmationType == "create" {
-					title = "create " + toolUses.Details.FilePath + "?"
-				} else if toolUses.ConfirmationType == "exit_spec_mode" {
-					title = toolUses.Details.Title
-				} else {
-					title = "update"
-				}
-
-				var request types.RequestPermissionParam
-				var filePath, oldText, newText string
-				var writePath, writeContent string
-				if len(toolUses.Details.FullCommand) == 0 {
-					var contents []types.DiffContent = []types.DiffContent{}
-
-					inputRaw := toolUses.ToolUse.Input
-					switch toolUses.ConfirmationType {
-					case "create":
-						filePath = toolUses.Details.FilePath
-						newText = toolUses.Details.Content
-						writePath = filePath
-						if toolUses.Details != nil {
-							writeContent = newText
-						}
-					case "apply_patch":
-						var input types.InputApplyPatch
-						if err := json.Unmarshal(inputRaw, &input); err != nil {
-							fmt.Fprintf(os.Stderr, "Failed to parse droid.session_notification: %v\n", err)
-							return
-						}
-						patch, _ := utils.GetPatchResult(input.Input)
-						filePath = patch.URI
-						oldText = patch.Before
-						newText = patch.After
-
-						writePath = filePath
-						if toolUses.Details != nil {
-							writeContent = toolUses.Details.NewContent
-						}
-					case "edit":
-						var input types.InputEdit
-						if err := json.Unmarshal(inputRaw, &input); err != nil {
-							fmt.Fprintf(os.Stderr, "Failed to parse droid.session_notification: %v\n", err)
-							return
-						}
-						filePath = input.FilePath
-						oldText = input.OldStr
-						newText = input.NewString
-
-						writePath = filePath
-						if toolUses.Details != nil {
-							writeContent = toolUses.Details.NewContent
-						}
-					}
-					contents = append(contents, types.DiffContent{
-						Type:    "diff",
-						Path:    filePath,
-						OldText: oldText,
-						NewText: newText,
-					})
-					var locations []types.ToolCallLocation
-
-					locations = []types.ToolCallLocation{{Path: filePath}}
-
-					request = types.RequestPermissionParam{
-						SessionId: currentSession,
-						ToolCall: types.ToolCall{
-							ToolCallId: toolUses.ToolUse.ID,
-							Title:      filePath,
-							Kind:       "edit",
-							Status:     "pending",
-							Content:    contents,
-							Locations:  locations,
-						},
-						Options: options,
-					}
-
-				} else {
-					update := types.SessionUpdateParam{
-						SessionId: currentSession,
-						Update: types.Update{
-							SessionUpdate: "tool_call",
-							ToolCallId:    toolUses.ToolUse.ID,
-							Status:        "in_progress",
-							Title:         title,
-						},
-					}
-
-					if err := sendACPNotification("session/update", update); err != nil {
-						fmt.Fprintf(os.Stderr, "[ERROR] Failed to send session/update notification: %v\n", err)
-					}
-
-					request = types.RequestPermissionParam{
-						SessionId: currentSession,
-						ToolCall: types.ToolCall{
-							ToolCallId: toolUses.ToolUse.ID,
-							Title:      title,
-						},
-						Options: options,
-					}
-				}
+		} else {
+			a.sessionUpdate(types.Update{
+				SessionUpdate: a.toolCallUpdateType(toolUses.ToolUse.ID),
+				ToolCallId:    toolUses.ToolUse.ID,
+				Status:        "in_progress",
+				Title:         title,
+			})
 
-				if reqID, err := sendACPRequest("session/request_permission", request); err == nil {
-					permissionRequestMu.Lock()
-					permissionRequestMap[reqID] = permissionRequest{
-						DroidRequestID: msg.ID,
-						ToolCallID:     toolUses.ToolUse.ID,
-						WritePath:      writePath,
-						WriteContent:   writeContent,
-					}
-					permissionRequestMu.Unlock()
-				} else {
-					fmt.Fprintf(os.Stderr, "[ERROR] Failed to send session/request_permission request: %v\n", err)
-				}
+			request = types.RequestPermissionParam{
+				SessionId: sessionID,
+				ToolCall: types.ToolCall{
+					ToolCallId: toolUses.ToolUse.ID,
+					Title:      title,
+				},
+				Options: options,
 			}
+		}
+
+		switch policy {
+		case config.PolicyAllow:
+			a.permLog.Info("allowed by policy", "session", sessionID, "toolUse", toolUses.ToolUse.ID, "title", title)
+			selected = "proceed_once"
+			a.recordPermission(request.ToolCall, selected, policy)
+		case config.PolicyDeny:
+			a.permLog.Info("denied by policy", "session", sessionID, "toolUse", toolUses.ToolUse.ID, "title", title)
+			a.recordPermission(request.ToolCall, "cancel", policy)
+			a.sessionUpdate(types.Update{
+				SessionUpdate: "tool_call_update",
+				ToolCallId:    toolUses.ToolUse.ID,
+				Status:        "failed",
+			})
+			return "cancel", nil
 		default:
-			fmt.Fprintf(os.Stderr, "Unknown droid method: %s\n", msg.Method)
-			sendDroidOK(msg.ID)
+			outcome, err := a.conn.RequestPermission(ctx, request)
+			if err != nil {
+				return "", fmt.Errorf("session/request_permission: %w", err)
+			}
+			selected = outcome.OptionId
+			if selected == "" {
+				return "", nil
+			}
+			a.recordPermission(request.ToolCall, selected, "")
+		}
+
+		allowed := selected == "proceed_once" || selected == "proceed_always"
+		if !allowed {
+			return selected, nil
+		}
+		if len(details.FullCommand) > 0 {
+			a.trackToolInput(toolUses.ToolUse.ID, details.FullCommand, nil)
+		}
+		if writePath != "" {
+			a.untrackEdits(toolUses.ToolUse.ID)
+			if err := a.writeFile(ctx, sessionID, writePath, writeContent); err != nil {
+				a.permLog.Error("failed to write file through fs/write_text_file", "session", sessionID, "path", writePath, "err", err)
+			}
 		}
 	}
+	return selected, nil
 }
 
 func main() {
-	for _, arg := range os.Args[1:] {
-		if arg == "-v" || arg == "--version" {
-			fmt.Println("v." + version)
-			return
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "replay" {
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: droid-acp replay <recording.jsonl>\n")
+			os.Exit(2)
 		}
-		if val, ok := strings.CutPrefix(arg, "--model="); ok {
-			modelFilter = val
+		if err := runReplay(args[1], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			os.Exit(1)
 		}
+		return
 	}
-
-	switch modelFilter {
-	case "all", "common", "custom":
-	default:
-		fmt.Fprintf(os.Stderr, "Invalid model filter %q; must be one of common, custom, or all\n", modelFilter)
-		os.Exit(1)
+	if len(args) > 0 && args[0] == "sessions" {
+		if err := runSessions(args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "export" {
+		if err := runExport(args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "undo" {
+		if err := runUndo(args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Undo failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "usage" {
+		if err := runUsageReport(args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Usage report failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	acpOut = os.Stdout
-	cmd := exec.Command(
-		"droid",
-		"exec",
-		"--input-format", "stream-jsonrpc",
-		"--output-format", "stream-jsonrpc",
-	)
-	var err error
-	droidInPipe, err := cmd.StdinPipe()
+	cli, err := parseArgs(args)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create stdin pipe: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	droidIn = droidInPipe
-	droidOut, err := cmd.StdoutPipe()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create stdout pipe: %v\n", err)
-		os.Exit(1)
+	if cli.version {
+		fmt.Println("v." + version)
+		return
 	}
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start droid: %v\n", err)
+
+	s, cfg, err := loadSettings(cli)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
 		os.Exit(1)
 	}
-	go func() {
-		scanner := bufio.NewScanner(droidOut)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-
-			//fmt.Fprintf(os.Stderr, "[DROID->] %s\n", line)
 
-			var msg types.DroidMessage
-			if err := json.Unmarshal([]byte(line), &msg); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to parse droid message: %v\n", err)
-				continue
-			}
-			handleDroidMessage(msg)
+	var redactor *redact.Redactor
+	if cfg.Redact.Enabled {
+		redactor, err = redact.New(cfg.Redact.Patterns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
-	}()
+	}
+	logOpts := logging.Options{
+		Level:        cfg.Log.Level,
+		File:         cfg.Log.File,
+		MaxSizeMB:    cfg.Log.MaxSizeMB,
+		PayloadLimit: cfg.Log.PayloadLimit,
+		Redactor:     redactor,
+	}
+	if logOpts.PayloadLimit == 0 {
+		logOpts.PayloadLimit = -1
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
+	logCloser, err := logging.Setup(logOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+	defer logCloser.Close()
+	log := logging.Component("main")
+	log.Info("starting droid-acp", "version", version)
+
+	acpRecord := func(bool, []byte) {}
+	droidRecord := func(bool, []byte) {}
+	if cli.record != "" {
+		recorder, err := record.Create(cli.record, redactor)
+		if err != nil {
+			log.Error("failed to create recording", "path", cli.record, "err", err)
+			os.Exit(1)
 		}
-
-		fmt.Fprintf(os.Stderr, "[ZED->] %s\n", line)
-
-		var req types.ACPRequest
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse ACP request: %v\n", err)
-			continue
+		defer recorder.Close()
+		if err := recorder.WriteConfig(cfg); err != nil {
+			log.Error("failed to record the configuration", "err", err)
 		}
+		acpRecord = recorder.Trace(record.ChannelACP)
+		droidRecord = recorder.Trace(record.ChannelDroid)
+	}
 
-		handleACPRequest(req)
+	agent := newDroidAgent(os.Stdout, s, cfg)
+	agent.ledger = usage.OpenLedger(filepath.Join(cfg.StateDir, "usage.jsonl"))
+	agent.sessions = sessions.Open(sessionsDir(cfg.StateDir))
+	agent.sessions.SetRedactor(redactor)
+	agent.snapshots = snapshots.Open(snapshotsDir(cfg.StateDir))
+	agent.conn.SetTrace(func(outbound bool, line []byte) {
+		logging.Traffic(agent.acpLog, outbound, line)
+		acpRecord(outbound, line)
+	})
+
+	var env []string
+	for name, value := range cfg.Droid.Env {
+		env = append(env, name+"="+value)
+	}
+	client, err := droid.Start(droid.Options{
+		Path:   cfg.Droid.Path,
+		Args:   cfg.Droid.Args,
+		Env:    env,
+		Dir:    cfg.Droid.Dir,
+		Stderr: logging.Writer(agent.droidLog.With("stream", "stderr"), slog.LevelInfo),
+	}, agent)
+	if err == nil {
+		client.SetTrace(func(outbound bool, line []byte) {
+			logging.Traffic(agent.droidLog, outbound, line)
+			droidRecord(outbound, line)
+		})
+		err = client.CheckStartup(droidStartupTimeout)
+	}
+	if err != nil {
+		// Keep serving so Zed can show why instead of a dead connection.
+		log.Error("droid is not available", "err", err)
+		agent.droidErr = err
+		if client != nil {
+			client.Close()
+			client = nil
+		}
 	}
+	agent.droid = client
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Scanner error: %v\n", err)
+	if err := agent.conn.Serve(context.Background(), os.Stdin); err != nil {
+		log.Error("failed to read from zed", "err", err)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		fmt.Fprintf(os.Stderr, "Droid exited with error: %v\n", err)
+	if client == nil {
+		return
+	}
+	client.Close()
+	if err := client.Wait(); err != nil {
+		log.Error("droid exited with error", "err", err)
 		os.Exit(1)
 	}
 }
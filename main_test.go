@@ -0,0 +1,1453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"droid-acp/acp"
+	"droid-acp/acp/acptest"
+	"droid-acp/config"
+	"droid-acp/droid"
+	"droid-acp/droid/droidtest"
+	"droid-acp/sessions"
+	"droid-acp/snapshots"
+	"droid-acp/types"
+	"droid-acp/usage"
+)
+
+var testSession = types.ResultModel{
+	SessionID: "droid-session-1",
+	Settings: types.SessionSettings{
+		ModelID:       "claude-sonnet-4-5",
+		AutonomyLevel: "normal",
+	},
+	AvailableModels: []types.AvailableModel{
+		{ID: "claude-sonnet-4-5", DisplayName: "Claude Sonnet 4.5", ModelProvider: "anthropic"},
+		{ID: "gpt-5.1-codex", DisplayName: "GPT-5.1 Codex", ModelProvider: "openai"},
+		{ID: "custom:glm-4.7", DisplayName: "GLM 4.7", ModelProvider: "generic-chat-completion-api", IsCustom: true},
+	},
+}
+
+// startBridge wires a droidAgent between a fake editor and a fake Droid
+// playing scenario.
+func startBridge(t *testing.T, scenario droidtest.Scenario) (*droidAgent, *acptest.Client, *droidtest.Fake) {
+	t.Helper()
+
+	fake := droidtest.New(scenario)
+	client, agentR, agentW := acptest.Pipe()
+	s, cfg := defaultSettings()
+	agent := newDroidAgent(agentW, s, cfg)
+	droidR, droidW := fake.Connect()
+	agent.droid = droid.NewClient(droidR, droidW, agent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go agent.conn.Serve(ctx, agentR)
+	t.Cleanup(func() {
+		cancel()
+		agent.droid.Close()
+	})
+	return agent, client, fake
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newTestSession(t *testing.T, client *acptest.Client) types.NewSessionResult {
+	t.Helper()
+	session, err := client.NewSession(testContext(t), "/work")
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+	return session
+}
+
+func TestNewSessionListsModelsAndModes(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{Session: testSession})
+
+	if _, err := client.Initialize(testContext(t)); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	session := newTestSession(t, client)
+
+	if session.SessionId == "" {
+		t.Fatal("session/new returned an empty session id")
+	}
+	if got := len(session.Models.AvailableModels); got != 3 {
+		t.Errorf("got %d models, want 3", got)
+	}
+	if session.Models.CurrentModelId != "claude-sonnet-4-5" {
+		t.Errorf("current model = %q", session.Models.CurrentModelId)
+	}
+	if session.Modes.CurrentModeId != "normal" {
+		t.Errorf("current mode = %q", session.Modes.CurrentModeId)
+	}
+
+	var params types.InitializeSessionParams
+	reqs := fake.Requests(droid.MethodInitializeSession)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d initialize_session requests, want 1", len(reqs))
+	}
+	json.Unmarshal(reqs[0].Params, &params)
+	if params.Cwd != "/work" {
+		t.Errorf("initialize_session cwd = %q, want /work", params.Cwd)
+	}
+}
+
+func TestPromptStreamsTextAndThinking(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.WorkingState("streaming_assistant_message"),
+			droidtest.Thinking("Let me look."),
+			droidtest.TextDelta("Hello, "),
+			droidtest.TextDelta("world."),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	result, err := client.Prompt(testContext(t), session.SessionId, "hi")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "end_turn" {
+		t.Errorf("stopReason = %q, want end_turn", result.StopReason)
+	}
+	if got := client.AgentText(); got != "Hello, world." {
+		t.Errorf("agent text = %q", got)
+	}
+
+	var thoughts int
+	for _, u := range client.Updates() {
+		if u.Update.SessionUpdate == "agent_thought_chunk" {
+			thoughts++
+		}
+		if u.SessionId != session.SessionId {
+			t.Errorf("update for session %q, want %q", u.SessionId, session.SessionId)
+		}
+	}
+	if thoughts != 1 {
+		t.Errorf("got %d thought chunks, want 1", thoughts)
+	}
+}
+
+func TestPatchIsShownAsEditToolCall(t *testing.T) {
+	patch := "*** Begin Patch\n*** Update File: /work/main.go\n@@\n-old line\n+new line\n*** End Patch"
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Patch("call-1", patch),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "edit"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	var found bool
+	for _, u := range client.Updates() {
+		if u.Update.SessionUpdate != "tool_call" {
+			continue
+		}
+		found = true
+		if u.Update.ToolCallId != "call-1" || u.Update.Kind != "edit" {
+			t.Errorf("unexpected tool call %+v", u.Update)
+		}
+		if u.Update.Content == nil || u.Update.Content.OldText != "old line" || u.Update.Content.NewText != "new line" {
+			t.Errorf("unexpected diff %+v", u.Update.Content)
+		}
+	}
+	if !found {
+		t.Fatal("no tool_call update was sent")
+	}
+}
+
+func createFileToolUse(id, path, content string) types.ToolUseParent {
+	return types.ToolUseParent{
+		ToolUse:          types.ToolUse{Type: "tool_use", ID: id, Name: "Create"},
+		ConfirmationType: "create",
+		Details:          &types.ToolUseDetail{Type: "create", FilePath: path, Content: content},
+	}
+}
+
+func TestPermissionIsRelayedAndFileWritten(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Permission(createFileToolUse("call-1", "/work/notes.md", "# Notes\n")),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	perms := client.Permissions()
+	if len(perms) != 1 {
+		t.Fatalf("got %d permission requests, want 1", len(perms))
+	}
+	if perms[0].ToolCall.ToolCallId != "call-1" || perms[0].ToolCall.Kind != "edit" {
+		t.Errorf("unexpected tool call %+v", perms[0].ToolCall)
+	}
+	if got := fake.Answers(); len(got) != 1 || got[0] != "proceed_once" {
+		t.Errorf("droid got answers %v, want [proceed_once]", got)
+	}
+	if got := client.Files["/work/notes.md"]; got != "# Notes\n" {
+		t.Errorf("written content = %q", got)
+	}
+}
+
+func TestRejectedPermissionDoesNotWrite(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Permission(createFileToolUse("call-1", "/work/notes.md", "# Notes\n")),
+			droidtest.Idle(),
+		}},
+	})
+	client.OnPermission = func(types.RequestPermissionParam) types.PermissionOutcome {
+		return types.PermissionOutcome{Outcome: "selected", OptionId: "cancel"}
+	}
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if got := fake.Answers(); len(got) != 1 || got[0] != "cancel" {
+		t.Errorf("droid got answers %v, want [cancel]", got)
+	}
+	if got := client.Writes(); len(got) != 0 {
+		t.Errorf("got %d writes after rejection", len(got))
+	}
+}
+
+func TestPolicyDeniesEditsWithoutAsking(t *testing.T) {
+	dir := t.TempDir()
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Permission(createFileToolUse("call-1", filepath.Join(dir, "notes.md"), "# Notes\n")),
+			droidtest.Idle(),
+		}},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("permissions.edits", config.PolicyDeny)
+	agent.settings.above = []config.Layer{flags}
+
+	// A project file may not set permissions.
+	project := filepath.Join(dir, ".droid-acp.toml")
+	os.WriteFile(project, []byte("[permissions]\nedits = \"allow\"\n"), 0o600)
+	if _, err := client.NewSession(testContext(t), dir); err == nil || !strings.Contains(err.Error(), `"permissions" cannot be set in a project file`) {
+		t.Fatalf("session/new with permissions in the project file error = %v", err)
+	}
+	os.Remove(project)
+
+	session, err := client.NewSession(testContext(t), dir)
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if got := client.Permissions(); len(got) != 0 {
+		t.Errorf("got %d permission requests, want none", len(got))
+	}
+	if got := fake.Answers(); len(got) != 1 || got[0] != "cancel" {
+		t.Errorf("droid got answers %v, want [cancel]", got)
+	}
+	if got := client.Writes(); len(got) != 0 {
+		t.Errorf("got %d writes after denial", len(got))
+	}
+}
+
+func TestSetModelAndModeUpdateDroidSettings(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{Session: testSession})
+	session := newTestSession(t, client)
+
+	if err := client.SetModel(testContext(t), session.SessionId, "gpt-5.1-codex"); err != nil {
+		t.Fatalf("session/set_model: %v", err)
+	}
+	if err := client.SetMode(testContext(t), session.SessionId, "auto-low"); err != nil {
+		t.Fatalf("session/set_mode: %v", err)
+	}
+
+	reqs := fake.Requests(droid.MethodUpdateSessionSettings)
+	if len(reqs) != 2 {
+		t.Fatalf("got %d update_session_settings requests, want 2", len(reqs))
+	}
+	var model, mode types.UpdateSessionSettingsParams
+	json.Unmarshal(reqs[0].Params, &model)
+	json.Unmarshal(reqs[1].Params, &mode)
+	if model.ModelId != "gpt-5.1-codex" || model.SessionId != "droid-session-1" {
+		t.Errorf("model update = %+v", model)
+	}
+	if mode.AutonomyLevel != "auto-low" {
+		t.Errorf("mode update = %+v", mode)
+	}
+}
+
+func TestCancelInterruptsTurn(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.TextDelta("Working"),
+			{Sleep: 100 * time.Millisecond},
+			droidtest.TextDelta("..."),
+			{Sleep: 100 * time.Millisecond},
+			droidtest.TextDelta("done"),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Cancel(session.SessionId)
+	}()
+	result, err := client.Prompt(testContext(t), session.SessionId, "long task")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "cancelled" {
+		t.Errorf("stopReason = %q, want cancelled", result.StopReason)
+	}
+	if got := len(fake.Requests(droid.MethodInterruptSession)); got != 1 {
+		t.Errorf("got %d interrupt requests, want 1", got)
+	}
+}
+
+func TestDroidCrashFailsLaterRequests(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns:   [][]droidtest.Step{{droidtest.TextDelta("partial"), droidtest.Crash()}},
+	})
+	session := newTestSession(t, client)
+
+	_, err := client.Prompt(testContext(t), session.SessionId, "hi")
+	if err == nil || !strings.Contains(err.Error(), "Droid exited unexpectedly") {
+		t.Fatalf("session/prompt error = %v, want Droid exited unexpectedly", err)
+	}
+
+	select {
+	case <-agent.droid.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("droid client did not notice the crash")
+	}
+	if _, err := client.NewSession(testContext(t), "/work"); err == nil {
+		t.Fatal("session/new succeeded after droid crashed")
+	}
+}
+
+func TestPromptStopReasons(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("I can't help with that."), droidtest.Stop("refusal"), droidtest.Idle()},
+			{droidtest.TextDelta("cut off"), droidtest.Stop("max_tokens"), droidtest.Idle()},
+			{droidtest.TextDelta("done"), droidtest.Stop("end_turn"), droidtest.Idle()},
+		},
+	})
+	session := newTestSession(t, client)
+
+	for _, want := range []string{"refusal", "max_tokens", "end_turn"} {
+		result, err := client.Prompt(testContext(t), session.SessionId, "go")
+		if err != nil {
+			t.Fatalf("session/prompt: %v", err)
+		}
+		if result.StopReason != want {
+			t.Errorf("stopReason = %q, want %q", result.StopReason, want)
+		}
+	}
+}
+
+func TestDroidErrorFailsPrompt(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.Error("model overloaded"), droidtest.Idle()},
+			{droidtest.TextDelta("ok"), droidtest.Idle()},
+		},
+	})
+	session := newTestSession(t, client)
+
+	_, err := client.Prompt(testContext(t), session.SessionId, "first")
+	var rpcErr *types.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != acp.CodeInternalError || rpcErr.Message != "model overloaded" {
+		t.Fatalf("session/prompt error = %v, want internal error with Droid's message", err)
+	}
+	result, err := client.Prompt(testContext(t), session.SessionId, "second")
+	if err != nil || result.StopReason != "end_turn" {
+		t.Fatalf("next prompt = %+v, %v; want end_turn", result, err)
+	}
+}
+
+func TestUnavailableDroidIsReportedOnNewSession(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{Session: testSession})
+	agent.droidErr = &droid.StartupError{Path: "droid", Err: errors.New("executable not found")}
+
+	if _, err := client.Initialize(testContext(t)); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	_, err := client.NewSession(testContext(t), "/work")
+	if err == nil || !strings.Contains(err.Error(), "executable not found") {
+		t.Fatalf("session/new error = %v, want the startup error", err)
+	}
+}
+
+func TestRequestsAfterFailedStartupAreRejected(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{Session: testSession})
+	// main leaves agent.droid nil when Droid fails to start.
+	started := agent.droid
+	agent.droid = nil
+	agent.droidErr = &droid.StartupError{Path: "droid", Err: errors.New("executable not found")}
+	t.Cleanup(func() { agent.droid = started })
+
+	if err := client.Cancel(""); err != nil {
+		t.Fatalf("session/cancel: %v", err)
+	}
+	if err := client.SetModel(testContext(t), "", "gpt-5.1-codex"); err == nil || !strings.Contains(err.Error(), "executable not found") {
+		t.Errorf("session/set_model error = %v, want the startup error", err)
+	}
+	for _, sessionID := range []string{"", "unknown"} {
+		_, err := client.Prompt(testContext(t), sessionID, "hello")
+		if err == nil || !strings.Contains(err.Error(), "executable not found") {
+			t.Errorf("session/prompt %q error = %v, want the startup error", sessionID, err)
+		}
+	}
+}
+
+func TestPromptWithoutSessionIDIsRejected(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{Session: testSession})
+	_, err := client.Prompt(testContext(t), "", "hello")
+	if err == nil || !strings.Contains(err.Error(), "sessionId is required") {
+		t.Errorf("session/prompt error = %v", err)
+	}
+}
+
+func TestNewSessionAppliesDefaults(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{Session: testSession})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("model.default", "gpt-5.1-codex")
+	flags.Set("autonomy.default", "auto-medium")
+	agent.settings.above = append(agent.settings.above, flags)
+
+	session := newTestSession(t, client)
+	if session.Models.CurrentModelId != "gpt-5.1-codex" {
+		t.Errorf("current model = %q, want gpt-5.1-codex", session.Models.CurrentModelId)
+	}
+	if session.Modes.CurrentModeId != "auto-medium" {
+		t.Errorf("current mode = %q, want auto-medium", session.Modes.CurrentModeId)
+	}
+	reqs := fake.Requests(droid.MethodUpdateSessionSettings)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d update_session_settings requests, want 1", len(reqs))
+	}
+	var params types.UpdateSessionSettingsParams
+	json.Unmarshal(reqs[0].Params, &params)
+	if params.ModelId != "gpt-5.1-codex" || params.AutonomyLevel != "auto-medium" || params.SessionId != testSession.SessionID {
+		t.Errorf("update_session_settings params = %+v", params)
+	}
+}
+
+func TestNewSessionIgnoresUnknownDefaultModel(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{Session: testSession})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("model.default", "no-such-model")
+	agent.settings.above = append(agent.settings.above, flags)
+
+	session := newTestSession(t, client)
+	if session.Models.CurrentModelId != "claude-sonnet-4-5" {
+		t.Errorf("current model = %q, want droid's own", session.Models.CurrentModelId)
+	}
+	if got := len(fake.Requests(droid.MethodUpdateSessionSettings)); got != 0 {
+		t.Errorf("got %d update_session_settings requests, want none", got)
+	}
+}
+
+func TestModesComeFromDroid(t *testing.T) {
+	reported := testSession
+	reported.AvailableAutonomyLevels = []types.AutonomyLevel{
+		{ID: "normal"},
+		{ID: "auto-low"},
+		{ID: "auto-max", DisplayName: "Auto Max", Description: "Anything goes"},
+	}
+	_, client, fake := startBridge(t, droidtest.Scenario{Session: reported})
+	session := newTestSession(t, client)
+
+	var ids []string
+	for _, mode := range session.Modes.AvailableModes {
+		ids = append(ids, mode.Id)
+		if mode.Name == "" || mode.Description == "" {
+			t.Errorf("mode %q has no name or description", mode.Id)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "spec,normal,auto-low,auto-max" {
+		t.Errorf("modes = %s, want spec,normal,auto-low,auto-max", got)
+	}
+
+	if err := client.SetMode(testContext(t), session.SessionId, "auto-high"); err == nil {
+		t.Error("session/set_mode accepted a mode droid did not report")
+	}
+	if err := client.SetMode(testContext(t), session.SessionId, "spec"); err != nil {
+		t.Fatalf("session/set_mode spec: %v", err)
+	}
+	reqs := fake.Requests(droid.MethodUpdateSessionSettings)
+	var params types.UpdateSessionSettingsParams
+	json.Unmarshal(reqs[len(reqs)-1].Params, &params)
+	if params.SpecMode == nil || !*params.SpecMode || params.AutonomyLevel != "" {
+		t.Errorf("spec mode update = %+v", params)
+	}
+}
+
+func TestSpecPlanIsReviewedAndSwitchesMode(t *testing.T) {
+	_, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.SpecPlan("call-1", "Add logging", "1. Add slog\n2. Wire flags"),
+			droidtest.Idle(),
+		}},
+	})
+	client.OnPermission = func(req types.RequestPermissionParam) types.PermissionOutcome {
+		return types.PermissionOutcome{Outcome: "selected", OptionId: "proceed_auto_run_medium"}
+	}
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "plan it"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	perms := client.Permissions()
+	if len(perms) != 1 {
+		t.Fatalf("got %d permission requests, want 1", len(perms))
+	}
+	call := perms[0].ToolCall
+	if call.Kind != "switch_mode" || call.Title != "Add logging" {
+		t.Errorf("plan review tool call = %+v", call)
+	}
+	content, _ := json.Marshal(call.Content)
+	if !strings.Contains(string(content), "1. Add slog") {
+		t.Errorf("plan review content = %s", content)
+	}
+	if len(perms[0].Options) != 4 || perms[0].Options[1].Kind != "allow_once" || perms[0].Options[3].Kind != "reject_once" {
+		t.Errorf("plan review options = %+v", perms[0].Options)
+	}
+	if got := fake.Answers(); len(got) != 1 || got[0] != "proceed_auto_run_medium" {
+		t.Errorf("droid got answers %v", got)
+	}
+
+	var mode string
+	for _, u := range client.Updates() {
+		if u.Update.SessionUpdate == "current_mode_update" {
+			mode = u.Update.CurrentModeId
+		}
+	}
+	if mode != "auto-medium" {
+		t.Errorf("current_mode_update = %q, want auto-medium", mode)
+	}
+}
+
+func TestPromptReportsTokenUsage(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("one"), droidtest.TokenUsage(1000, 200, 5000, 0), droidtest.Idle()},
+			{droidtest.TextDelta("two"), droidtest.TokenUsage(3000, 500, 9000, 100), droidtest.Idle()},
+		},
+	})
+	ledgerPath := filepath.Join(t.TempDir(), "usage.jsonl")
+	agent.ledger = usage.OpenLedger(ledgerPath)
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "first"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	result, err := client.Prompt(testContext(t), session.SessionId, "second")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	want := types.PromptUsage{TotalTokens: 6400, InputTokens: 2000, OutputTokens: 300, ThoughtTokens: 100, CachedReadTokens: 4000}
+	if result.Usage == nil || *result.Usage != want {
+		t.Errorf("usage = %+v, want %+v", result.Usage, want)
+	}
+	var meta struct {
+		DroidAcp struct{ Usage usageMeta } `json:"droidAcp"`
+	}
+	raw, _ := json.Marshal(result.Meta)
+	json.Unmarshal(raw, &meta)
+	if got := meta.DroidAcp.Usage.Session; got.Tokens != (usage.Tokens{Input: 3000, Output: 500, CacheRead: 9000, Reasoning: 100}) || got.CostUSD == nil {
+		t.Errorf("_meta = %s", raw)
+	}
+	if !strings.Contains(client.AgentText(), "Tokens: 2.0k in (+4.0k cached) · 400 out") {
+		t.Errorf("agent text = %q, want a usage summary", client.AgentText())
+	}
+
+	f, err := os.Open(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, _ := usage.Read(f)
+	if len(entries) != 2 || entries[1].Tokens.Input != 2000 || entries[1].Model != "claude-sonnet-4-5" || entries[1].Cost == nil {
+		t.Errorf("ledger entries = %+v", entries)
+	}
+}
+
+func TestTurnToolCallLimitInterruptsDroid(t *testing.T) {
+	patch := "*** Begin Patch\n*** Update File: /work/a.go\n@@\n-a\n+b\n*** End Patch"
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Patch("call-1", patch),
+			droidtest.Patch("call-2", patch),
+			{Sleep: 100 * time.Millisecond},
+			droidtest.TextDelta("still going"),
+			droidtest.Idle(),
+		}},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("limits.turn.maxToolCalls", 2)
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	result, err := client.Prompt(testContext(t), session.SessionId, "edit")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "max_turn_requests" {
+		t.Errorf("stopReason = %q, want max_turn_requests", result.StopReason)
+	}
+	if text := client.AgentText(); !strings.Contains(text, "2 tool calls") || strings.Contains(text, "still going") {
+		t.Errorf("agent text = %q", text)
+	}
+	if got := len(fake.Requests(droid.MethodInterruptSession)); got != 1 {
+		t.Errorf("got %d interrupt requests, want 1", got)
+	}
+}
+
+func TestSessionTokenLimitEndsLaterPrompts(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.TokenUsage(800, 300, 50000, 0),
+			{Sleep: 100 * time.Millisecond},
+			droidtest.Idle(),
+		}},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("limits.session.maxTokens", 1000)
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	result, err := client.Prompt(testContext(t), session.SessionId, "first")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "max_tokens" {
+		t.Errorf("stopReason = %q, want max_tokens", result.StopReason)
+	}
+
+	result, err = client.Prompt(testContext(t), session.SessionId, "second")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "max_tokens" {
+		t.Errorf("second stopReason = %q, want max_tokens", result.StopReason)
+	}
+	if got := len(fake.Requests(droid.MethodAddUserMessage)); got != 1 {
+		t.Errorf("got %d add_user_message requests, want 1", got)
+	}
+}
+
+func TestTurnDurationTimerStopsWithAbandonedPrompt(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{{Sleep: 200 * time.Millisecond}, droidtest.Idle()},
+			{{Sleep: 350 * time.Millisecond}, droidtest.TextDelta("done"), droidtest.Idle()},
+		},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("limits.turn.maxDuration", "500ms")
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	// The first prompt is abandoned before Droid finishes its turn.
+	ctx, cancel := context.WithCancel(testContext(t))
+	abandoned := make(chan error, 1)
+	go func() {
+		_, err := agent.Prompt(ctx, types.PromptParams{
+			SessionId: session.SessionId,
+			Prompt:    []types.ContentBlock{{Type: "text", Text: "first"}},
+		})
+		abandoned <- err
+	}()
+	waitUntil(t, "first message sent", func() bool {
+		return len(fake.Requests(droid.MethodAddUserMessage)) == 1
+	})
+	cancel()
+	if err := <-abandoned; !errors.Is(err, context.Canceled) {
+		t.Fatalf("abandoned prompt error = %v", err)
+	}
+	agent.mu.Lock()
+	timer := agent.limitTimer
+	agent.mu.Unlock()
+	if timer != nil {
+		t.Error("turn duration timer still running after the prompt was abandoned")
+	}
+	waitUntil(t, "first turn idle", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return agent.workingState == "idle"
+	})
+
+	// The second turn outlasts the first turn's deadline but not its own.
+	result, err := client.Prompt(testContext(t), session.SessionId, "second")
+	if err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if result.StopReason != "end_turn" {
+		t.Errorf("stopReason = %q, want end_turn", result.StopReason)
+	}
+	if got := len(fake.Requests(droid.MethodInterruptSession)); got != 0 {
+		t.Errorf("got %d interrupt requests, want 0", got)
+	}
+}
+
+func TestCostLimitWarnsAboutUnpricedModel(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TokenUsage(800, 300, 0, 0), droidtest.Idle()},
+			{droidtest.Idle()},
+		},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("model.default", "custom:glm-4.7")
+	flags.Set("limits.turn.maxCostUsd", 1.0)
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	for _, text := range []string{"first", "second"} {
+		if _, err := client.Prompt(testContext(t), session.SessionId, text); err != nil {
+			t.Fatalf("session/prompt: %v", err)
+		}
+	}
+	text := client.AgentText()
+	if n := strings.Count(text, "no price for custom:glm-4.7, so the cost limit is not enforced"); n != 1 {
+		t.Errorf("warned %d times, want once: %q", n, text)
+	}
+}
+
+// promptAsync sends a prompt without waiting for its result.
+func promptAsync(t *testing.T, client *acptest.Client, sessionID, text string) <-chan types.PromptResult {
+	t.Helper()
+	results := make(chan types.PromptResult, 1)
+	go func() {
+		result, err := client.Prompt(testContext(t), sessionID, text)
+		if err != nil {
+			t.Errorf("session/prompt %q: %v", text, err)
+		}
+		results <- result
+	}()
+	return results
+}
+
+// waitUntil polls cond until it holds or the test times out.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPromptWhileBusyIsQueued(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("first "), {Sleep: 150 * time.Millisecond}, droidtest.Idle()},
+			{droidtest.TextDelta("second"), droidtest.Idle()},
+		},
+	})
+	session := newTestSession(t, client)
+
+	first := promptAsync(t, client, session.SessionId, "one")
+	waitUntil(t, "droid got the first message", func() bool { return len(fake.Requests(droid.MethodAddUserMessage)) == 1 })
+	second := promptAsync(t, client, session.SessionId, "two")
+	waitUntil(t, "the second prompt is queued", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return len(agent.queued) == 1
+	})
+	if got := len(fake.Requests(droid.MethodAddUserMessage)); got != 1 {
+		t.Fatalf("droid got %d messages while busy, want 1", got)
+	}
+
+	for _, results := range []<-chan types.PromptResult{first, second} {
+		if result := <-results; result.StopReason != "end_turn" {
+			t.Errorf("stopReason = %q, want end_turn", result.StopReason)
+		}
+	}
+	if got := client.AgentText(); got != "first second" {
+		t.Errorf("agent text = %q", got)
+	}
+}
+
+func TestCancelDropsQueuedPrompts(t *testing.T) {
+	// The turn keeps running until it is interrupted.
+	turn := []droidtest.Step{droidtest.TextDelta("working")}
+	for i := 0; i < 100; i++ {
+		turn = append(turn, droidtest.Step{Sleep: 50 * time.Millisecond})
+	}
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns:   [][]droidtest.Step{append(turn, droidtest.Idle())},
+	})
+	session := newTestSession(t, client)
+
+	first := promptAsync(t, client, session.SessionId, "one")
+	waitUntil(t, "droid got the first message", func() bool { return len(fake.Requests(droid.MethodAddUserMessage)) == 1 })
+	second := promptAsync(t, client, session.SessionId, "two")
+	waitUntil(t, "the second prompt is queued", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return len(agent.queued) == 1
+	})
+	client.Cancel(session.SessionId)
+
+	if result := <-second; result.StopReason != "cancelled" {
+		t.Errorf("queued prompt stopReason = %q, want cancelled", result.StopReason)
+	}
+	if result := <-first; result.StopReason != "cancelled" {
+		t.Errorf("running prompt stopReason = %q, want cancelled", result.StopReason)
+	}
+	if got := len(fake.Requests(droid.MethodAddUserMessage)); got != 1 {
+		t.Errorf("droid got %d messages, want 1", got)
+	}
+}
+
+func TestSteerSendsPromptIntoRunningTurn(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("working"), {Sleep: 150 * time.Millisecond}, droidtest.TokenUsage(100, 10, 0, 0), droidtest.Idle()},
+			{droidtest.TextDelta(" steered")},
+		},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("prompts.whileBusy", "steer")
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	first := promptAsync(t, client, session.SessionId, "one")
+	waitUntil(t, "droid got the first message", func() bool { return len(fake.Requests(droid.MethodAddUserMessage)) == 1 })
+	second := promptAsync(t, client, session.SessionId, "also this")
+	waitUntil(t, "droid got the steering message", func() bool { return len(fake.Requests(droid.MethodAddUserMessage)) == 2 })
+
+	r1, r2 := <-first, <-second
+	if r1.StopReason != "end_turn" || r2.StopReason != "end_turn" {
+		t.Errorf("stop reasons = %q, %q; want end_turn for both", r1.StopReason, r2.StopReason)
+	}
+	if r1.Usage == nil || r2.Usage != nil {
+		t.Errorf("usage = %+v, %+v; want it on the first prompt only", r1.Usage, r2.Usage)
+	}
+	if got := client.AgentText(); !strings.Contains(got, "working steered") {
+		t.Errorf("agent text = %q", got)
+	}
+}
+
+func TestToolInputIsStreamedBeforePermission(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.ToolInput(1, "call-1", "Create", `{"file_path":"/work/notes.md","content":"# No`),
+			{Sleep: 150 * time.Millisecond},
+			droidtest.ToolInput(1, "", "", `tes\n"}`),
+			droidtest.Permission(createFileToolUse("call-1", "/work/notes.md", "# Notes\n")),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	var calls []types.Update
+	for _, u := range client.Updates() {
+		if u.Update.ToolCallId == "call-1" {
+			calls = append(calls, u.Update)
+		}
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got %d updates for call-1, want 2: %+v", len(calls), calls)
+	}
+	first, second := calls[0], calls[1]
+	if first.SessionUpdate != "tool_call" || first.Kind != "edit" || first.Title != "/work/notes.md" ||
+		first.Content == nil || first.Content.NewText != "# No" {
+		t.Errorf("first update = %+v", first)
+	}
+	if second.SessionUpdate != "tool_call_update" || second.Content == nil || second.Content.NewText != "# Notes\n" {
+		t.Errorf("second update = %+v", second)
+	}
+	if perms := client.Permissions(); len(perms) != 1 || perms[0].ToolCall.ToolCallId != "call-1" {
+		t.Errorf("permissions = %+v", perms)
+	}
+}
+
+func TestSubagentActivityIsNested(t *testing.T) {
+	patch := "*** Begin Patch\n*** Update File: /work/a.go\n@@\n-a\n+b\n*** End Patch"
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.ToolInput(0, "task-1", "Task", `{"description":"Fix the callers","prompt":"..."}`),
+			droidtest.Subagent("task-1", droidtest.TextDelta("Looking for callers.")),
+			droidtest.Subagent("task-1", droidtest.Patch("call-2", patch)),
+			droidtest.Subagent("task-1", droidtest.Idle()),
+			droidtest.ToolResult("task-1", "Updated 1 caller.", false),
+			droidtest.TextDelta("Done."),
+			droidtest.Idle(),
+		}},
+	})
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "fix it"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if got := client.AgentText(); got != "Done." {
+		t.Errorf("agent text = %q, want only the main agent's text", got)
+	}
+
+	var task []types.Update
+	var nested *types.Update
+	for _, u := range client.Updates() {
+		switch u.Update.ToolCallId {
+		case "task-1":
+			task = append(task, u.Update)
+		case "call-2":
+			nested = &u.Update
+		}
+	}
+	if len(task) != 3 || task[0].SessionUpdate != "tool_call" || task[0].Title != "Task: Fix the callers" {
+		t.Fatalf("task updates = %+v", task)
+	}
+	if c := task[1].Content; c == nil || c.Text != "Looking for callers." {
+		t.Errorf("progress update = %+v", task[1])
+	}
+	if last := task[2]; last.Status != "completed" || last.Content == nil || last.Content.Text != "Updated 1 caller." {
+		t.Errorf("final update = %+v", last)
+	}
+	if nested == nil {
+		t.Fatal("the sub-agent's edit was not shown")
+	}
+	meta, _ := nested.Meta["droidAcp"].(map[string]any)
+	if meta["parentToolCallId"] != "task-1" {
+		t.Errorf("nested tool call _meta = %v, want parentToolCallId task-1", nested.Meta)
+	}
+}
+
+func TestWorkingStatesAreShown(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.WorkingState("compacting_conversation"),
+			droidtest.WorkingState("streaming_assistant_message"),
+			droidtest.WorkingState("executing_tool"),
+			droidtest.TextDelta("Continuing."),
+			droidtest.Idle(),
+		}},
+	})
+	flags := config.Layer{Source: "flags"}
+	flags.Set("status.sessionInfo", true)
+	agent.settings.above = append(agent.settings.above, flags)
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "/compact"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	var thoughts string
+	var states []string
+	for _, u := range client.Updates() {
+		switch u.Update.SessionUpdate {
+		case "agent_thought_chunk":
+			thoughts += u.Update.Content.Text
+		case "session_info_update":
+			meta, _ := u.Update.Meta["droidAcp"].(map[string]any)
+			state, _ := meta["workingState"].(string)
+			states = append(states, state)
+		}
+	}
+	if thoughts != "Compacting conversation…\nConversation compacted.\n" {
+		t.Errorf("thoughts = %q", thoughts)
+	}
+	if want := []string{"compacting_conversation", "streaming_assistant_message", "executing_tool", "idle"}; strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Errorf("session info states = %v, want %v", states, want)
+	}
+	if got := client.AgentText(); got != "Continuing." {
+		t.Errorf("agent text = %q", got)
+	}
+}
+
+func TestSessionTitleAndMetadata(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("ok"), droidtest.TokenUsage(100, 20, 0, 0), droidtest.Idle()},
+			{droidtest.Title("Fix flaky login test"), droidtest.Idle()},
+		},
+	})
+	store := sessions.Open(t.TempDir())
+	agent.sessions = store
+	session := newTestSession(t, client)
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "Please fix the flaky login test in auth_test.go\nIt fails on CI."); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	meta, err := store.Get(session.SessionId)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if meta.Title != "Please fix the flaky login test in auth_test.go" || meta.Cwd != "/work" ||
+		meta.Model != "claude-sonnet-4-5" || meta.Tokens.Total() != 120 || meta.Created.IsZero() {
+		t.Errorf("metadata after first turn = %+v", meta)
+	}
+
+	if _, err := client.Prompt(testContext(t), session.SessionId, "and the other one"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	var titles []string
+	for _, u := range client.Updates() {
+		if u.Update.SessionUpdate == "session_info_update" {
+			titles = append(titles, u.Update.Title)
+		}
+	}
+	if want := "Please fix the flaky login test in auth_test.go,Fix flaky login test"; strings.Join(titles, ",") != want {
+		t.Errorf("titles = %v", titles)
+	}
+	if meta, _ := store.Get(session.SessionId); meta.Title != "Fix flaky login test" {
+		t.Errorf("stored title = %q", meta.Title)
+	}
+}
+
+func TestListForkAndDeleteSessions(t *testing.T) {
+	agent, client, fake := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("The test races on the clock."), droidtest.Idle()},
+			{droidtest.TextDelta("Done."), droidtest.Idle()},
+		},
+	})
+	store := sessions.Open(t.TempDir())
+	agent.sessions = store
+	init, err := client.Initialize(testContext(t))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	if caps := init.AgentCapabilities.SessionCapabilities; caps == nil || caps.List == nil || caps.Fork == nil {
+		t.Errorf("session capabilities = %+v", caps)
+	}
+	original := newTestSession(t, client)
+	if _, err := client.Prompt(testContext(t), original.SessionId, "Why is the login test flaky?"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	fork, err := client.ForkSession(testContext(t), original.SessionId, "")
+	if err != nil {
+		t.Fatalf("session/fork: %v", err)
+	}
+	if fork.SessionId == original.SessionId {
+		t.Fatalf("fork kept the session ID")
+	}
+	// The fork replaced the original session in Droid.
+	if _, err := client.Prompt(testContext(t), original.SessionId, "Still there?"); err == nil || !strings.Contains(err.Error(), "is no longer active") {
+		t.Errorf("prompt to the original session after the fork error = %v", err)
+	}
+	if _, err := client.Prompt(testContext(t), fork.SessionId, "Fix it."); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	reqs := fake.Requests(droid.MethodAddUserMessage)
+	var sent types.AddUserMessageParams
+	if err := json.Unmarshal(reqs[len(reqs)-1].Params, &sent); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"User: Why is the login test flaky?", "Assistant: The test races on the clock.", "Fix it."} {
+		if !strings.Contains(sent.Text, want) {
+			t.Errorf("first prompt of the fork lacks %q:\n%s", want, sent.Text)
+		}
+	}
+
+	meta, err := store.Get(fork.SessionId)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if meta.ForkedFrom != original.SessionId || meta.Title != "Why is the login test flaky? (fork)" {
+		t.Errorf("fork metadata = %+v", meta)
+	}
+	events, _ := store.Events(fork.SessionId)
+	if got := sessions.Conversation(events); len(got) != 4 || got[2].Text != "Fix it." {
+		t.Errorf("fork conversation = %+v", got)
+	}
+
+	list, err := client.ListSessions(testContext(t), "/work", "")
+	if err != nil {
+		t.Fatalf("session/list: %v", err)
+	}
+	if len(list.Sessions) != 2 || list.Sessions[0].SessionId != fork.SessionId {
+		t.Errorf("session/list = %+v", list.Sessions)
+	}
+	if list, _ := client.ListSessions(testContext(t), "/elsewhere", ""); len(list.Sessions) != 0 {
+		t.Errorf("session/list for another cwd = %+v", list.Sessions)
+	}
+
+	if err := client.Conn.Call(testContext(t), deleteSessionMethod, types.DeleteSessionParams{SessionId: original.SessionId}, nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.Get(original.SessionId); !errors.Is(err, sessions.ErrNotFound) {
+		t.Errorf("Get after delete: %v", err)
+	}
+	if events, _ := store.Events(original.SessionId); len(events) != 0 {
+		t.Errorf("transcript kept after delete: %d events", len(events))
+	}
+	if _, err := client.ForkSession(testContext(t), original.SessionId, ""); err == nil {
+		t.Errorf("forking a deleted session succeeded")
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.TextDelta("Use the key sk-ant-REDACTED."), droidtest.Idle()},
+		},
+	})
+	agent.sessions = sessions.Open(t.TempDir())
+	session := newTestSession(t, client)
+	if _, err := client.Prompt(testContext(t), session.SessionId, "Which key do I use?"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "session.md")
+	if _, err := client.Prompt(testContext(t), session.SessionId, "/export md "+path); err != nil {
+		t.Fatalf("/export: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("export not written: %v", err)
+	}
+	doc := string(b)
+	if !strings.Contains(doc, "## User\n\nWhich key do I use?") || !strings.Contains(doc, "Use the key [REDACTED].") {
+		t.Errorf("export =\n%s", doc)
+	}
+	if !strings.Contains(client.AgentText(), "Exported this session to `"+path+"`.") {
+		t.Errorf("agent text = %q", client.AgentText())
+	}
+}
+
+func TestUndoRestoresFilesOfLastTurns(t *testing.T) {
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.Permission(createFileToolUse("call-1", "/work/a.md", "v1\n")), droidtest.Idle()},
+			{droidtest.Permission(createFileToolUse("call-2", "/work/b.md", "new\n")), droidtest.Idle()},
+			{droidtest.Permission(createFileToolUse("call-3", "/work/a.md", "v2\n")), droidtest.Idle()},
+		},
+	})
+	agent.snapshots = snapshots.Open(t.TempDir())
+	client.Files["/work/a.md"] = "v0\n"
+	session := newTestSession(t, client)
+	prompt := func(text string) {
+		t.Helper()
+		if _, err := client.Prompt(testContext(t), session.SessionId, text); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+	}
+
+	prompt("edit a")
+	prompt("create b")
+	prompt("/undo")
+	if !strings.Contains(client.AgentText(), "Undid the last turn.\n\nDeleted:\n- `/work/b.md`") {
+		t.Errorf("agent text after /undo = %q", client.AgentText())
+	}
+	prompt("/undo")
+	if got := client.Files["/work/a.md"]; got != "v0\n" {
+		t.Errorf("a.md after undoing both turns = %q", got)
+	}
+
+	prompt("edit a again")
+	client.Files["/work/a.md"] = "edited by hand\n"
+	prompt("/undo")
+	if !strings.Contains(client.AgentText(), "these files changed since droid-acp wrote them:\n- `/work/a.md`") {
+		t.Errorf("agent text after a conflicting /undo = %q", client.AgentText())
+	}
+	if got := client.Files["/work/a.md"]; got != "edited by hand\n" {
+		t.Errorf("conflicting /undo changed a.md to %q", got)
+	}
+	prompt("/undo 1 force")
+	if got := client.Files["/work/a.md"]; got != "v0\n" {
+		t.Errorf("a.md after a forced /undo = %q", got)
+	}
+}
+
+func TestUndoRestoresEditsDroidMadeItself(t *testing.T) {
+	dir := t.TempDir()
+	readme, notes, old := filepath.Join(dir, "README.md"), filepath.Join(dir, "notes.md"), filepath.Join(dir, "old.md")
+	os.WriteFile(readme, []byte("v0\n"), 0o644)
+	os.WriteFile(old, []byte("gone\n"), 0o644)
+	patch := "*** Begin Patch\n*** Delete File: " + old + "\n*** End Patch"
+
+	handled := 50 * time.Millisecond
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.FileTool("call-1", "Edit", readme),
+			{Sleep: handled},
+			{Run: func() { os.WriteFile(readme, []byte("v1\n"), 0o644) }},
+			droidtest.ToolResult("call-1", "edited", false),
+			droidtest.FileTool("call-2", "Create", notes),
+			{Sleep: handled},
+			{Run: func() { os.WriteFile(notes, []byte("# Notes\n"), 0o644) }},
+			droidtest.ToolResult("call-2", "created", false),
+			droidtest.Patch("call-3", patch),
+			{Sleep: handled},
+			{Run: func() { os.Remove(old) }},
+			droidtest.ToolResult("call-3", "applied", false),
+			droidtest.Idle(),
+		}},
+	})
+	agent.snapshots = snapshots.Open(t.TempDir())
+	client.Disk = true
+	session, err := client.NewSession(testContext(t), dir)
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+	for _, text := range []string{"tidy up", "/undo"} {
+		if _, err := client.Prompt(testContext(t), session.SessionId, text); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+	}
+
+	if b, _ := os.ReadFile(readme); string(b) != "v0\n" {
+		t.Errorf("README.md after /undo = %q", b)
+	}
+	if b, _ := os.ReadFile(old); string(b) != "gone\n" {
+		t.Errorf("old.md after /undo = %q", b)
+	}
+	if _, err := os.Stat(notes); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("notes.md created by the turn still exists")
+	}
+}
+
+func TestTurnSummaryListsChangesAndCommands(t *testing.T) {
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.Permission(createFileToolUse("call-1", "/work/notes.md", "# Notes\nfirst\n")),
+			droidtest.Permission(createFileToolUse("call-2", "/work/README.md", "# Readme\nnew line\n")),
+			droidtest.Permission(types.ToolUseParent{
+				ToolUse:          types.ToolUse{Type: "tool_use", ID: "call-3", Name: "Execute"},
+				ConfirmationType: "exec",
+				Details:          &types.ToolUseDetail{Type: "exec", FullCommand: "go test ./..."},
+			}),
+			droidtest.ToolResult("call-3", "FAIL\nExit code: 1", true),
+			droidtest.Idle(),
+		}},
+	})
+	client.Files["/work/README.md"] = "# Readme\n"
+	session := newTestSession(t, client)
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	for _, want := range []string{
+		"**Turn summary**",
+		"- created `notes.md` (+2 −0)",
+		"- modified `README.md` (+1 −0)",
+		"- `go test ./...`: exit code 1",
+	} {
+		if !strings.Contains(client.AgentText(), want) {
+			t.Errorf("summary lacks %q:\n%s", want, client.AgentText())
+		}
+	}
+	var combined *types.Update
+	for _, u := range client.Updates() {
+		if u.Update.ToolCallId == "turn-1-changes" {
+			combined = &u.Update
+		}
+	}
+	if combined == nil {
+		t.Fatal("no combined diff tool call")
+	}
+	if combined.Title != "Changes in this turn: 2 files, +3 −0" || len(combined.Locations) != 2 ||
+		!strings.Contains(combined.Content.Text, "--- /dev/null\n+++ b/notes.md\n") ||
+		!strings.Contains(combined.Content.Text, "--- a/README.md\n+++ b/README.md\n") {
+		t.Errorf("combined diff = %+v", combined)
+	}
+}
+
+func TestTurnSummaryListsEditsMadeWithoutPermission(t *testing.T) {
+	dir := t.TempDir()
+	notes, readme, old := filepath.Join(dir, "notes.md"), filepath.Join(dir, "README.md"), filepath.Join(dir, "old.md")
+	os.WriteFile(readme, []byte("# Readme\n"), 0o644)
+	os.WriteFile(old, []byte("gone\n"), 0o644)
+	patch := "*** Begin Patch\n*** Update File: " + readme + "\n@@\n # Readme\n+more\n*** Delete File: " + old + "\n*** End Patch"
+
+	// In an auto mode Droid runs edit tools itself; the fake stands in for
+	// them between create_message and tool_result.
+	handled := 50 * time.Millisecond
+	_, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.FileTool("call-1", "Create", notes),
+			{Sleep: handled},
+			{Run: func() { os.WriteFile(notes, []byte("# Notes\n"), 0o644) }},
+			droidtest.ToolResult("call-1", "created", false),
+			droidtest.Patch("call-2", patch),
+			{Sleep: handled},
+			{Run: func() {
+				os.WriteFile(readme, []byte("# Readme\nmore\n"), 0o644)
+				os.Remove(old)
+			}},
+			droidtest.ToolResult("call-2", "applied", false),
+			droidtest.FileTool("call-3", "Read", readme),
+			droidtest.ToolResult("call-3", "# Readme", false),
+			droidtest.Idle(),
+		}},
+	})
+	session, err := client.NewSession(testContext(t), dir)
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+	if _, err := client.Prompt(testContext(t), session.SessionId, "tidy up"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+
+	for _, want := range []string{
+		"- created `notes.md` (+1 −0)",
+		"- modified `README.md` (+1 −0)",
+		"- deleted `old.md` (+0 −1)",
+	} {
+		if !strings.Contains(client.AgentText(), want) {
+			t.Errorf("summary lacks %q:\n%s", want, client.AgentText())
+		}
+	}
+	if strings.Count(client.AgentText(), "\n- ") != 3 {
+		t.Errorf("summary lists files that did not change:\n%s", client.AgentText())
+	}
+	var title string
+	for _, u := range client.Updates() {
+		if u.Update.ToolCallId == "turn-1-changes" {
+			title = u.Update.Title
+		}
+	}
+	if title != "Changes in this turn: 3 files, +2 −1" {
+		t.Errorf("combined diff title = %q", title)
+	}
+}
+
+func TestGitTurnsCommitAndUndo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	git("config", "user.name", "Test")
+	git("config", "user.email", "test@example.com")
+	a, b, notes := filepath.Join(dir, "a.md"), filepath.Join(dir, "b.md"), filepath.Join(dir, "notes.md")
+	if err := os.WriteFile(a, []byte("v0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "a.md")
+	git("commit", "--quiet", "-m", "initial")
+
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{
+			{droidtest.Permission(createFileToolUse("call-1", a, "v1\n")), droidtest.Idle()},
+			{droidtest.Permission(createFileToolUse("call-2", b, "new\n")), droidtest.Idle()},
+		},
+	})
+	agent.snapshots = snapshots.Open(t.TempDir())
+	client.Disk = true
+	session, err := client.NewSession(testContext(t), dir)
+	if err != nil {
+		t.Fatalf("session/new: %v", err)
+	}
+	agent.cfg.Git.Turns = config.GitTurnsCommit
+	prompt := func(text string) {
+		t.Helper()
+		if _, err := client.Prompt(testContext(t), session.SessionId, text); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+	}
+
+	// A clean work tree gets a commit with the prompt as its message.
+	prompt("edit a")
+	if got := git("log", "-1", "--format=%s"); got != "edit a" {
+		t.Errorf("last commit = %q", got)
+	}
+	if !strings.Contains(client.AgentText(), "Committed this turn as `") {
+		t.Errorf("agent text = %q", client.AgentText())
+	}
+
+	// With the user's own change in the tree, the turn is kept under a ref
+	// that holds only the agent's change.
+	if err := os.WriteFile(notes, []byte("mine\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prompt("create b")
+	ref := "refs/droid-acp/" + session.SessionId + "/2"
+	if got := git("diff", "--name-only", ref+"^", ref); got != "b.md" {
+		t.Errorf("files changed by %s = %q", ref, got)
+	}
+	if !strings.Contains(client.AgentText(), "Saved this turn's changes as `"+ref+"`") {
+		t.Errorf("agent text = %q", client.AgentText())
+	}
+
+	prompt("/undo 2")
+	if !strings.Contains(client.AgentText(), "Undid the last 2 turns through git:") {
+		t.Errorf("agent text after /undo = %q", client.AgentText())
+	}
+	if _, err := os.Stat(b); !errors.Is(err, os.ErrNotExist) {
+		t.Error("b.md still exists")
+	}
+	if content, _ := os.ReadFile(a); string(content) != "v0\n" {
+		t.Errorf("a.md after /undo = %q", content)
+	}
+	if content, _ := os.ReadFile(notes); string(content) != "mine\n" {
+		t.Errorf("/undo changed the user's notes.md to %q", content)
+	}
+	if got := git("log", "-1", "--format=%s"); got != `Revert "edit a"` {
+		t.Errorf("last commit after /undo = %q", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"droid-acp/config"
+	"droid-acp/types"
+)
+
+// providerNames are display names for Droid's model providers.
+var providerNames = map[string]string{
+	"anthropic":                   "Anthropic",
+	"openai":                      "OpenAI",
+	"google":                      "Google",
+	"xai":                         "xAI",
+	"generic-chat-completion-api": "OpenAI-compatible API",
+}
+
+// offeredModels returns the models shown in Zed's picker: the ones that
+// pass every filter in cfg, renamed by its aliases, with pinned models
+// first and the rest in Droid's order.
+func offeredModels(cfg config.ModelConfig, available []types.AvailableModel) []types.ModelInfo {
+	include := compilePatterns(cfg.Include)
+	exclude := compilePatterns(cfg.Exclude)
+
+	var models []types.ModelInfo
+	for _, model := range available {
+		if cfg.Filter == "custom" && !model.IsCustom {
+			continue
+		}
+		if cfg.Filter == "common" && model.IsCustom {
+			continue
+		}
+		if len(cfg.Providers) > 0 && !containsFold(cfg.Providers, model.ModelProvider) {
+			continue
+		}
+		if len(cfg.Allow) > 0 && !slices.Contains(cfg.Allow, model.ID) {
+			continue
+		}
+		if len(include) > 0 && !matchAny(include, model.ID) {
+			continue
+		}
+		if matchAny(exclude, model.ID) {
+			continue
+		}
+
+		name := model.DisplayName
+		if alias := cfg.Aliases[model.ID]; alias != "" {
+			name = alias
+		}
+		models = append(models, types.ModelInfo{
+			ModelId:     types.ModelId(model.ID),
+			Name:        name,
+			Description: modelDescription(model),
+		})
+	}
+
+	rank := func(id types.ModelId) int {
+		for i, pinned := range cfg.Pinned {
+			if pinned == string(id) {
+				return i
+			}
+		}
+		return len(cfg.Pinned)
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		return rank(models[i].ModelId) < rank(models[j].ModelId)
+	})
+	return models
+}
+
+// modelDescription summarises what the picker cannot show: provider,
+// reasoning efforts and whether the model is a custom (BYOK) one.
+func modelDescription(model types.AvailableModel) string {
+	var parts []string
+	if model.ModelProvider != "" {
+		provider := providerNames[model.ModelProvider]
+		if provider == "" {
+			provider = model.ModelProvider
+		}
+		parts = append(parts, provider)
+	}
+	if efforts := model.SupportedReasoningEfforts; len(efforts) > 0 {
+		reasoning := "reasoning: " + strings.Join(efforts, ", ")
+		if model.DefaultReasoningEffort != "" {
+			reasoning += fmt.Sprintf(" (default %s)", model.DefaultReasoningEffort)
+		}
+		parts = append(parts, reasoning)
+	}
+	if model.IsCustom {
+		parts = append(parts, "custom (BYOK)")
+	}
+	if len(parts) == 0 {
+		return model.DisplayName
+	}
+	return strings.Join(parts, " · ")
+}
+
+// compilePatterns compiles patterns already checked by config.Validate.
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if re, err := config.CompilePattern(p); err == nil {
+			res = append(res, re)
+		}
+	}
+	return res
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"droid-acp/config"
+	"droid-acp/types"
+)
+
+func TestOfferedModels(t *testing.T) {
+	available := append(append([]types.AvailableModel(nil), testSession.AvailableModels...),
+		types.AvailableModel{ID: "claude-opus-4-1", DisplayName: "Claude Opus 4.1", ModelProvider: "anthropic"},
+		types.AvailableModel{ID: "gpt-5", DisplayName: "GPT-5", ModelProvider: "openai"},
+	)
+	tests := []struct {
+		name string
+		cfg  config.ModelConfig
+		want []types.ModelId
+	}{
+		{"all", config.ModelConfig{Filter: "all"}, []types.ModelId{"claude-sonnet-4-5", "gpt-5.1-codex", "custom:glm-4.7", "claude-opus-4-1", "gpt-5"}},
+		{"custom", config.ModelConfig{Filter: "custom"}, []types.ModelId{"custom:glm-4.7"}},
+		{"provider", config.ModelConfig{Filter: "all", Providers: []string{"OpenAI"}}, []types.ModelId{"gpt-5.1-codex", "gpt-5"}},
+		{"allowlist", config.ModelConfig{Filter: "all", Allow: []string{"gpt-5", "claude-opus-4-1"}}, []types.ModelId{"claude-opus-4-1", "gpt-5"}},
+		{"glob", config.ModelConfig{Filter: "all", Include: []string{"claude-*"}}, []types.ModelId{"claude-sonnet-4-5", "claude-opus-4-1"}},
+		{"regex exclude", config.ModelConfig{Filter: "all", Exclude: []string{"/gpt-5(\\..*)?/", "custom:*"}}, []types.ModelId{"claude-sonnet-4-5", "claude-opus-4-1"}},
+		{"pinned", config.ModelConfig{Filter: "common", Pinned: []string{"gpt-5", "claude-opus-4-1"}}, []types.ModelId{"gpt-5", "claude-opus-4-1", "claude-sonnet-4-5", "gpt-5.1-codex"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []types.ModelId
+			for _, m := range offeredModels(tt.cfg, available) {
+				got = append(got, m.ModelId)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("offeredModels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOfferedModelsAliasAndDescription(t *testing.T) {
+	available := []types.AvailableModel{{
+		ID:                        "custom:glm-4.7",
+		DisplayName:               "GLM 4.7",
+		ModelProvider:             "generic-chat-completion-api",
+		SupportedReasoningEfforts: []string{"low", "high"},
+		DefaultReasoningEffort:    "high",
+		IsCustom:                  true,
+	}}
+	cfg := config.ModelConfig{Filter: "all", Aliases: map[string]string{"custom:glm-4.7": "GLM (team)"}}
+
+	got := offeredModels(cfg, available)
+	want := []types.ModelInfo{{
+		ModelId:     "custom:glm-4.7",
+		Name:        "GLM (team)",
+		Description: "OpenAI-compatible API · reasoning: low, high (default high) · custom (BYOK)",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("offeredModels = %+v, want %+v", got, want)
+	}
+}
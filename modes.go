@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"droid-acp/types"
+)
+
+// specModeId is the ACP mode for Droid's spec mode, where Droid plans
+// without changing anything and asks for the plan to be approved.
+const specModeId = "spec"
+
+// knownModes describes the modes Droid is known to support, used when it
+// does not report its own list and to fill in missing descriptions.
+var knownModes = []types.AvailableMode{
+	{
+		Id:          specModeId,
+		Name:        "Spec",
+		Description: "Research and write a plan for review before changing anything",
+	},
+	{
+		Id:          "normal",
+		Name:        "Normal",
+		Description: "Safe for reviewing what changes would be made",
+	},
+	{
+		Id:          "auto-low",
+		Name:        "Auto Low",
+		Description: "Documentation updates, code formatting, adding comments",
+	},
+	{
+		Id:          "auto-medium",
+		Name:        "Auto Medium",
+		Description: "Local development, testing, dependency management",
+	},
+	{
+		Id:          "auto-high",
+		Name:        "Auto High",
+		Description: "CI/CD pipelines, automated deployments",
+	},
+}
+
+// sessionModes builds the ACP modes of a session from the autonomy levels
+// Droid reports, with spec mode always offered first.
+func sessionModes(result *types.ResultModel) types.Modes {
+	if len(result.AvailableAutonomyLevels) == 0 {
+		return types.Modes{
+			CurrentModeId:  currentMode(result.Settings),
+			AvailableModes: append([]types.AvailableMode(nil), knownModes...),
+		}
+	}
+
+	modes := []types.AvailableMode{knownModes[0]}
+	for _, level := range result.AvailableAutonomyLevels {
+		if level.ID == specModeId {
+			continue
+		}
+		mode := types.AvailableMode{Id: level.ID, Name: level.DisplayName, Description: level.Description}
+		for _, known := range knownModes {
+			if known.Id != level.ID {
+				continue
+			}
+			if mode.Name == "" {
+				mode.Name = known.Name
+			}
+			if mode.Description == "" {
+				mode.Description = known.Description
+			}
+		}
+		if mode.Name == "" {
+			mode.Name = level.ID
+		}
+		modes = append(modes, mode)
+	}
+	return types.Modes{
+		CurrentModeId:  currentMode(result.Settings),
+		AvailableModes: modes,
+	}
+}
+
+// currentMode returns the ACP mode for Droid's session settings.
+func currentMode(settings types.SessionSettings) string {
+	if settings.SpecMode {
+		return specModeId
+	}
+	return settings.AutonomyLevel
+}
+
+// modeSettings returns the Droid settings that switch a session to mode.
+func modeSettings(sessionID, mode string) types.UpdateSessionSettingsParams {
+	spec := mode == specModeId
+	params := types.UpdateSessionSettingsParams{
+		SessionId: sessionID,
+		SpecMode:  &spec,
+	}
+	if !spec {
+		params.AutonomyLevel = mode
+	}
+	return params
+}
+
+func hasMode(modes []types.AvailableMode, id string) bool {
+	for _, mode := range modes {
+		if mode.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// specExitMode returns the mode a session continues in after the plan is
+// approved with option, e.g. "proceed_auto_run_medium" leads to
+// auto-medium, or "" if the plan was not approved.
+func specExitMode(option string) string {
+	if !strings.HasPrefix(option, "proceed") {
+		return ""
+	}
+	for _, level := range []string{"high", "medium", "low"} {
+		if strings.HasSuffix(option, "_"+level) {
+			return "auto-" + level
+		}
+	}
+	return "normal"
+}
+
+// reviewPlan asks the user to approve the plan Droid wrote in spec mode.
+// Approving it moves the session to the execution mode the chosen option
+// names.
+func (a *droidAgent) reviewPlan(ctx context.Context, sessionID, toolCallID string, details *types.ToolUseDetail, options []types.PermissionOption) (string, error) {
+	title := details.Title
+	if title == "" {
+		title = "Review plan"
+	}
+	request := types.RequestPermissionParam{
+		SessionId: sessionID,
+		ToolCall: types.ToolCall{
+			ToolCallId: toolCallID,
+			Title:      title,
+			Kind:       "switch_mode",
+			Status:     "pending",
+			Content: []types.TextToolCallContent{{
+				Type:    "content",
+				Content: types.Content{Type: "text", Text: details.Content},
+			}},
+		},
+		Options: options,
+	}
+	outcome, err := a.conn.RequestPermission(ctx, request)
+	if err != nil {
+		return "", fmt.Errorf("session/request_permission: %w", err)
+	}
+
+	mode := specExitMode(outcome.OptionId)
+	if mode == "" {
+		a.permLog.Info("plan not approved", "session", sessionID, "option", outcome.OptionId)
+		return outcome.OptionId, nil
+	}
+	a.permLog.Info("plan approved", "session", sessionID, "option", outcome.OptionId, "mode", mode)
+	a.mu.Lock()
+	a.modeId = mode
+	a.mu.Unlock()
+	a.sessionUpdate(types.Update{
+		SessionUpdate: "current_mode_update",
+		CurrentModeId: mode,
+	})
+	return outcome.OptionId, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+
+	"droid-acp/config"
+)
+
+// queuedPrompt is a prompt waiting for the running turn to end.
+type queuedPrompt struct {
+	done chan promptOutcome
+	// ready receives true when the prompt's turn starts and false when it
+	// was cancelled while waiting.
+	ready chan bool
+}
+
+// acquireTurn claims Droid for a prompt. It returns at once when Droid is
+// idle, or when steer mode joins the prompt to the running turn; otherwise
+// the prompt waits in the queue until every turn ahead of it has ended.
+// cancelled is true when session/cancel dropped the prompt from the queue.
+func (a *droidAgent) acquireTurn(ctx context.Context, sessionID string) (done chan promptOutcome, steered, cancelled bool, err error) {
+	done = make(chan promptOutcome, 1)
+	a.mu.Lock()
+	if !a.turnBusy {
+		a.turnBusy = true
+		a.beginTurn(done)
+		a.mu.Unlock()
+		return done, false, false, nil
+	}
+	if a.cfg.Prompts.WhileBusy == config.WhileBusySteer && a.pendingPrompt != nil && !a.cancelled && a.limitStop == "" {
+		a.steered = append(a.steered, done)
+		a.mu.Unlock()
+		a.acpLog.Info("steering the running turn", "session", sessionID)
+		return done, true, false, nil
+	}
+	q := queuedPrompt{done: done, ready: make(chan bool, 1)}
+	a.queued = append(a.queued, q)
+	position := len(a.queued)
+	a.mu.Unlock()
+	a.acpLog.Info("queued prompt until the running turn ends", "session", sessionID, "position", position)
+
+	select {
+	case ok := <-q.ready:
+		return done, false, !ok, nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		removed := a.removeQueued(done)
+		a.mu.Unlock()
+		// If the turn was handed over just as ctx ended, pass it on.
+		if !removed {
+			if ok := <-q.ready; ok {
+				a.clearPrompt(done)
+			}
+		}
+		return nil, false, false, ctx.Err()
+	}
+}
+
+// beginTurn makes done the prompt that the running turn reports to. a.mu
+// must be held.
+func (a *droidAgent) beginTurn(done chan promptOutcome) {
+	a.turnID++
+	a.turnPrompt = ""
+	a.pendingPrompt = done
+	a.steered = nil
+	a.cancelled = false
+	a.modelStop = ""
+	a.turnErr = nil
+	a.streamedTools = nil
+	a.streamIndex = nil
+	a.subagents = nil
+	a.changes = turnChanges{}
+	a.gitTurn = nil
+}
+
+// nextTurn hands Droid to the first queued prompt, or marks it idle. a.mu
+// must be held.
+func (a *droidAgent) nextTurn() {
+	a.pendingPrompt = nil
+	a.steered = nil
+	if len(a.queued) == 0 {
+		a.turnBusy = false
+		return
+	}
+	next := a.queued[0]
+	a.queued = a.queued[1:]
+	a.beginTurn(next.done)
+	next.ready <- true
+}
+
+// cancelQueued drops every queued prompt. a.mu must be held.
+func (a *droidAgent) cancelQueued() {
+	for _, q := range a.queued {
+		q.ready <- false
+	}
+	a.queued = nil
+}
+
+// removeQueued takes done out of the queue and reports whether it was
+// still waiting. a.mu must be held.
+func (a *droidAgent) removeQueued(done chan promptOutcome) bool {
+	for i, q := range a.queued {
+		if q.done == done {
+			a.queued = append(a.queued[:i:i], a.queued[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Package record reads and writes protocol recordings: every ACP and Droid
+// message in both directions, one timestamped JSON object per line.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"droid-acp/redact"
+)
+
+// Channels and directions used in entries. Directions are relative to
+// droid-acp: "in" is read by it, "out" is written by it. ChannelConfig
+// holds the settings droid-acp ran with; see WriteConfig.
+const (
+	ChannelACP    = "acp"
+	ChannelDroid  = "droid"
+	ChannelConfig = "config"
+
+	DirIn  = "in"
+	DirOut = "out"
+)
+
+type Entry struct {
+	Time    time.Time       `json:"time"`
+	Channel string          `json:"channel"`
+	Dir     string          `json:"dir"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Recorder appends entries to a file. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	redactor *redact.Redactor
+}
+
+// Create truncates or creates the recording at path. Messages are passed
+// through redactor, when non-nil, before they are written.
+func Create(path string, redactor *redact.Redactor) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f, w: bufio.NewWriter(f), redactor: redactor}, nil
+}
+
+// WriteConfig records cfg, the settings droid-acp runs with, as the header
+// of the recording so that a replay can run with them too.
+func (r *Recorder) WriteConfig(cfg any) error {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	r.Record(ChannelConfig, DirIn, b)
+	return nil
+}
+
+// Config returns the settings recorded by WriteConfig, if any.
+func Config(entries []Entry) (json.RawMessage, bool) {
+	for _, e := range entries {
+		if e.Channel == ChannelConfig {
+			return e.Message, true
+		}
+	}
+	return nil, false
+}
+
+// Trace returns a function suitable for acp.Conn.SetTrace and
+// droid.Client.SetTrace that records traffic on channel.
+func (r *Recorder) Trace(channel string) func(outbound bool, line []byte) {
+	return func(outbound bool, line []byte) {
+		dir := DirIn
+		if outbound {
+			dir = DirOut
+		}
+		r.Record(channel, dir, line)
+	}
+}
+
+// Record appends one message. Lines that are not valid JSON are stored as
+// JSON strings so the recording stays parseable.
+func (r *Recorder) Record(channel, dir string, line []byte) {
+	msg := json.RawMessage(r.redactor.Bytes(append([]byte(nil), line...)))
+	if !json.Valid(msg) {
+		msg, _ = json.Marshal(string(msg))
+	}
+	b, err := json.Marshal(Entry{
+		Time:    time.Now().UTC(),
+		Channel: channel,
+		Dir:     dir,
+		Message: msg,
+	})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(b)
+	r.w.WriteByte('\n')
+	// Flush per entry so a crash still leaves a usable trace behind.
+	r.w.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// Read parses a recording.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
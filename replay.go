@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"droid-acp/config"
+	"droid-acp/droid"
+	"droid-acp/record"
+)
+
+// replayStepTimeout bounds how long replay waits for the bridge to produce
+// the output that preceded the next recorded input.
+const replayStepTimeout = 2 * time.Second
+
+// replayKeys are fields whose values are generated per run, or are wall
+// clock times, and therefore ignored when comparing replayed output with
+// the recording.
+var replayKeys = map[string]bool{
+	"sessionId": true,
+	"machineId": true,
+	"updatedAt": true,
+	"created":   true,
+}
+
+// replayOutput collects what the bridge writes on one channel.
+type replayOutput struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	lines [][]byte
+}
+
+func newReplayOutput() *replayOutput {
+	o := &replayOutput{}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *replayOutput) collect(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		o.mu.Lock()
+		o.lines = append(o.lines, append([]byte(nil), scanner.Bytes()...))
+		o.cond.Broadcast()
+		o.mu.Unlock()
+	}
+}
+
+// runReplay feeds the inputs of a recording through a fresh bridge, with
+// in-memory pipes standing in for Zed and Droid, and reports where the
+// bridge's output diverges from what was recorded.
+func runReplay(path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	entries, err := record.Read(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read recording %s: %w", path, err)
+	}
+
+	acpInR, acpInW := io.Pipe()
+	acpOutR, acpOutW := io.Pipe()
+	droidInR, droidInW := io.Pipe()
+	droidOutR, droidOutW := io.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, cfg, err := replaySettings(entries)
+	if err != nil {
+		return fmt.Errorf("settings in recording %s: %w", path, err)
+	}
+	agent := newDroidAgent(acpOutW, s, cfg)
+	agent.droid = droid.NewClient(droidInR, droidOutW, agent)
+	go agent.conn.Serve(ctx, acpInR)
+	if startupChecked(entries) {
+		go agent.droid.CheckStartup(replayStepTimeout)
+	}
+
+	outputs := map[string]*replayOutput{
+		record.ChannelACP:   newReplayOutput(),
+		record.ChannelDroid: newReplayOutput(),
+	}
+	go outputs[record.ChannelACP].collect(acpOutR)
+	go outputs[record.ChannelDroid].collect(droidOutR)
+	inputs := map[string]io.Writer{
+		record.ChannelACP:   acpInW,
+		record.ChannelDroid: droidInW,
+	}
+
+	expected := map[string][][]byte{}
+	for _, e := range entries {
+		if e.Channel == record.ChannelConfig {
+			continue
+		}
+		if e.Dir == record.DirOut {
+			expected[e.Channel] = append(expected[e.Channel], e.Message)
+			continue
+		}
+		w, ok := inputs[e.Channel]
+		if !ok {
+			return fmt.Errorf("unknown channel %q in recording", e.Channel)
+		}
+		// Wait for the bridge to catch up with the recording so inputs
+		// that answer earlier outputs arrive in the same order.
+		for channel, want := range expected {
+			waitForOutputs(outputs[channel], len(want))
+		}
+		message := e.Message
+		if e.Channel == record.ChannelACP {
+			message = replaySessionIDs(message, expected[e.Channel], outputs[e.Channel])
+		}
+		if _, err := fmt.Fprintln(w, string(message)); err != nil {
+			return fmt.Errorf("feed %s input: %w", e.Channel, err)
+		}
+	}
+	for channel, want := range expected {
+		waitForOutputs(outputs[channel], len(want))
+	}
+
+	var mismatches int
+	for _, channel := range []string{record.ChannelACP, record.ChannelDroid} {
+		want := expected[channel]
+		o := outputs[channel]
+		o.mu.Lock()
+		got := o.lines
+		o.mu.Unlock()
+
+		for i := 0; i < len(want) || i < len(got); i++ {
+			switch {
+			case i >= len(got):
+				mismatches++
+				fmt.Fprintf(out, "%s out #%d missing\n  recorded: %s\n", channel, i+1, want[i])
+			case i >= len(want):
+				mismatches++
+				fmt.Fprintf(out, "%s out #%d unexpected\n  replayed: %s\n", channel, i+1, got[i])
+			case !sameMessage(want[i], got[i]):
+				mismatches++
+				fmt.Fprintf(out, "%s out #%d differs\n  recorded: %s\n  replayed: %s\n", channel, i+1, want[i], got[i])
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "replayed %d messages: %d mismatches\n", len(entries), mismatches)
+	if mismatches > 0 {
+		return fmt.Errorf("replay diverged from recording")
+	}
+	return nil
+}
+
+// replaySettings returns the settings the recording was made with, on top
+// of the defaults, or only the defaults for a recording without them.
+// Project files are applied per session as in the recorded run.
+func replaySettings(entries []record.Entry) (settings, *config.Config, error) {
+	raw, ok := record.Config(entries)
+	if !ok {
+		s, cfg := defaultSettings()
+		return s, cfg, nil
+	}
+	recorded := config.Layer{Source: "recording"}
+	if err := json.Unmarshal(raw, &recorded.Values); err != nil {
+		return settings{}, nil, err
+	}
+	s := settings{below: []config.Layer{config.Defaults(), recorded}}
+	cfg, err := s.resolve("")
+	if err != nil {
+		return settings{}, nil, err
+	}
+	return s, cfg, nil
+}
+
+// startupChecked reports whether the recording begins with the request
+// droid.Client.CheckStartup sends, which a replay must send again.
+func startupChecked(entries []record.Entry) bool {
+	for _, e := range entries {
+		if e.Channel == record.ChannelConfig {
+			continue
+		}
+		if e.Channel != record.ChannelDroid || e.Dir != record.DirOut {
+			return false
+		}
+		var msg struct {
+			Method string `json:"method"`
+		}
+		json.Unmarshal(e.Message, &msg)
+		return msg.Method == droid.MethodInterruptSession
+	}
+	return false
+}
+
+// replaySessionIDs rewrites the session IDs of a recorded ACP input to the
+// IDs the replayed bridge gave the same sessions, so that requests reach
+// the session they were sent to.
+func replaySessionIDs(message []byte, want [][]byte, o *replayOutput) []byte {
+	o.mu.Lock()
+	got := o.lines
+	o.mu.Unlock()
+	for i := 0; i < len(want) && i < len(got); i++ {
+		recorded, replayed := outputSessionID(want[i]), outputSessionID(got[i])
+		if recorded != "" && replayed != "" && recorded != replayed {
+			message = bytes.ReplaceAll(message, []byte(`"`+recorded+`"`), []byte(`"`+replayed+`"`))
+		}
+	}
+	return message
+}
+
+// outputSessionID returns the session a bridge output created or reports
+// to, if any.
+func outputSessionID(line []byte) string {
+	var m struct {
+		Result struct {
+			SessionID string `json:"sessionId"`
+		} `json:"result"`
+		Params struct {
+			SessionID string `json:"sessionId"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(line, &m) != nil {
+		return ""
+	}
+	if m.Result.SessionID != "" {
+		return m.Result.SessionID
+	}
+	return m.Params.SessionID
+}
+
+func waitForOutputs(o *replayOutput, n int) {
+	deadline := time.Now().Add(replayStepTimeout)
+	timer := time.AfterFunc(replayStepTimeout, func() {
+		o.mu.Lock()
+		o.cond.Broadcast()
+		o.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.lines) < n && time.Now().Before(deadline) {
+		o.cond.Wait()
+	}
+}
+
+func sameMessage(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	na, _ := json.Marshal(maskReplayKeys(va))
+	nb, _ := json.Marshal(maskReplayKeys(vb))
+	return bytes.Equal(na, nb)
+}
+
+func maskReplayKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if replayKeys[k] {
+				v[k] = "*"
+				continue
+			}
+			v[k] = maskReplayKeys(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = maskReplayKeys(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"droid-acp/config"
+	"droid-acp/droid/droidtest"
+	"droid-acp/record"
+)
+
+func TestReplayReproducesRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	recorder, err := record.Create(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, client, _ := startBridge(t, droidtest.Scenario{
+		Session: testSession,
+		Turns: [][]droidtest.Step{{
+			droidtest.TextDelta("Creating notes."),
+			droidtest.Permission(createFileToolUse("call-1", "/work/notes.md", "# Notes\n")),
+			droidtest.Idle(),
+		}},
+	})
+	// The replay must run with the recorded settings: with the default
+	// policy it would ask the client for a permission never answered.
+	flags := config.Layer{Source: "flags"}
+	flags.Set("permissions.edits", config.PolicyAllow)
+	flags.Set("status.turnSummary", false)
+	agent.settings.above = append(agent.settings.above, flags)
+	cfg, err := agent.settings.resolve("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.WriteConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	agent.conn.SetTrace(recorder.Trace(record.ChannelACP))
+	agent.droid.SetTrace(recorder.Trace(record.ChannelDroid))
+	if err := agent.droid.CheckStartup(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	session := newTestSession(t, client)
+	if _, err := client.Prompt(testContext(t), session.SessionId, "write notes"); err != nil {
+		t.Fatalf("session/prompt: %v", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Replay as if the recording had been made a while ago.
+	trace, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(trace, []byte(`"updatedAt":`)) {
+		t.Fatal("recording has no updatedAt to age")
+	}
+	trace = regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ`).ReplaceAll(trace, []byte("2020-01-02T03:04:05Z"))
+	if err := os.WriteFile(path, trace, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runReplay(path, &out); err != nil {
+		t.Fatalf("replay: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "0 mismatches") {
+		t.Errorf("unexpected replay report:\n%s", out.String())
+	}
+}
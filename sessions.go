@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"droid-acp/acp"
+	"droid-acp/sessions"
+	"droid-acp/snapshots"
+	"droid-acp/types"
+)
+
+// maxTitleLength bounds titles derived from the first prompt.
+const maxTitleLength = 60
+
+// sessionsDir is where session metadata is kept under the state dir.
+func sessionsDir(stateDir string) string {
+	return filepath.Join(stateDir, "sessions")
+}
+
+// updateSessionMeta applies change to the metadata of the current session
+// and saves it. change runs with a.mu held.
+func (a *droidAgent) updateSessionMeta(change func(m *sessions.Meta)) {
+	a.mu.Lock()
+	if a.sessionMeta.ID == "" {
+		a.mu.Unlock()
+		return
+	}
+	change(&a.sessionMeta)
+	a.sessionMeta.Updated = time.Now()
+	meta := a.sessionMeta
+	a.mu.Unlock()
+
+	if a.sessions == nil {
+		return
+	}
+	if err := a.sessions.Save(meta); err != nil {
+		a.acpLog.Error("failed to save session metadata", "session", meta.ID, "err", err)
+	}
+}
+
+// setSessionTitle names the current session and tells Zed. A title from
+// the first prompt is only a stand-in: it never replaces an existing one,
+// while the title Droid generates always does.
+func (a *droidAgent) setSessionTitle(title string, fromDroid bool) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return
+	}
+	a.mu.Lock()
+	current := a.sessionMeta.Title
+	a.mu.Unlock()
+	if current == title || (current != "" && !fromDroid) {
+		return
+	}
+
+	var updated time.Time
+	a.updateSessionMeta(func(m *sessions.Meta) {
+		m.Title = title
+		updated = time.Now()
+	})
+	a.sessionUpdate(types.Update{
+		SessionUpdate: "session_info_update",
+		Title:         title,
+		UpdatedAt:     updated.UTC().Format(time.RFC3339),
+	})
+}
+
+// promptTitle derives a session title from the text of a prompt, or ""
+// for prompts that make a poor title such as slash commands.
+func promptTitle(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "/") {
+		return ""
+	}
+	line, _, _ := strings.Cut(text, "\n")
+	line = strings.Join(strings.Fields(line), " ")
+	if r := []rune(line); len(r) > maxTitleLength {
+		cut := string(r[:maxTitleLength])
+		if i := strings.LastIndex(cut, " "); i > maxTitleLength/2 {
+			cut = cut[:i]
+		}
+		line = cut + "…"
+	}
+	return line
+}
+
+// runSessions implements "droid-acp sessions list" and "droid-acp
+// sessions delete <id>".
+func runSessions(args []string, out io.Writer) error {
+	const usage = "usage: droid-acp sessions list | droid-acp sessions delete <session-id>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	command, args := args[0], args[1:]
+	var id string
+	switch command {
+	case "list":
+	case "delete":
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			return errors.New(usage)
+		}
+		id, args = args[0], args[1:]
+	default:
+		return errors.New(usage)
+	}
+	cli, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	_, cfg, err := loadSettings(cli)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	store := sessions.Open(sessionsDir(cfg.StateDir))
+
+	if command == "delete" {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+		if err := snapshots.Open(snapshotsDir(cfg.StateDir)).Delete(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted session %s.\n", id)
+		return nil
+	}
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+	sessions.WriteList(out, list)
+	return nil
+}
+
+// sessionPageSize is how many sessions one session/list page holds.
+const sessionPageSize = 50
+
+// forkSeedLimit bounds the earlier conversation sent with the first prompt
+// of a fork; older messages are left out beyond it.
+const forkSeedLimit = 100_000
+
+// deleteSessionMethod is the extension method that deletes a session.
+const deleteSessionMethod = "_droid-acp/session/delete"
+
+// listSessionsMethod serves session/list for clients that only call
+// extension methods.
+const listSessionsMethod = "_droid-acp/session/list"
+
+// transcriptUpdates are the session updates kept in transcripts.
+var transcriptUpdates = map[string]bool{
+	"agent_message_chunk": true,
+	"agent_thought_chunk": true,
+	"tool_call":           true,
+	"tool_call_update":    true,
+	"plan":                true,
+}
+
+// recordEvent appends e to the transcript of the current session.
+func (a *droidAgent) recordEvent(e sessions.Event) {
+	a.mu.Lock()
+	id := a.sessionMeta.ID
+	enabled := a.cfg != nil && a.cfg.Sessions.Transcripts
+	a.mu.Unlock()
+	if a.sessions == nil || id == "" || !enabled {
+		return
+	}
+	e.Time = time.Now()
+	if err := a.sessions.Append(id, e); err != nil {
+		a.acpLog.Error("failed to record session transcript", "session", id, "err", err)
+	}
+}
+
+// recordPermission records how the permission for call was answered;
+// policy is set when a configured policy answered.
+func (a *droidAgent) recordPermission(call types.ToolCall, option, policy string) {
+	a.recordEvent(sessions.Event{Type: "permission", Permission: &sessions.PermissionEvent{
+		ToolCallID: call.ToolCallId,
+		Title:      call.Title,
+		Option:     option,
+		Policy:     policy,
+	}})
+}
+
+// ListSessions implements session/list from the session store.
+func (a *droidAgent) ListSessions(ctx context.Context, params types.ListSessionsParams) (types.ListSessionsResult, error) {
+	if a.sessions == nil {
+		return types.ListSessionsResult{Sessions: []types.SessionInfo{}}, nil
+	}
+	list, err := a.sessions.List()
+	if err != nil {
+		return types.ListSessionsResult{}, err
+	}
+	start := 0
+	if params.Cursor != "" {
+		start, err = strconv.Atoi(params.Cursor)
+		if err != nil || start < 0 {
+			return types.ListSessionsResult{}, acp.ErrInvalidParams(fmt.Errorf("invalid cursor %q", params.Cursor))
+		}
+	}
+
+	result := types.ListSessionsResult{Sessions: []types.SessionInfo{}}
+	matched := 0
+	for _, m := range list {
+		if params.Cwd != "" && filepath.Clean(m.Cwd) != filepath.Clean(params.Cwd) {
+			continue
+		}
+		matched++
+		if matched <= start {
+			continue
+		}
+		if len(result.Sessions) == sessionPageSize {
+			result.NextCursor = strconv.Itoa(start + sessionPageSize)
+			break
+		}
+		result.Sessions = append(result.Sessions, types.SessionInfo{
+			SessionId: m.ID,
+			Cwd:       m.Cwd,
+			Title:     m.Title,
+			UpdatedAt: m.Updated.UTC().Format(time.RFC3339),
+			Meta: map[string]any{"droidAcp": map[string]any{
+				"model":      m.Model,
+				"created":    m.Created.UTC().Format(time.RFC3339),
+				"tokens":     m.Tokens,
+				"forkedFrom": m.ForkedFrom,
+			}},
+		})
+	}
+	return result, nil
+}
+
+// ForkSession implements session/fork. Droid cannot load a conversation,
+// so the fork is a new Droid session and the earlier conversation is sent
+// along with its first prompt. The fork's transcript starts as a copy of
+// the original's.
+func (a *droidAgent) ForkSession(ctx context.Context, params types.ForkSessionParams) (types.NewSessionResult, error) {
+	if a.sessions == nil {
+		return types.NewSessionResult{}, acp.ErrMethodNotFound("session/fork")
+	}
+	source, err := a.sessions.Get(params.SessionId)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return types.NewSessionResult{}, acp.ErrInvalidParams(err)
+	}
+	if err != nil {
+		return types.NewSessionResult{}, err
+	}
+	events, err := a.sessions.Events(source.ID)
+	if err != nil {
+		return types.NewSessionResult{}, err
+	}
+
+	cwd := params.Cwd
+	if cwd == "" {
+		cwd = source.Cwd
+	}
+	result, err := a.NewSession(ctx, types.NewSessionParams{Cwd: cwd})
+	if err != nil {
+		return result, err
+	}
+	a.acpLog.Info("forked session", "from", source.ID, "session", result.SessionId, "events", len(events))
+
+	a.mu.Lock()
+	a.forkSeed = forkSeed(sessions.Conversation(events))
+	a.mu.Unlock()
+	title := source.Title
+	if title != "" {
+		title += " (fork)"
+	}
+	a.updateSessionMeta(func(m *sessions.Meta) {
+		m.ForkedFrom = source.ID
+		m.Title = title
+	})
+	if len(events) > 0 {
+		if err := a.sessions.Append(result.SessionId, events...); err != nil {
+			a.acpLog.Error("failed to copy transcript to fork", "session", result.SessionId, "err", err)
+		}
+	}
+	if title != "" {
+		acp.AfterReply(ctx, func() {
+			a.sessionUpdate(types.Update{
+				SessionUpdate: "session_info_update",
+				Title:         title,
+				UpdatedAt:     time.Now().UTC().Format(time.RFC3339),
+			})
+		})
+	}
+	return result, nil
+}
+
+// forkSeed writes an earlier conversation out for Droid, keeping the most
+// recent messages within forkSeedLimit.
+func forkSeed(messages []sessions.Message) string {
+	var parts []string
+	size := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if m.Text == "" {
+			continue
+		}
+		role := "User"
+		if m.Role == "assistant" {
+			role = "Assistant"
+		}
+		part := role + ": " + m.Text
+		if size+len(part) > forkSeedLimit {
+			break
+		}
+		size += len(part)
+		parts = append([]string{part}, parts...)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "This conversation continues an earlier one. The earlier messages were:\n\n<conversation>\n" +
+		strings.Join(parts, "\n\n") + "\n</conversation>\n\nContinue from there. The new message is:\n\n"
+}
+
+// HandleExtMethod implements acp.ExtHandler.
+func (a *droidAgent) HandleExtMethod(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case listSessionsMethod:
+		var p types.ListSessionsParams
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, acp.ErrInvalidParams(err)
+			}
+		}
+		return a.ListSessions(ctx, p)
+
+	case deleteSessionMethod:
+		var p types.DeleteSessionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, acp.ErrInvalidParams(err)
+		}
+		return nil, a.deleteSession(p.SessionId)
+	}
+	return nil, acp.ErrMethodNotFound(method)
+}
+
+// deleteSession removes a session's metadata, transcript and file
+// snapshots. Deleting the current session also stops recording it.
+func (a *droidAgent) deleteSession(id string) error {
+	if a.sessions == nil {
+		return acp.ErrMethodNotFound(deleteSessionMethod)
+	}
+	a.mu.Lock()
+	if a.sessionMeta.ID == id {
+		a.sessionMeta = sessions.Meta{}
+	}
+	a.mu.Unlock()
+	err := a.sessions.Delete(id)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return acp.ErrInvalidParams(err)
+	}
+	if a.snapshots != nil {
+		if err := a.snapshots.Delete(id); err != nil {
+			a.acpLog.Error("failed to delete file snapshots", "session", id, "err", err)
+		}
+	}
+	if err == nil {
+		a.acpLog.Info("deleted session", "session", id)
+	}
+	return err
+}
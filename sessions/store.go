@@ -0,0 +1,174 @@
+// Package sessions keeps droid-acp's own record of each session: its
+// title, where and with which model it ran, and how much it used.
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"droid-acp/redact"
+	"droid-acp/usage"
+)
+
+// ErrNotFound is returned for a session the store does not know.
+var ErrNotFound = errors.New("session not found")
+
+// Meta describes one ACP session.
+type Meta struct {
+	ID             string    `json:"id"`
+	DroidSessionID string    `json:"droidSessionId,omitempty"`
+	Title          string    `json:"title,omitempty"`
+	Cwd            string    `json:"cwd"`
+	Model          string    `json:"model,omitempty"`
+	Created        time.Time `json:"created"`
+	// Updated is the time of the last activity in the session.
+	Updated time.Time    `json:"updated"`
+	Tokens  usage.Tokens `json:"tokens"`
+	// ForkedFrom is the session this one was forked from.
+	ForkedFrom string `json:"forkedFrom,omitempty"`
+}
+
+// Store keeps one JSON file per session in a directory, so several
+// droid-acp processes can share it.
+type Store struct {
+	dir string
+	// redactor masks secrets in titles and transcripts before they are
+	// written; nil writes them as they are.
+	redactor *redact.Redactor
+	// mu serialises transcript appends within this process.
+	mu sync.Mutex
+}
+
+// Open returns the store in dir; the directory is created on the first
+// Save.
+func Open(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// SetRedactor makes the store mask secrets with r in everything it writes
+// from now on.
+func (s *Store) SetRedactor(r *redact.Redactor) {
+	s.redactor = r
+}
+
+// Dir returns the directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid session ID %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Save writes m, replacing what was stored for its ID.
+func (s *Store) Save(m Meta) error {
+	path, err := s.path(m.ID)
+	if err != nil {
+		return err
+	}
+	m.Title = s.redactor.String(m.Title)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see half a file.
+	tmp, err := os.CreateTemp(s.dir, "."+m.ID+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the session with id.
+func (s *Store) Get(id string) (Meta, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return Meta{}, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Meta{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Meta{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// List returns every stored session, most recently active first. Files
+// that cannot be read are skipped.
+func (s *Store) List() ([]Meta, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Meta
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		m, err := s.Get(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Updated.After(list[j].Updated)
+	})
+	return list, nil
+}
+
+// WriteList prints sessions as a table.
+func WriteList(w io.Writer, list []Meta) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "No sessions recorded.")
+		return
+	}
+	fmt.Fprintf(w, "%-36s %-16s %-28s %10s  %-40s %s\n", "ID", "LAST ACTIVITY", "MODEL", "TOKENS", "TITLE", "CWD")
+	for _, m := range list {
+		fmt.Fprintf(w, "%-36s %-16s %-28s %10s  %-40s %s\n",
+			m.ID, m.Updated.Local().Format("2006-01-02 15:04"), m.Model,
+			usage.FormatTokens(m.Tokens.Total()), truncate(m.Title, 40), m.Cwd)
+	}
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
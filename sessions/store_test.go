@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"droid-acp/redact"
+	"droid-acp/types"
+	"droid-acp/usage"
+)
+
+func TestStore(t *testing.T) {
+	store := Open(t.TempDir())
+	if list, err := store.List(); err != nil || len(list) != 0 {
+		t.Fatalf("empty store List = %v, %v", list, err)
+	}
+
+	now := time.Now()
+	older := Meta{ID: "a", Title: "Older", Cwd: "/work", Created: now, Updated: now.Add(-time.Hour)}
+	newer := Meta{ID: "b", Title: "Newer", Cwd: "/work", Updated: now, Tokens: usage.Tokens{Input: 10}}
+	for _, m := range []Meta{older, newer} {
+		if err := store.Save(m); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	newer.Title = "Renamed"
+	if err := store.Save(newer); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].Title != "Renamed" || list[1].ID != "a" || list[0].Tokens.Input != 10 {
+		t.Errorf("List = %+v", list)
+	}
+	if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := store.Save(Meta{ID: "../escape"}); err == nil {
+		t.Error("Save accepted an ID with a path separator")
+	}
+
+	var out strings.Builder
+	WriteList(&out, list)
+	if !strings.Contains(out.String(), "Renamed") || !strings.HasPrefix(out.String(), "ID") {
+		t.Errorf("WriteList = %q", out.String())
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	store := Open(t.TempDir())
+	if events, err := store.Events("a"); err != nil || len(events) != 0 {
+		t.Fatalf("Events without a transcript = %v, %v", events, err)
+	}
+	chunk := func(text string) Event {
+		return Event{Type: "update", Update: &types.Update{
+			SessionUpdate: "agent_message_chunk",
+			Content:       &types.Content{Type: "text", Text: text},
+		}}
+	}
+	if err := store.Save(Meta{ID: "a"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := store.Append("a", Event{Type: "prompt", Text: "Hi"}, chunk("Hello, "), chunk("there.\n")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := store.Append("a", Event{Type: "permission", Permission: &PermissionEvent{ToolCallID: "t1", Option: "cancel"}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	events, err := store.Events("a")
+	if err != nil || len(events) != 4 || events[3].Permission.Option != "cancel" {
+		t.Fatalf("Events = %+v, %v", events, err)
+	}
+	got := Conversation(events)
+	if len(got) != 2 || got[0] != (Message{"user", "Hi"}) || got[1] != (Message{"assistant", "Hello, there."}) {
+		t.Errorf("Conversation = %+v", got)
+	}
+
+	// With a redactor, secrets never reach the disk.
+	store.SetRedactor(&redact.Redactor{})
+	if err := store.Append("a", Event{Type: "prompt", Text: "use OPENAI_API_KEY=abc123secret"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(store.Dir(), "a.jsonl")); strings.Contains(string(b), "abc123secret") {
+		t.Errorf("transcript holds the secret:\n%s", b)
+	}
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if events, _ := store.Events("a"); len(events) != 0 {
+		t.Errorf("Events after Delete = %+v", events)
+	}
+	if err := store.Delete("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,202 @@
+package sessions
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"droid-acp/types"
+)
+
+// Event is one entry of a session transcript.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type is "prompt" for what the user sent, "update" for a session/update
+	// sent to the client, "permission" for a permission decision and
+	// "result" for what a tool returned to Droid.
+	Type       string           `json:"type"`
+	Text       string           `json:"text,omitempty"`
+	Update     *types.Update    `json:"update,omitempty"`
+	Permission *PermissionEvent `json:"permission,omitempty"`
+	Result     *ResultEvent     `json:"result,omitempty"`
+}
+
+// PermissionEvent records how a permission request was answered.
+type PermissionEvent struct {
+	ToolCallID string `json:"toolCallId"`
+	Title      string `json:"title,omitempty"`
+	// Option is the option selected, e.g. proceed_once or cancel.
+	Option string `json:"option"`
+	// Policy is set when a configured policy answered instead of the user.
+	Policy string `json:"policy,omitempty"`
+}
+
+// ResultEvent records the result of a tool call, such as command output.
+type ResultEvent struct {
+	ToolCallID string `json:"toolCallId"`
+	Text       string `json:"text,omitempty"`
+	IsError    bool   `json:"isError,omitempty"`
+}
+
+func (s *Store) transcriptPath(id string) (string, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".json") + ".jsonl", nil
+}
+
+// Append adds events to the transcript of session id.
+func (s *Store) Append(id string, events ...Event) error {
+	path, err := s.transcriptPath(id)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for _, e := range events {
+		b, err := json.Marshal(s.redactEvent(e))
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// redactEvent returns a copy of e with secrets masked in its free text.
+// Tool call IDs and other structural fields are kept, since exports match
+// tool calls with their permissions and results by ID.
+func (s *Store) redactEvent(e Event) Event {
+	r := s.redactor
+	if r == nil {
+		return e
+	}
+	e.Text = r.String(e.Text)
+	if e.Update != nil {
+		u := *e.Update
+		u.Title = r.String(u.Title)
+		if u.Content != nil {
+			c := *u.Content
+			c.Text = r.String(c.Text)
+			c.OldText = r.String(c.OldText)
+			c.NewText = r.String(c.NewText)
+			u.Content = &c
+		}
+		e.Update = &u
+	}
+	if e.Permission != nil {
+		p := *e.Permission
+		p.Title = r.String(p.Title)
+		e.Permission = &p
+	}
+	if e.Result != nil {
+		res := *e.Result
+		res.Text = r.String(res.Text)
+		e.Result = &res
+	}
+	return e
+}
+
+// Events reads the transcript of session id, skipping lines it cannot
+// decode. A session without a transcript has no events.
+func (s *Store) Events(id string) ([]Event, error) {
+	path, err := s.transcriptPath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Delete removes session id and its transcript.
+func (s *Store) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	transcript, _ := s.transcriptPath(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, statErr := os.Stat(transcript); statErr != nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(transcript); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Message is one side of a conversation rebuilt from a transcript.
+type Message struct {
+	// Role is "user" or "assistant".
+	Role string
+	Text string
+}
+
+// Conversation joins the prompts and agent message chunks of a transcript
+// into alternating messages.
+func Conversation(events []Event) []Message {
+	var messages []Message
+	add := func(role, text string) {
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Text += text
+			return
+		}
+		messages = append(messages, Message{Role: role, Text: text})
+	}
+	for _, e := range events {
+		switch {
+		case e.Type == "prompt":
+			add("user", e.Text)
+		case e.Type == "update" && e.Update != nil && e.Update.SessionUpdate == "agent_message_chunk" && e.Update.Content != nil:
+			add("assistant", e.Update.Content.Text)
+		}
+	}
+	for i := range messages {
+		messages[i].Text = strings.TrimSpace(messages[i].Text)
+	}
+	return messages
+}
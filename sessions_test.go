@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestPromptTitle(t *testing.T) {
+	tests := map[string]string{
+		"  Fix   the bug\nmore detail": "Fix the bug",
+		"/review security":             "",
+		"Refactor the configuration loader so that every layer is validated on its own before merging": "Refactor the configuration loader so that every layer is…",
+	}
+	for text, want := range tests {
+		if got := promptTitle(text); got != want {
+			t.Errorf("promptTitle(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
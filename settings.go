@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"droid-acp/config"
+)
+
+// settings resolves the effective configuration of a session from the
+// layers below the project file (defaults, user file) and above it
+// (environment, flags).
+type settings struct {
+	below []config.Layer
+	above []config.Layer
+}
+
+// resolve returns the configuration for a session rooted at cwd; an empty
+// cwd skips the project file.
+func (s settings) resolve(cwd string) (*config.Config, error) {
+	layers := append([]config.Layer(nil), s.below...)
+	if cwd != "" {
+		project, err := config.LoadProject(cwd)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, project)
+	}
+	layers = append(layers, s.above...)
+	return config.Resolve(layers...)
+}
+
+// loadSettings reads the user file and environment around the flags of
+// cli and resolves the configuration that applies outside any project.
+func loadSettings(cli cliArgs) (settings, *config.Config, error) {
+	path, optional := cli.configPath, cli.configPath == ""
+	if optional {
+		path = config.UserFile()
+	}
+	user, err := config.LoadFile(path, optional)
+	if err != nil {
+		return settings{}, nil, err
+	}
+	env, err := config.FromEnv(os.Environ())
+	if err != nil {
+		return settings{}, nil, err
+	}
+	s := settings{
+		below: []config.Layer{config.Defaults(), user},
+		above: []config.Layer{env, cli.flags},
+	}
+	cfg, err := s.resolve("")
+	if err != nil {
+		return settings{}, nil, err
+	}
+	return s, cfg, nil
+}
+
+// defaultSettings uses only the built-in defaults, for replays and tests.
+func defaultSettings() (settings, *config.Config) {
+	s := settings{below: []config.Layer{config.Defaults()}}
+	cfg, err := s.resolve("")
+	if err != nil {
+		panic(err)
+	}
+	return s, cfg
+}
+
+// cliArgs holds the parsed command line. Options that are also settings
+// are collected into the flags layer.
+type cliArgs struct {
+	version    bool
+	record     string
+	configPath string
+	flags      config.Layer
+}
+
+func parseArgs(args []string) (cliArgs, error) {
+	cli := cliArgs{flags: config.Layer{Source: "flags"}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// missing names a flag given without its value.
+		var missing string
+		value := func(name string) (string, bool) {
+			if arg == name && i+1 == len(args) {
+				missing = name
+			}
+			return flagValue(args, &i, name)
+		}
+		if arg == "-v" || arg == "--version" {
+			cli.version = true
+			continue
+		}
+		if arg == "--no-redact" {
+			cli.flags.Set("redact.enabled", false)
+			continue
+		}
+		if val, ok := strings.CutPrefix(arg, "--model="); ok {
+			cli.flags.Set("model.filter", val)
+			continue
+		}
+		if val, ok := value("--model-provider"); ok {
+			cli.flags.Append("model.providers", val)
+			continue
+		}
+		if val, ok := value("--model-allow"); ok {
+			cli.flags.Append("model.allow", val)
+			continue
+		}
+		if val, ok := value("--model-include"); ok {
+			cli.flags.Append("model.include", val)
+			continue
+		}
+		if val, ok := value("--model-exclude"); ok {
+			cli.flags.Append("model.exclude", val)
+			continue
+		}
+		if val, ok := value("--model-alias"); ok {
+			id, name, ok := strings.Cut(val, "=")
+			if !ok || id == "" || name == "" {
+				return cli, fmt.Errorf("invalid --model-alias %q; must be MODEL_ID=name", val)
+			}
+			cli.flags.SetEntry("model.aliases", id, name)
+			continue
+		}
+		if val, ok := value("--model-pin"); ok {
+			cli.flags.Append("model.pinned", val)
+			continue
+		}
+		if val, ok := value("--default-model"); ok {
+			cli.flags.Set("model.default", val)
+			continue
+		}
+		if val, ok := value("--default-mode"); ok {
+			cli.flags.Set("autonomy.default", val)
+			continue
+		}
+		if val, ok := value("--config"); ok {
+			cli.configPath = val
+			continue
+		}
+		if val, ok := value("--record"); ok {
+			cli.record = val
+			continue
+		}
+		if val, ok := value("--redact-pattern"); ok {
+			cli.flags.Append("redact.patterns", val)
+			continue
+		}
+		if val, ok := value("--log-level"); ok {
+			cli.flags.Set("log.level", val)
+			continue
+		}
+		if val, ok := value("--log-file"); ok {
+			cli.flags.Set("log.file", val)
+			continue
+		}
+		if val, ok := value("--log-max-size"); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return cli, fmt.Errorf("invalid --log-max-size %q; must be a number of megabytes", val)
+			}
+			cli.flags.Set("log.maxSizeMB", n)
+			continue
+		}
+		if val, ok := value("--log-payload-limit"); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return cli, fmt.Errorf("invalid --log-payload-limit %q; must be a number of bytes", val)
+			}
+			cli.flags.Set("log.payloadLimit", n)
+			continue
+		}
+		if val, ok := value("--droid-path"); ok {
+			cli.flags.Set("droid.path", val)
+			continue
+		}
+		if val, ok := value("--droid-arg"); ok {
+			cli.flags.Append("droid.args", val)
+			continue
+		}
+		if val, ok := value("--droid-env"); ok {
+			name, value, ok := strings.Cut(val, "=")
+			if !ok || name == "" {
+				return cli, fmt.Errorf("invalid --droid-env %q; must be NAME=value", val)
+			}
+			cli.flags.SetEntry("droid.env", name, value)
+			continue
+		}
+		if val, ok := value("--droid-dir"); ok {
+			cli.flags.Set("droid.dir", val)
+			continue
+		}
+		if val, ok := value("--limit"); ok {
+			key, value, ok := strings.Cut(val, "=")
+			if !ok || (!strings.HasPrefix(key, "session.") && !strings.HasPrefix(key, "turn.")) {
+				return cli, fmt.Errorf("invalid --limit %q; must be session.<name>=value or turn.<name>=value", val)
+			}
+			cli.flags.Set("limits."+key, limitValue(key, value))
+			continue
+		}
+		if val, ok := value("--while-busy"); ok {
+			cli.flags.Set("prompts.whileBusy", val)
+			continue
+		}
+		if val, ok := value("--git-turns"); ok {
+			cli.flags.Set("git.turns", val)
+			continue
+		}
+		if val, ok := value("--state-dir"); ok {
+			cli.flags.Set("stateDir", val)
+			continue
+		}
+		if missing != "" {
+			return cli, fmt.Errorf("%s needs a value", missing)
+		}
+		if strings.HasPrefix(arg, "-") {
+			return cli, fmt.Errorf("unknown option %q", arg)
+		}
+		return cli, fmt.Errorf("unexpected argument %q", arg)
+	}
+	return cli, nil
+}
+
+// limitValue types a --limit value: numbers stay numbers, durations such
+// as 30m stay strings. A duration is always a string, so a bare number
+// for it is reported as missing its unit rather than as the wrong type.
+// Other mismatches are reported by config validation.
+func limitValue(key, s string) any {
+	if strings.HasSuffix(key, ".maxDuration") {
+		return s
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// flagValue reports the value of flag name at args[*i], accepting both
+// "--name=value" and "--name value"; the latter advances *i.
+func flagValue(args []string, i *int, name string) (string, bool) {
+	arg := args[*i]
+	if val, ok := strings.CutPrefix(arg, name+"="); ok {
+		return val, true
+	}
+	if arg == name && *i+1 < len(args) {
+		*i++
+		return args[*i], true
+	}
+	return "", false
+}
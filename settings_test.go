@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	cli, err := parseArgs([]string{"--log-level", "debug", "--record=/tmp/trace.jsonl", "--no-redact", "--model=custom"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if cli.record != "/tmp/trace.jsonl" {
+		t.Errorf("record = %q", cli.record)
+	}
+	if level := cli.flags.Values["log"].(map[string]any)["level"]; level != "debug" {
+		t.Errorf("log.level = %v", level)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--log-levle", "debug"}, `unknown option "--log-levle"`},
+		{[]string{"--log-level", "debug", "--record"}, "--record needs a value"},
+		{[]string{"debug"}, `unexpected argument "debug"`},
+	} {
+		if _, err := parseArgs(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseArgs(%q) error = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestLimitFlags(t *testing.T) {
+	cli, err := parseArgs([]string{"--limit", "turn.maxToolCalls=50", "--limit=session.maxDuration=30"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	limits := cli.flags.Values["limits"].(map[string]any)
+	if n := limits["turn"].(map[string]any)["maxToolCalls"]; n != int64(50) {
+		t.Errorf("turn.maxToolCalls = %#v, want 50", n)
+	}
+	if d := limits["session"].(map[string]any)["maxDuration"]; d != "30" {
+		t.Errorf("session.maxDuration = %#v, want the string 30", d)
+	}
+}
@@ -0,0 +1,312 @@
+// Package snapshots keeps the content files had before droid-acp wrote
+// them, grouped by prompt turn, so that whole turns can be undone.
+package snapshots
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNothingToUndo is returned by Undo for a session without snapshots.
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// ErrConflict is returned by Undo when files changed after droid-acp wrote
+// them.
+var ErrConflict = errors.New("files changed since they were written")
+
+// File is one file written in a turn.
+type File struct {
+	Path string `json:"path"`
+	// Existed is false for a file the turn created.
+	Existed bool   `json:"existed"`
+	Before  string `json:"before,omitempty"`
+	// After is the content the turn left, used to notice later changes.
+	After string `json:"after"`
+	// Deleted is true when the turn left the file deleted.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Turn is the files one prompt turn wrote.
+type Turn struct {
+	ID     int       `json:"id"`
+	Prompt string    `json:"prompt,omitempty"`
+	Time   time.Time `json:"time"`
+	Files  []File    `json:"files"`
+	// Git is set when the turn was also recorded in git.
+	Git *GitRecord `json:"git,omitempty"`
+}
+
+// GitRecord is where a turn was recorded in git.
+type GitRecord struct {
+	// Dir is the top of the work tree.
+	Dir string `json:"dir"`
+	// Mode is "commit" for a commit on the branch or "ref" for a commit
+	// kept under Ref.
+	Mode string `json:"mode"`
+	// Commit holds the turn's changes on top of Parent.
+	Commit string `json:"commit"`
+	Parent string `json:"parent"`
+	Ref    string `json:"ref,omitempty"`
+	// Head and Dirty describe the repository when the turn started.
+	Head  string `json:"head,omitempty"`
+	Dirty bool   `json:"dirty,omitempty"`
+}
+
+// FS reads and writes the files being restored.
+type FS interface {
+	// ReadFile returns the content of path and whether it exists.
+	ReadFile(path string) (content string, exists bool, err error)
+	WriteFile(path, content string) error
+	Remove(path string) error
+}
+
+// OSFS is the FS of the local disk.
+type OSFS struct{}
+
+func (OSFS) ReadFile(path string) (string, bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	return string(b), err == nil, err
+}
+
+func (OSFS) WriteFile(path, content string) error {
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+func (OSFS) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Store keeps the snapshots of each session in a JSON file.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// Open returns the store in dir; the directory is created on the first
+// write.
+func Open(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) path(session string) (string, error) {
+	if session == "" || strings.ContainsAny(session, `/\`) || session == "." || session == ".." {
+		return "", fmt.Errorf("invalid session ID %q", session)
+	}
+	return filepath.Join(s.dir, session+".json"), nil
+}
+
+// Record adds a write of f.Path to turn id of session, starting the turn
+// if needed. A file written twice in a turn keeps its first Before.
+func (s *Store) Record(session string, id int, prompt string, f File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turns, err := s.load(session)
+	if err != nil {
+		return err
+	}
+	if len(turns) == 0 || turns[len(turns)-1].ID != id {
+		turns = append(turns, Turn{ID: id, Prompt: prompt, Time: time.Now()})
+	}
+	turn := &turns[len(turns)-1]
+	for i := range turn.Files {
+		if turn.Files[i].Path == f.Path {
+			turn.Files[i].After = f.After
+			turn.Files[i].Deleted = f.Deleted
+			return s.save(session, turns)
+		}
+	}
+	turn.Files = append(turn.Files, f)
+	return s.save(session, turns)
+}
+
+// RecordGit notes that turn id of session was recorded in git.
+func (s *Store) RecordGit(session string, id int, prompt string, g GitRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turns, err := s.load(session)
+	if err != nil {
+		return err
+	}
+	if len(turns) == 0 || turns[len(turns)-1].ID != id {
+		turns = append(turns, Turn{ID: id, Prompt: prompt, Time: time.Now()})
+	}
+	turns[len(turns)-1].Git = &g
+	return s.save(session, turns)
+}
+
+// Pop forgets the last n turns of session, once they were undone some
+// other way.
+func (s *Store) Pop(session string, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turns, err := s.load(session)
+	if err != nil {
+		return err
+	}
+	return s.save(session, turns[:len(turns)-min(max(n, 0), len(turns))])
+}
+
+// Turns returns the turns of session that can be undone, oldest first.
+func (s *Store) Turns(session string) ([]Turn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(session)
+}
+
+// Delete removes the snapshots of session.
+func (s *Store) Delete(session string) error {
+	path, err := s.path(session)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Result reports what Undo did or, on ErrConflict, would have done.
+type Result struct {
+	// Turns are the undone turns, newest first.
+	Turns    []Turn
+	Restored []string
+	Removed  []string
+	// Conflicts are the files whose content is no longer what the undone
+	// turns left.
+	Conflicts []string
+}
+
+// Undo restores the files written in the last n turns of session to their
+// content before the oldest of them, deleting files those turns created.
+// Unless force is set, nothing is changed if any file changed since; the
+// result then lists the conflicts and the error is ErrConflict.
+func (s *Store) Undo(session string, n int, fsys FS, force bool) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turns, err := s.load(session)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(turns) == 0 {
+		return Result{}, ErrNothingToUndo
+	}
+	n = min(max(n, 1), len(turns))
+	undone := turns[len(turns)-n:]
+
+	var result Result
+	for i := len(undone) - 1; i >= 0; i-- {
+		result.Turns = append(result.Turns, undone[i])
+	}
+	// The oldest undone write of a file has the content to restore; the
+	// newest has the content expected now.
+	var paths []string
+	restore := make(map[string]File)
+	expect := make(map[string]File)
+	for _, turn := range undone {
+		for _, f := range turn.Files {
+			if _, ok := restore[f.Path]; !ok {
+				paths = append(paths, f.Path)
+				restore[f.Path] = f
+			}
+			expect[f.Path] = f
+		}
+	}
+
+	for _, path := range paths {
+		current, exists, err := fsys.ReadFile(path)
+		if err != nil {
+			return Result{}, err
+		}
+		if want := expect[path]; exists == want.Deleted || current != want.After {
+			result.Conflicts = append(result.Conflicts, path)
+		}
+	}
+	if len(result.Conflicts) > 0 && !force {
+		return result, ErrConflict
+	}
+
+	for _, path := range paths {
+		f := restore[path]
+		if f.Existed {
+			if err := fsys.WriteFile(path, f.Before); err != nil {
+				return result, fmt.Errorf("restore %s: %w", path, err)
+			}
+			result.Restored = append(result.Restored, path)
+			continue
+		}
+		if err := fsys.Remove(path); err != nil {
+			return result, fmt.Errorf("remove %s: %w", path, err)
+		}
+		result.Removed = append(result.Removed, path)
+	}
+	return result, s.save(session, turns[:len(turns)-n])
+}
+
+func (s *Store) load(session string) ([]Turn, error) {
+	path, err := s.path(session)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var turns []Turn
+	if err := json.Unmarshal(b, &turns); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return turns, nil
+}
+
+func (s *Store) save(session string, turns []Turn) error {
+	path, err := s.path(session)
+	if err != nil {
+		return err
+	}
+	if len(turns) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(turns)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never loses the snapshots.
+	tmp, err := os.CreateTemp(s.dir, "."+session+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,93 @@
+package snapshots
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	store := Open(t.TempDir())
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := func(turn int, f File) {
+		t.Helper()
+		if err := store.Record("s", turn, "prompt", f); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	if _, err := store.Undo("s", 1, OSFS{}, false); !errors.Is(err, ErrNothingToUndo) {
+		t.Fatalf("Undo of an empty session error = %v", err)
+	}
+
+	// Turn 1 edits a.txt twice; turn 2 edits it again and creates b.txt.
+	write(a, "v1")
+	record(1, File{Path: a, Existed: true, Before: "v0", After: "v0.5"})
+	record(1, File{Path: a, Existed: true, Before: "v0.5", After: "v1"})
+	write(a, "v2")
+	record(2, File{Path: a, Existed: true, Before: "v1", After: "v2"})
+	write(b, "new")
+	record(2, File{Path: b, After: "new"})
+
+	turns, _ := store.Turns("s")
+	if len(turns) != 2 || len(turns[0].Files) != 1 || turns[0].Files[0].Before != "v0" || turns[0].Files[0].After != "v1" {
+		t.Fatalf("Turns = %+v", turns)
+	}
+
+	// A change made after the turn is a conflict.
+	write(b, "edited by hand")
+	result, err := store.Undo("s", 1, OSFS{}, false)
+	if !errors.Is(err, ErrConflict) || len(result.Conflicts) != 1 || result.Conflicts[0] != b {
+		t.Fatalf("Undo with a conflict = %+v, %v", result, err)
+	}
+	if content, _ := os.ReadFile(a); string(content) != "v2" {
+		t.Errorf("conflicting Undo changed a.txt to %q", content)
+	}
+
+	result, err = store.Undo("s", 1, OSFS{}, true)
+	if err != nil || len(result.Restored) != 1 || len(result.Removed) != 1 {
+		t.Fatalf("forced Undo = %+v, %v", result, err)
+	}
+	if content, _ := os.ReadFile(a); string(content) != "v1" {
+		t.Errorf("a.txt after undoing turn 2 = %q", content)
+	}
+	if _, err := os.Stat(b); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("b.txt created by turn 2 still exists")
+	}
+
+	// Undoing more turns than are left undoes all of them.
+	record(3, File{Path: a, Existed: true, Before: "v1", After: "v3"})
+	write(a, "v3")
+	result, err = store.Undo("s", 5, OSFS{}, false)
+	if err != nil || len(result.Turns) != 2 || result.Turns[0].ID != 3 {
+		t.Fatalf("Undo of every turn = %+v, %v", result, err)
+	}
+	if content, _ := os.ReadFile(a); string(content) != "v0" {
+		t.Errorf("a.txt after undoing every turn = %q", content)
+	}
+	if turns, _ := store.Turns("s"); len(turns) != 0 {
+		t.Errorf("turns left = %+v", turns)
+	}
+	// A deleted file is restored, unless it was created again since.
+	os.Remove(a)
+	record(4, File{Path: a, Existed: true, Before: "v0", Deleted: true})
+	write(a, "recreated")
+	if _, err := store.Undo("s", 1, OSFS{}, false); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Undo of a deletion over a new file error = %v", err)
+	}
+	os.Remove(a)
+	if _, err := store.Undo("s", 1, OSFS{}, false); err != nil {
+		t.Fatalf("Undo of a deletion: %v", err)
+	}
+	if content, _ := os.ReadFile(a); string(content) != "v0" {
+		t.Errorf("a.txt after undoing its deletion = %q", content)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"droid-acp/types"
+)
+
+// workingStates are the Droid working states worth telling the user
+// about, with what is shown while Droid is in them.
+var workingStates = map[string]string{
+	"compacting_conversation":       "Compacting conversation…",
+	"executing_tool":                "Running tool…",
+	"waiting_for_tool_confirmation": "Waiting for permission…",
+}
+
+// thoughtStates are the states also shown as a thought in the thread.
+// Tool calls and permission requests have their own entries there, so a
+// thought for each would only pad out long turns.
+var thoughtStates = map[string]bool{
+	"compacting_conversation": true,
+}
+
+// workingStateDone is shown when Droid leaves a state, for states whose
+// end is worth a note of its own.
+var workingStateDone = map[string]string{
+	"compacting_conversation": "Conversation compacted.",
+}
+
+// showWorkingState tells the user what Droid is doing: as a thought in the
+// thread for thoughtStates and, if enabled, as session info for clients
+// that display it.
+func (a *droidAgent) showWorkingState(state string) {
+	a.mu.Lock()
+	previous := a.workingState
+	a.workingState = state
+	status := a.cfg.Status
+	sessionID := a.currentSession
+	a.mu.Unlock()
+	if state == previous {
+		return
+	}
+	a.droidLog.Debug("droid working state changed", "session", sessionID, "from", previous, "to", state)
+
+	if status.Messages {
+		var lines []string
+		if done := workingStateDone[previous]; done != "" {
+			lines = append(lines, done+"\n")
+		}
+		if thoughtStates[state] {
+			lines = append(lines, workingStates[state]+"\n")
+		}
+		if len(lines) > 0 {
+			a.sessionUpdate(types.Update{
+				SessionUpdate: "agent_thought_chunk",
+				Content:       &types.Content{Type: "text", Text: strings.Join(lines, "")},
+			})
+		}
+	}
+	if status.SessionInfo {
+		a.sessionUpdate(types.Update{
+			SessionUpdate: "session_info_update",
+			UpdatedAt:     time.Now().UTC().Format(time.RFC3339),
+			Meta: map[string]any{"droidAcp": map[string]any{
+				"workingState": state,
+				"status":       workingStates[state],
+			}},
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"droid-acp/types"
+)
+
+// subagentTools are the Droid tools that hand work to a sub-agent.
+var subagentTools = map[string]bool{"Task": true}
+
+// subagent is a sub-agent working for a tool call of the main agent.
+type subagent struct {
+	progress strings.Builder
+	sent     time.Time
+}
+
+// parentMeta is the _meta of a tool call made by the sub-agent working for
+// parent, or nil for the main agent.
+func parentMeta(parent string) map[string]any {
+	if parent == "" {
+		return nil
+	}
+	return map[string]any{"droidAcp": map[string]any{"parentToolCallId": parent}}
+}
+
+// startSubagent tracks the sub-agent working for tool use id. A sub-agent
+// that reports before its tool call was shown gets a tool call of its own.
+func (a *droidAgent) startSubagent(id string) {
+	a.mu.Lock()
+	if a.subagents == nil {
+		a.subagents = make(map[string]*subagent)
+	}
+	if a.subagents[id] != nil {
+		a.mu.Unlock()
+		return
+	}
+	a.subagents[id] = &subagent{}
+	announced := a.streamedTools[id] != nil
+	a.mu.Unlock()
+
+	if !announced {
+		a.sessionUpdate(types.Update{
+			SessionUpdate: "tool_call",
+			ToolCallId:    id,
+			Title:         "Sub-agent",
+			Kind:          "other",
+			Status:        "in_progress",
+		})
+	}
+}
+
+// subagentText adds text a sub-agent wrote to the progress shown in the
+// tool call of its parent rather than to the main agent's message.
+func (a *droidAgent) subagentText(parent, text string) {
+	a.startSubagent(parent)
+	a.mu.Lock()
+	sub := a.subagents[parent]
+	sub.progress.WriteString(text)
+	if time.Since(sub.sent) < toolStreamInterval {
+		a.mu.Unlock()
+		return
+	}
+	sub.sent = time.Now()
+	progress := sub.progress.String()
+	a.mu.Unlock()
+
+	a.sessionUpdate(types.Update{
+		SessionUpdate: "tool_call_update",
+		ToolCallId:    parent,
+		Status:        "in_progress",
+		Content:       &types.Content{Type: "text", Text: progress},
+	})
+}
+
+// finishSubagent shows the final summary of the sub-agent working for
+// tool use id. It reports false when id is not a sub-agent.
+func (a *droidAgent) finishSubagent(id string, result json.RawMessage, failed bool) bool {
+	a.mu.Lock()
+	sub := a.subagents[id]
+	if sub == nil {
+		a.mu.Unlock()
+		return false
+	}
+	delete(a.subagents, id)
+	summary := toolResultText(result)
+	if summary == "" {
+		summary = sub.progress.String()
+	}
+	a.mu.Unlock()
+
+	status := "completed"
+	if failed {
+		status = "failed"
+	}
+	update := types.Update{
+		SessionUpdate: "tool_call_update",
+		ToolCallId:    id,
+		Status:        status,
+	}
+	if summary != "" {
+		update.Content = &types.Content{Type: "text", Text: summary}
+	}
+	a.sessionUpdate(update)
+	return true
+}
+
+// toolResultText returns the text of a tool result, which is either a
+// string or a list of content blocks.
+func toolResultText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var blocks []types.Content
+	if json.Unmarshal(raw, &blocks) != nil {
+		return ""
+	}
+	var parts []string
+	for _, block := range blocks {
+		if block.Type == "text" && block.Text != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
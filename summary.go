@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"droid-acp/diff"
+	"droid-acp/export"
+	"droid-acp/snapshots"
+	"droid-acp/types"
+)
+
+// turnChanges is what the running turn changed and ran, for the summary
+// sent when it ends.
+type turnChanges struct {
+	files    []*fileChange
+	commands []commandRun
+	// pendingCommands and pendingEdits wait for the tool result that tells
+	// whether they happened, keyed by tool use. pendingEdits holds the
+	// files a tool use may change as they were before it ran.
+	pendingCommands map[string]string
+	pendingEdits    map[string][]fileChange
+}
+
+// fileChange is a file the turn created, modified or deleted. before is
+// its content when the turn first touched it.
+type fileChange struct {
+	path    string
+	existed bool
+	deleted bool
+	before  string
+	after   string
+}
+
+// commandRun is a command the turn ran. exitCode is nil when Droid did not
+// report it.
+type commandRun struct {
+	command  string
+	exitCode *int
+	failed   bool
+}
+
+// exitCodePattern finds the exit code in the result of a command.
+var exitCodePattern = regexp.MustCompile(`(?i)exit(?:ed with)?(?: code| status)[:= ]*(-?\d+)`)
+
+// patchFilePattern finds the files an apply_patch input adds, updates or
+// deletes.
+var patchFilePattern = regexp.MustCompile(`(?m)^\*\*\* (?:Add|Update|Delete) File:\s*(.+?)\s*$`)
+
+// editTools are the Droid tools that change files on their own when no
+// permission is asked.
+var editTools = map[string]bool{"Create": true, "Edit": true, "MultiEdit": true, "ApplyPatch": true}
+
+// trackFileWrite notes that the turn wrote content to path.
+func (a *droidAgent) trackFileWrite(path string, existed bool, before, after string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.noteFileChange(fileChange{path: path, existed: existed, before: before, after: after})
+}
+
+// noteFileChange adds c to the files of the turn, keeping the earlier
+// content of a file it already changed. a.mu must be held.
+func (a *droidAgent) noteFileChange(c fileChange) {
+	for _, f := range a.changes.files {
+		if f.path == c.path {
+			f.after = c.after
+			f.deleted = false
+			return
+		}
+	}
+	a.changes.files = append(a.changes.files, &c)
+}
+
+// editedPaths returns the files tool use content may change, from its
+// input in create_message and what was streamed of it.
+func (a *droidAgent) editedPaths(content types.DroidContent) []string {
+	name, filePath, patch := content.Name, "", ""
+	if content.Input != nil {
+		filePath, patch = content.Input.FilePath, content.Input.Input
+	}
+	a.mu.Lock()
+	if tool := a.streamedTools[content.Id]; tool != nil {
+		fields := partialJSONStrings(tool.input.String())
+		name = cmp.Or(name, tool.name)
+		filePath = cmp.Or(filePath, fields["file_path"])
+		patch = cmp.Or(patch, fields["input"])
+	}
+	a.mu.Unlock()
+	if name != "" && !editTools[name] {
+		return nil
+	}
+
+	var paths []string
+	if filePath != "" {
+		paths = append(paths, filePath)
+	}
+	for _, m := range patchFilePattern.FindAllStringSubmatch(patch, -1) {
+		if !slices.Contains(paths, m[1]) {
+			paths = append(paths, m[1])
+		}
+	}
+	return paths
+}
+
+// trackToolInput notes the command and the files of a tool use before it
+// runs; they count once its result arrives.
+func (a *droidAgent) trackToolInput(id, command string, paths []string) {
+	var edits []fileChange
+	for _, path := range paths {
+		before, existed, _ := snapshots.OSFS{}.ReadFile(path)
+		edits = append(edits, fileChange{path: path, existed: existed, before: before})
+	}
+	if command == "" && len(edits) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if command != "" {
+		if a.changes.pendingCommands == nil {
+			a.changes.pendingCommands = make(map[string]string)
+		}
+		a.changes.pendingCommands[id] = command
+	}
+	if len(edits) > 0 {
+		if a.changes.pendingEdits == nil {
+			a.changes.pendingEdits = make(map[string][]fileChange)
+		}
+		a.changes.pendingEdits[id] = edits
+	}
+}
+
+// untrackEdits forgets the files of tool use id, for edits droid-acp
+// writes itself and tracks as it does.
+func (a *droidAgent) untrackEdits(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.changes.pendingEdits, id)
+}
+
+// trackToolResult settles the command and the files of tool use id.
+func (a *droidAgent) trackToolResult(id, text string, failed bool) {
+	a.mu.Lock()
+	command, ok := a.changes.pendingCommands[id]
+	if !ok {
+		// Commands that needed no permission are known from their input.
+		if tool := a.streamedTools[id]; tool != nil && tool.name == "Execute" {
+			command, ok = partialJSONStrings(tool.input.String())["command"], true
+		}
+	}
+	delete(a.changes.pendingCommands, id)
+	if ok && command != "" {
+		run := commandRun{command: command, failed: failed}
+		if m := exitCodePattern.FindStringSubmatch(text); m != nil {
+			code, _ := strconv.Atoi(m[1])
+			run.exitCode = &code
+			run.failed = code != 0
+		}
+		a.changes.commands = append(a.changes.commands, run)
+	}
+	edits := a.changes.pendingEdits[id]
+	delete(a.changes.pendingEdits, id)
+	a.mu.Unlock()
+	if failed || len(edits) == 0 {
+		return
+	}
+
+	// The tool wrote the files itself; what it did is on disk.
+	for i := range edits {
+		after, exists, _ := snapshots.OSFS{}.ReadFile(edits[i].path)
+		edits[i].after, edits[i].deleted = after, !exists
+	}
+	var changed []snapshots.File
+	a.mu.Lock()
+	for _, e := range edits {
+		switch {
+		case e.deleted && e.existed:
+			e.after = ""
+			a.trackDeletion(e)
+		case !e.deleted && (!e.existed || e.after != e.before):
+			a.noteFileChange(e)
+		default:
+			continue
+		}
+		changed = append(changed, snapshots.File{Path: e.path, Existed: e.existed, Before: e.before, After: e.after, Deleted: e.deleted})
+	}
+	snapshot := a.snapshots != nil && a.cfg.Undo.Snapshots
+	sessionID, turn, prompt := a.currentSession, a.turnID, a.turnPrompt
+	a.mu.Unlock()
+
+	// Keep what the files were before for /undo, as writeFile does.
+	if !snapshot {
+		return
+	}
+	for _, f := range changed {
+		if err := a.snapshots.Record(sessionID, turn, prompt, f); err != nil {
+			a.droidLog.Error("failed to save file snapshot", "session", sessionID, "path", f.Path, "err", err)
+		}
+	}
+}
+
+// trackDeletion notes a deleted file. a.mu must be held.
+func (a *droidAgent) trackDeletion(d fileChange) {
+	for i, f := range a.changes.files {
+		if f.path != d.path {
+			continue
+		}
+		if !f.existed {
+			// Created and deleted in the same turn: no change at all.
+			a.changes.files = append(a.changes.files[:i], a.changes.files[i+1:]...)
+			return
+		}
+		f.deleted = true
+		f.after = ""
+		return
+	}
+	a.changes.files = append(a.changes.files, &d)
+}
+
+// sendTurnSummary shows what the turn that just ended changed: a message
+// listing the files and commands, and one tool call with the combined
+// diff of every file.
+func (a *droidAgent) sendTurnSummary() {
+	a.mu.Lock()
+	changes := a.changes
+	a.changes = turnChanges{}
+	enabled := a.cfg.Status.TurnSummary
+	cwd := a.lastSessionCwd
+	turn := a.turnID
+	a.mu.Unlock()
+	if !enabled || (len(changes.files) == 0 && len(changes.commands) == 0) {
+		return
+	}
+
+	a.agentMessage(turnSummary(changes, cwd))
+	if len(changes.files) == 0 {
+		return
+	}
+	var diffs []string
+	var locations []types.ToolCallLocation
+	added, removed := 0, 0
+	for _, f := range changes.files {
+		name := relPath(cwd, f.path)
+		from, to := "a/"+name, "b/"+name
+		if !f.existed {
+			from = "/dev/null"
+		}
+		if f.deleted {
+			to = "/dev/null"
+		}
+		if d := diff.Unified(from, to, f.before, f.after); d != "" {
+			diffs = append(diffs, d)
+		}
+		plus, minus := diff.Stat(f.before, f.after)
+		added += plus
+		removed += minus
+		if !f.deleted {
+			locations = append(locations, types.ToolCallLocation{Path: f.path})
+		}
+	}
+	files := "1 file"
+	if n := len(changes.files); n != 1 {
+		files = fmt.Sprintf("%d files", n)
+	}
+	update := types.Update{
+		SessionUpdate: "tool_call",
+		ToolCallId:    fmt.Sprintf("turn-%d-changes", turn),
+		Title:         fmt.Sprintf("Changes in this turn: %s, +%d −%d", files, added, removed),
+		Kind:          "edit",
+		Status:        "completed",
+		Locations:     locations,
+	}
+	if len(diffs) > 0 {
+		update.Content = &types.Content{Type: "text", Text: export.CodeBlock("diff", strings.Join(diffs, ""))}
+	}
+	a.sessionUpdate(update)
+}
+
+// turnSummary lists the files and commands of a turn.
+func turnSummary(changes turnChanges, cwd string) string {
+	var b strings.Builder
+	b.WriteString("\n\n---\n**Turn summary**\n")
+	if len(changes.files) > 0 {
+		b.WriteString("\nFiles:\n")
+		for _, f := range changes.files {
+			added, removed := diff.Stat(f.before, f.after)
+			verb := "modified"
+			switch {
+			case f.deleted:
+				verb = "deleted"
+			case !f.existed:
+				verb = "created"
+			}
+			fmt.Fprintf(&b, "- %s `%s` (+%d −%d)\n", verb, relPath(cwd, f.path), added, removed)
+		}
+	}
+	if len(changes.commands) > 0 {
+		b.WriteString("\nCommands:\n")
+		for _, c := range changes.commands {
+			result := "ok"
+			switch {
+			case c.exitCode != nil:
+				result = fmt.Sprintf("exit code %d", *c.exitCode)
+			case c.failed:
+				result = "failed"
+			}
+			fmt.Fprintf(&b, "- `%s`: %s\n", firstLine(c.command), result)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// relPath shows path relative to the session directory when it is inside
+// it.
+func relPath(cwd, path string) string {
+	if rel, err := filepath.Rel(cwd, path); err == nil && filepath.IsAbs(path) && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"droid-acp/types"
+	"droid-acp/usage"
+)
+
+// usageMeta is the usage reported under _meta of the session/prompt result.
+type usageMeta struct {
+	Model   string       `json:"model"`
+	Turn    usageMetaSum `json:"turn"`
+	Session usageMetaSum `json:"session"`
+}
+
+type usageMetaSum struct {
+	Tokens usage.Tokens `json:"tokens"`
+	// CostUSD is an estimate; it is left out when the model has no price.
+	CostUSD *float64 `json:"costUsd,omitempty"`
+}
+
+func tokensFromDroid(u *types.TokenUsage) usage.Tokens {
+	return usage.Tokens{
+		Input:      u.InputTokens,
+		Output:     u.OutputTokens,
+		CacheRead:  u.CacheReadTokens,
+		CacheWrite: u.CacheCreationTokens,
+		Reasoning:  u.ThinkingTokens,
+	}
+}
+
+// finishTurn accounts for the turn that just ended: it fills in the usage
+// of result, shows the summary message and writes the ledger entry. Turns
+// for which Droid reported no usage are left alone.
+func (a *droidAgent) finishTurn(result *types.PromptResult) {
+	a.mu.Lock()
+	turn := a.sessionTokens.Sub(a.turnStart)
+	a.turnStart = a.sessionTokens
+	if turn.Total() <= 0 {
+		a.mu.Unlock()
+		return
+	}
+	cfg := a.cfg.Usage
+	model := a.modelId
+	turnCost, priced := usage.Cost(cfg.Prices, model, turn)
+	a.sessionCost += turnCost
+	if !priced {
+		a.sessionUnpriced = true
+	}
+	meta := usageMeta{
+		Model:   model,
+		Turn:    usageMetaSum{Tokens: turn},
+		Session: usageMetaSum{Tokens: a.sessionTokens},
+	}
+	if priced {
+		meta.Turn.CostUSD = &turnCost
+	}
+	if !a.sessionUnpriced {
+		sessionCost := a.sessionCost
+		meta.Session.CostUSD = &sessionCost
+	}
+	sessionID := a.currentSession
+	cwd := a.lastSessionCwd
+	a.mu.Unlock()
+
+	result.Usage = &types.PromptUsage{
+		TotalTokens:       turn.Total(),
+		InputTokens:       turn.Input,
+		OutputTokens:      turn.Output,
+		ThoughtTokens:     turn.Reasoning,
+		CachedReadTokens:  turn.CacheRead,
+		CachedWriteTokens: turn.CacheWrite,
+	}
+	result.Meta = map[string]any{"droidAcp": map[string]any{"usage": meta}}
+
+	if cfg.Summary {
+		a.agentMessage(usageSummary(meta))
+	}
+	if a.ledger != nil && cfg.Ledger {
+		err := a.ledger.Append(usage.Entry{
+			Time:      time.Now(),
+			SessionID: sessionID,
+			Cwd:       cwd,
+			Model:     model,
+			Tokens:    turn,
+			Cost:      meta.Turn.CostUSD,
+		})
+		if err != nil {
+			a.acpLog.Warn("failed to write usage ledger", "err", err)
+		}
+	}
+}
+
+// usageSummary renders a one-line usage summary shown after a turn.
+func usageSummary(m usageMeta) string {
+	var b strings.Builder
+	t := m.Turn.Tokens
+	fmt.Fprintf(&b, "\n\n---\nTokens: %s in", usage.FormatTokens(t.Input))
+	if t.CacheRead > 0 {
+		fmt.Fprintf(&b, " (+%s cached)", usage.FormatTokens(t.CacheRead))
+	}
+	fmt.Fprintf(&b, " · %s out", usage.FormatTokens(t.Output+t.Reasoning))
+	if m.Turn.CostUSD != nil {
+		fmt.Fprintf(&b, " · ~%s", usage.FormatCost(*m.Turn.CostUSD))
+	}
+	fmt.Fprintf(&b, " (session: %s tokens", usage.FormatTokens(m.Session.Tokens.Total()))
+	if m.Session.CostUSD != nil {
+		fmt.Fprintf(&b, " · ~%s", usage.FormatCost(*m.Session.CostUSD))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// runUsageReport prints the ledger totals per month and model. args are
+// the command-line arguments after "usage".
+func runUsageReport(args []string, out io.Writer) error {
+	var month string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if val, ok := flagValue(args, &i, "--month"); ok {
+			if _, err := time.Parse("2006-01", val); err != nil {
+				return fmt.Errorf("invalid --month %q; must be YYYY-MM", val)
+			}
+			month = val
+		} else {
+			rest = append(rest, args[i])
+		}
+	}
+	cli, err := parseArgs(rest)
+	if err != nil {
+		return err
+	}
+	_, cfg, err := loadSettings(cli)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	f, err := os.Open(filepath.Join(cfg.StateDir, "usage.jsonl"))
+	if errors.Is(err, fs.ErrNotExist) {
+		usage.WriteReport(out, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := usage.Read(f)
+	if err != nil {
+		return err
+	}
+	usage.WriteReport(out, usage.Report(entries, month))
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"droid-acp/types"
+	"droid-acp/utils"
+)
+
+// toolStreamInterval limits how often a tool input that is still being
+// generated is sent to Zed again; the complete input is always shown once
+// Droid asks for permission or creates the message.
+const toolStreamInterval = 100 * time.Millisecond
+
+// toolKinds maps Droid tool names to ACP tool kinds.
+var toolKinds = map[string]string{
+	"Create":     "edit",
+	"Edit":       "edit",
+	"MultiEdit":  "edit",
+	"ApplyPatch": "edit",
+	"Execute":    "execute",
+	"Read":       "read",
+	"LS":         "read",
+	"Grep":       "search",
+	"Glob":       "search",
+	"FetchUrl":   "fetch",
+	"WebSearch":  "fetch",
+}
+
+// streamedTool is a tool use whose input Droid is generating.
+type streamedTool struct {
+	name string
+	// parent is the tool use of the sub-agent that made this one, if any.
+	parent string
+	input  strings.Builder
+	sent   time.Time
+	// unsent is set when the latest input has not been shown yet.
+	unsent bool
+}
+
+// streamToolInput adds an input delta to its tool use. The first delta
+// announces the tool call; later ones update it as the input grows, so a
+// large file shows up while it is written rather than all at once.
+func (a *droidAgent) streamToolInput(n types.DroidNotificationData) {
+	a.mu.Lock()
+	if a.streamedTools == nil {
+		a.streamedTools = make(map[string]*streamedTool)
+		a.streamIndex = make(map[int]string)
+	}
+	// Only the first delta of a tool use may carry its ID; later ones are
+	// matched by their content block index.
+	id := n.ToolUseID
+	if id != "" {
+		a.streamIndex[n.Index] = id
+	} else {
+		id = a.streamIndex[n.Index]
+	}
+	if id == "" {
+		a.mu.Unlock()
+		return
+	}
+	tool := a.streamedTools[id]
+	first := tool == nil
+	if first {
+		tool = &streamedTool{parent: n.ParentToolUseID}
+		a.streamedTools[id] = tool
+	}
+	if tool.name == "" {
+		tool.name = n.ToolUseName
+	}
+	tool.input.WriteString(n.InputDelta)
+	due := first || time.Since(tool.sent) >= toolStreamInterval
+	tool.unsent = !due
+	if due {
+		tool.sent = time.Now()
+	}
+	name, input, parent := tool.name, tool.input.String(), tool.parent
+	a.mu.Unlock()
+
+	if first {
+		a.countToolUse(id)
+	}
+	if due {
+		update := toolInputUpdate(id, name, input)
+		update.Meta = parentMeta(parent)
+		if first {
+			update.SessionUpdate = "tool_call"
+			update.Status = "pending"
+		}
+		a.sessionUpdate(update)
+	}
+	if subagentTools[name] {
+		a.startSubagent(id)
+	}
+}
+
+// flushToolInput shows the complete input of a streamed tool use if the
+// last deltas were held back.
+func (a *droidAgent) flushToolInput(id string) {
+	a.mu.Lock()
+	tool := a.streamedTools[id]
+	if tool == nil || !tool.unsent {
+		a.mu.Unlock()
+		return
+	}
+	tool.unsent = false
+	name, input, parent := tool.name, tool.input.String(), tool.parent
+	a.mu.Unlock()
+	update := toolInputUpdate(id, name, input)
+	update.Meta = parentMeta(parent)
+	a.sessionUpdate(update)
+}
+
+// toolCallUpdateType returns the session update that shows tool use id:
+// tool_call, or tool_call_update when its input was already streamed.
+func (a *droidAgent) toolCallUpdateType(id string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.streamedTools[id] != nil {
+		return "tool_call_update"
+	}
+	return "tool_call"
+}
+
+// toolInputUpdate describes a tool use from its possibly incomplete input.
+func toolInputUpdate(id, name, input string) types.Update {
+	fields := partialJSONStrings(input)
+	update := types.Update{
+		SessionUpdate: "tool_call_update",
+		ToolCallId:    id,
+		Kind:          toolKinds[name],
+		Title:         name,
+	}
+	if update.Kind == "" {
+		update.Kind = "other"
+	}
+	if update.Title == "" {
+		update.Title = "Tool"
+	}
+
+	var path, oldText, newText string
+	switch name {
+	case "Create":
+		path, newText = fields["file_path"], fields["content"]
+	case "Edit", "MultiEdit":
+		path, oldText, newText = fields["file_path"], fields["old_str"], fields["new_str"]
+	case "ApplyPatch":
+		patch, _ := utils.GetPatchResult(fields["input"])
+		path, oldText, newText = patch.URI, patch.Before, patch.After
+	case "Task":
+		if description := fields["description"]; description != "" {
+			update.Title = "Task: " + description
+		}
+	case "Execute":
+		if command := fields["command"]; command != "" {
+			update.Title = command
+		}
+	default:
+		for _, key := range []string{"file_path", "path", "pattern", "url", "query"} {
+			if fields[key] != "" {
+				update.Title = name + " " + fields[key]
+				break
+			}
+		}
+	}
+	if path != "" {
+		update.Title = path
+		update.Content = &types.Content{Type: "diff", Path: path, OldText: oldText, NewText: newText}
+		update.Locations = []types.ToolCallLocation{{Path: path}}
+	}
+	return update
+}
+
+// partialJSONStrings returns the string fields of a JSON object that may
+// be cut off anywhere, including what has arrived of the last value.
+// Fields that are not strings are skipped.
+func partialJSONStrings(src string) map[string]string {
+	fields := make(map[string]string)
+	i := skipSpace(src, 0)
+	if i >= len(src) || src[i] != '{' {
+		return fields
+	}
+	i++
+	for {
+		i = skipSpace(src, i)
+		if i < len(src) && src[i] == ',' {
+			i = skipSpace(src, i+1)
+		}
+		if i >= len(src) || src[i] != '"' {
+			return fields
+		}
+		key, next, ok := partialString(src, i)
+		if !ok {
+			return fields
+		}
+		i = skipSpace(src, next)
+		if i >= len(src) || src[i] != ':' {
+			return fields
+		}
+		i = skipSpace(src, i+1)
+		if i >= len(src) {
+			return fields
+		}
+		if src[i] != '"' {
+			i = skipValue(src, i)
+			continue
+		}
+		value, next, ok := partialString(src, i)
+		fields[key] = value
+		if !ok {
+			return fields
+		}
+		i = next
+	}
+}
+
+// partialString decodes the JSON string that starts at src[i]. ok is false
+// when the string is cut off; value then holds what was decoded so far.
+func partialString(src string, i int) (value string, next int, ok bool) {
+	var b strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		c := src[j]
+		if c == '"' {
+			return b.String(), j + 1, true
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if j+1 >= len(src) {
+			break
+		}
+		j++
+		switch src[j] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			r, size, ok := unicodeEscape(src[j+1:])
+			if !ok {
+				return b.String(), len(src), false
+			}
+			b.WriteRune(r)
+			j += size
+		default:
+			b.WriteByte(src[j])
+		}
+	}
+	return b.String(), len(src), false
+}
+
+// unicodeEscape decodes the hex digits after \u, and the low half of a
+// surrogate pair if there is one. ok is false when they are cut off.
+func unicodeEscape(s string) (r rune, size int, ok bool) {
+	if len(s) < 4 {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(s[:4], 16, 32)
+	if err != nil {
+		return '�', 4, true
+	}
+	r = rune(n)
+	if !utf16.IsSurrogate(r) {
+		return r, 4, true
+	}
+	if len(s) >= 6 && s[4:6] != `\u` {
+		return '�', 4, true
+	}
+	if len(s) < 10 {
+		return 0, 0, false
+	}
+	if low, err := strconv.ParseUint(s[6:10], 16, 32); err == nil {
+		return utf16.DecodeRune(r, rune(low)), 10, true
+	}
+	return '�', 4, true
+}
+
+// skipValue skips a non-string value and returns the index of the comma
+// or brace that ends it.
+func skipValue(src string, i int) int {
+	depth := 0
+	for ; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			_, next, ok := partialString(src, i)
+			if !ok {
+				return len(src)
+			}
+			i = next - 1
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return i
+}
+
+func skipSpace(src string, i int) int {
+	for i < len(src) && strings.IndexByte(" \t\r\n", src[i]) >= 0 {
+		i++
+	}
+	return i
+}
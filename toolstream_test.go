@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartialJSONStrings(t *testing.T) {
+	tests := []struct {
+		src  string
+		want map[string]string
+	}{
+		{``, map[string]string{}},
+		{`{"file_pa`, map[string]string{}},
+		{`{"file_path":`, map[string]string{}},
+		{`{"file_path": "/work/a`, map[string]string{"file_path": "/work/a"}},
+		{`{"file_path":"/work/a.md","content":"# Title\nline \"one\"\`, map[string]string{"file_path": "/work/a.md", "content": "# Title\nline \"one\""}},
+		{`{"content":"café 😀"}`, map[string]string{"content": "café 😀"}},
+		{`{"content":"x\ud83d`, map[string]string{"content": "x"}},
+		{`{"content":"x\u00`, map[string]string{"content": "x"}},
+		{`{"timeout": 30, "opts": {"a": "b,}"}, "command": "go test`, map[string]string{"command": "go test"}},
+	}
+	for _, tt := range tests {
+		if got := partialJSONStrings(tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("partialJSONStrings(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestToolInputUpdate(t *testing.T) {
+	update := toolInputUpdate("call-1", "Execute", `{"command":"go vet ./...","riskLevel":"low"}`)
+	if update.Kind != "execute" || update.Title != "go vet ./..." {
+		t.Errorf("execute update = %+v", update)
+	}
+	update = toolInputUpdate("call-2", "ApplyPatch", `{"input":"*** Begin Patch\n*** Update File: /work/a.go\n@@\n-old\n+ne`)
+	if update.Kind != "edit" || update.Title != "/work/a.go" || update.Content == nil || update.Content.NewText != "ne" {
+		t.Errorf("patch update = %+v", update)
+	}
+	update = toolInputUpdate("call-3", "Grep", `{"pattern":"TODO"}`)
+	if update.Kind != "search" || update.Title != "Grep TODO" {
+		t.Errorf("grep update = %+v", update)
+	}
+}
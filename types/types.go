@@ -31,6 +31,10 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+func (e *Error) Error() string {
+	return e.Message
+}
+
 // ACP Initialize
 
 type InitializeParams struct {
@@ -61,9 +65,18 @@ type InitializeResult struct {
 }
 
 type AgentCapabilities struct {
-	LoadSession        bool               `json:"loadSession"`
-	PromptCapabilities PromptCapabilities `json:"promptCapabilities,omitempty"`
-	MCP                McpInfo            `json:"mcp"`
+	LoadSession         bool                 `json:"loadSession"`
+	PromptCapabilities  PromptCapabilities   `json:"promptCapabilities,omitempty"`
+	MCP                 McpInfo              `json:"mcp"`
+	SessionCapabilities *SessionCapabilities `json:"sessionCapabilities,omitempty"`
+	Meta                map[string]any       `json:"_meta,omitempty"`
+}
+
+// SessionCapabilities lists the optional session methods an agent
+// serves; a non-nil field means the method is supported.
+type SessionCapabilities struct {
+	List *struct{} `json:"list,omitempty"`
+	Fork *struct{} `json:"fork,omitempty"`
 }
 
 type McpInfo struct {
@@ -118,7 +131,63 @@ type ClientResources struct {
 }
 
 type PromptResult struct {
-	StopReason string `json:"stopReason"`
+	StopReason string         `json:"stopReason"`
+	Usage      *PromptUsage   `json:"usage,omitempty"`
+	Meta       map[string]any `json:"_meta,omitempty"`
+}
+
+type PromptUsage struct {
+	TotalTokens       int64 `json:"totalTokens"`
+	InputTokens       int64 `json:"inputTokens"`
+	OutputTokens      int64 `json:"outputTokens"`
+	ThoughtTokens     int64 `json:"thoughtTokens,omitempty"`
+	CachedReadTokens  int64 `json:"cachedReadTokens,omitempty"`
+	CachedWriteTokens int64 `json:"cachedWriteTokens,omitempty"`
+}
+
+type ListSessionsParams struct {
+	// Cwd keeps only sessions in this directory when set.
+	Cwd    string `json:"cwd,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type ListSessionsResult struct {
+	Sessions   []SessionInfo `json:"sessions"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+type SessionInfo struct {
+	SessionId string         `json:"sessionId"`
+	Cwd       string         `json:"cwd"`
+	Title     string         `json:"title,omitempty"`
+	UpdatedAt string         `json:"updatedAt,omitempty"`
+	Meta      map[string]any `json:"_meta,omitempty"`
+}
+
+type ForkSessionParams struct {
+	SessionId string `json:"sessionId"`
+	// Cwd defaults to the directory of the forked session.
+	Cwd string `json:"cwd,omitempty"`
+}
+
+// DeleteSessionParams are the params of the _droid-acp/session/delete
+// extension method.
+type DeleteSessionParams struct {
+	SessionId string `json:"sessionId"`
+}
+
+type LoadSessionParams struct {
+	SessionId string `json:"sessionId"`
+	Cwd       string `json:"cwd"`
+}
+
+type LoadSessionResult struct {
+	Models *Models `json:"models,omitempty"`
+	Modes  *Modes  `json:"modes,omitempty"`
+}
+
+type CancelParams struct {
+	SessionId string `json:"sessionId"`
 }
 
 type SetModelParams struct {
@@ -187,6 +256,13 @@ type ToolCall struct {
 	Locations  []ToolCallLocation `json:"locations,omitempty"`
 }
 
+// TextToolCallContent is a tool call content block holding plain content,
+// such as a plan to review.
+type TextToolCallContent struct {
+	Type    string  `json:"type"`
+	Content Content `json:"content"`
+}
+
 type DiffContent struct {
 	Type    string `json:"type"`
 	Path    string `json:"path"`
@@ -200,6 +276,15 @@ type PermissionOption struct {
 	Kind     string `json:"kind"`
 }
 
+type RequestPermissionResult struct {
+	Outcome PermissionOutcome `json:"outcome"`
+}
+
+type PermissionOutcome struct {
+	Outcome  string `json:"outcome"`
+	OptionId string `json:"optionId,omitempty"`
+}
+
 //--- end of struct for permission request
 
 // struct for session update param
@@ -209,13 +294,28 @@ type SessionUpdateParam struct {
 }
 
 type Update struct {
-	SessionUpdate string             `json:"sessionUpdate,omitempty"`
-	ToolCallId    string             `json:"toolCallId,omitempty"`
-	Title         string             `json:"title,omitempty"`
-	Kind          string             `json:"kind,omitempty"`
-	Status        string             `json:"status,omitempty"`
-	Content       *Content           `json:"content,omitempty"`
-	Locations     []ToolCallLocation `json:"locations,omitempty"`
+	SessionUpdate     string             `json:"sessionUpdate,omitempty"`
+	ToolCallId        string             `json:"toolCallId,omitempty"`
+	Title             string             `json:"title,omitempty"`
+	Kind              string             `json:"kind,omitempty"`
+	Status            string             `json:"status,omitempty"`
+	Content           *Content           `json:"content,omitempty"`
+	Locations         []ToolCallLocation `json:"locations,omitempty"`
+	CurrentModeId     string             `json:"currentModeId,omitempty"`
+	AvailableCommands []AvailableCommand `json:"availableCommands,omitempty"`
+	// UpdatedAt is sent with session_info_update, as an RFC 3339 time.
+	UpdatedAt string         `json:"updatedAt,omitempty"`
+	Meta      map[string]any `json:"_meta,omitempty"`
+}
+
+type AvailableCommand struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Input       *AvailableCommandInput `json:"input,omitempty"`
+}
+
+type AvailableCommandInput struct {
+	Hint string `json:"hint"`
 }
 
 type ToolCallLocation struct {
@@ -233,17 +333,60 @@ type Content struct {
 
 //--- end of struct for session update param
 
+// struct for Droid requests
+type InitializeSessionParams struct {
+	MachineId string `json:"machineId"`
+	Cwd       string `json:"cwd"`
+}
+
+type AddUserMessageParams struct {
+	Text        string       `json:"text,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+type Attachment struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Path     string `json:"path"`
+}
+
+type UpdateSessionSettingsParams struct {
+	SessionId       string `json:"sessionId"`
+	ModelId         string `json:"modelId,omitempty"`
+	AutonomyLevel   string `json:"autonomyLevel,omitempty"`
+	SpecMode        *bool  `json:"specMode,omitempty"`
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+}
+
+type InterruptSessionParams struct {
+	SessionId string `json:"sessionId"`
+}
+
+type PermissionResult struct {
+	SelectedOption string `json:"selectedOption"`
+}
+
+//--- end of struct for Droid requests
+
 // struct for Droid
 type ResultModel struct {
-	SessionID       string           `json:"sessionId"`
-	Settings        SessionSettings  `json:"settings"`
-	AvailableModels []AvailableModel `json:"availableModels"`
+	SessionID               string           `json:"sessionId"`
+	Settings                SessionSettings  `json:"settings"`
+	AvailableModels         []AvailableModel `json:"availableModels"`
+	AvailableAutonomyLevels []AutonomyLevel  `json:"availableAutonomyLevels,omitempty"`
 }
 
 type SessionSettings struct {
 	ModelID         string `json:"modelId"`
 	ReasoningEffort string `json:"reasoningEffort"`
 	AutonomyLevel   string `json:"autonomyLevel"`
+	SpecMode        bool   `json:"specMode,omitempty"`
+}
+
+type AutonomyLevel struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
 type AvailableModel struct {
@@ -294,6 +437,8 @@ type ToolUse struct {
 
 type InputApplyPatch struct {
 	Input string `json:"input"`
+	// FilePath is set instead for file tools such as Create and Edit.
+	FilePath string `json:"file_path,omitempty"`
 }
 
 type InputEdit struct {
@@ -327,6 +472,33 @@ type DroidNotificationData struct {
 	ToolUseID   string          `json:"toolUseId,omitempty"`
 	ToolUseName string          `json:"toolUseName,omitempty"`
 	NewState    string          `json:"newState,omitempty"`
+	TokenUsage  *TokenUsage     `json:"tokenUsage,omitempty"`
+	// StopReason is the model's reason for ending a message, e.g. refusal.
+	StopReason string      `json:"stopReason,omitempty"`
+	Error      *DroidError `json:"error,omitempty"`
+	// ParentToolUseID is set on notifications from a sub-agent and names
+	// the tool use that started it.
+	ParentToolUseID string `json:"parentToolUseId,omitempty"`
+	// IsError marks a failed tool_result.
+	IsError bool `json:"isError,omitempty"`
+	// Title is the session title Droid generated, sent with
+	// session_title_updated.
+	Title string `json:"title,omitempty"`
+}
+
+// DroidError is sent with error notifications when a turn fails.
+type DroidError struct {
+	Message string `json:"message"`
+}
+
+// TokenUsage is the cumulative token count of a Droid session, sent with
+// token_usage_updated notifications.
+type TokenUsage struct {
+	InputTokens         int64 `json:"inputTokens"`
+	OutputTokens        int64 `json:"outputTokens"`
+	CacheReadTokens     int64 `json:"cacheReadTokens"`
+	CacheCreationTokens int64 `json:"cacheCreationTokens"`
+	ThinkingTokens      int64 `json:"thinkingTokens"`
 }
 
 type Message struct {
@@ -337,6 +509,7 @@ type Message struct {
 
 type DroidContent struct {
 	Id    string           `json:"id"`
+	Name  string           `json:"name,omitempty"`
 	Input *InputApplyPatch `json:"input,omitempty"`
 }
 
@@ -347,4 +520,52 @@ type FSWriteTextFileParam struct {
 	Content   string `json:"content"`
 }
 
+type FSReadTextFileParam struct {
+	SessionId string `json:"sessionId"`
+	Path      string `json:"path"`
+	Line      int    `json:"line,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+type FSReadTextFileResult struct {
+	Content string `json:"content"`
+}
+
 // -- end of struct for fs
+
+// -- struct for terminal
+type CreateTerminalParam struct {
+	SessionId       string        `json:"sessionId"`
+	Command         string        `json:"command"`
+	Args            []string      `json:"args,omitempty"`
+	Env             []EnvVariable `json:"env,omitempty"`
+	Cwd             string        `json:"cwd,omitempty"`
+	OutputByteLimit int           `json:"outputByteLimit,omitempty"`
+}
+
+type EnvVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type CreateTerminalResult struct {
+	TerminalId string `json:"terminalId"`
+}
+
+type TerminalParam struct {
+	SessionId  string `json:"sessionId"`
+	TerminalId string `json:"terminalId"`
+}
+
+type TerminalOutputResult struct {
+	Output     string              `json:"output"`
+	Truncated  bool                `json:"truncated"`
+	ExitStatus *TerminalExitStatus `json:"exitStatus,omitempty"`
+}
+
+type TerminalExitStatus struct {
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+}
+
+// -- end of struct for terminal
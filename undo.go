@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"droid-acp/snapshots"
+	"droid-acp/types"
+)
+
+// snapshotsDir is where file snapshots are kept under the state dir.
+func snapshotsDir(stateDir string) string {
+	return filepath.Join(stateDir, "snapshots")
+}
+
+// clientFS reads and writes files through the client, so that undo sees
+// and updates what is open in the editor. Files the client cannot read
+// are read from disk.
+type clientFS struct {
+	ctx       context.Context
+	a         *droidAgent
+	sessionID string
+}
+
+func (c clientFS) ReadFile(path string) (string, bool, error) {
+	content, err := c.a.conn.ReadTextFile(c.ctx, types.FSReadTextFileParam{SessionId: c.sessionID, Path: path})
+	if err == nil {
+		return content, true, nil
+	}
+	return snapshots.OSFS{}.ReadFile(path)
+}
+
+func (c clientFS) WriteFile(path, content string) error {
+	return c.a.conn.WriteTextFile(c.ctx, types.FSWriteTextFileParam{SessionId: c.sessionID, Path: path, Content: content})
+}
+
+func (c clientFS) Remove(path string) error {
+	return snapshots.OSFS{}.Remove(path)
+}
+
+// writeFile writes a file through the client, first keeping its previous
+// content as a snapshot of the running turn and for the turn summary.
+func (a *droidAgent) writeFile(ctx context.Context, sessionID, path, content string) error {
+	a.mu.Lock()
+	snapshot := a.snapshots != nil && a.cfg.Undo.Snapshots
+	track := snapshot || a.cfg.Status.TurnSummary
+	turn, prompt := a.turnID, a.turnPrompt
+	a.mu.Unlock()
+
+	fsys := clientFS{ctx, a, sessionID}
+	var before string
+	var existed bool
+	if track {
+		var err error
+		before, existed, err = fsys.ReadFile(path)
+		if err != nil {
+			a.permLog.Warn("failed to read file before writing it", "session", sessionID, "path", path, "err", err)
+			track, snapshot = false, false
+		}
+	}
+	if err := fsys.WriteFile(path, content); err != nil {
+		return err
+	}
+	if track {
+		a.trackFileWrite(path, existed, before, content)
+	}
+	if !snapshot {
+		return nil
+	}
+	f := snapshots.File{Path: path, Existed: existed, Before: before, After: content}
+	if err := a.snapshots.Record(sessionID, turn, prompt, f); err != nil {
+		a.permLog.Error("failed to save file snapshot", "session", sessionID, "path", path, "err", err)
+	}
+	return nil
+}
+
+// parseUndoArgs reads "[N] [force]".
+func parseUndoArgs(args string) (n int, force bool, err error) {
+	n = 1
+	for _, arg := range strings.Fields(args) {
+		if arg == "force" {
+			force = true
+			continue
+		}
+		n, err = strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return 0, false, fmt.Errorf("invalid number of turns %q", arg)
+		}
+	}
+	return n, force, nil
+}
+
+// undoCommand implements /undo [N] [force].
+func (a *droidAgent) undoCommand(ctx context.Context, args string) (string, error) {
+	n, force, err := parseUndoArgs(args)
+	if err != nil {
+		a.agentMessage(err.Error() + ". Usage: /undo [turns] [force]")
+		return "", nil
+	}
+	a.mu.Lock()
+	sessionID := a.currentSession
+	busy := a.turnBusy
+	a.mu.Unlock()
+	if busy {
+		a.agentMessage("Droid is still working. Run /undo once the turn has ended.")
+		return "", nil
+	}
+	if a.snapshots == nil {
+		a.agentMessage("There is nothing to undo.")
+		return "", nil
+	}
+
+	const note = "\n\nDroid is not told about this; mention it in your next message if it matters."
+	if summary, ok, err := undoGitTurns(a.snapshots, sessionID, n); ok {
+		if err != nil {
+			a.acpLog.Error("failed to undo through git", "session", sessionID, "err", err)
+			if summary != "" {
+				summary += "\n\n"
+			}
+			a.agentMessage(summary + "Could not undo through git: " + err.Error() + "\n\nThe turns not listed were left as they are.")
+			return "", nil
+		}
+		a.acpLog.Info("undid turns through git", "session", sessionID, "turns", n)
+		a.agentMessage(summary + note)
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	result, err := a.snapshots.Undo(sessionID, n, clientFS{ctx, a, sessionID}, force)
+	switch {
+	case errors.Is(err, snapshots.ErrNothingToUndo):
+		a.agentMessage("There is nothing to undo.")
+		return "", nil
+	case errors.Is(err, snapshots.ErrConflict):
+		a.agentMessage(fmt.Sprintf("Not undoing: these files changed since droid-acp wrote them:\n%s\n\nRun `/undo %d force` to restore them anyway.",
+			fileList(result.Conflicts), len(result.Turns)))
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	a.acpLog.Info("undid turns", "session", sessionID, "turns", len(result.Turns), "restored", len(result.Restored), "removed", len(result.Removed))
+	a.agentMessage(undoSummary(result) + note)
+	return "", nil
+}
+
+// undoSummary describes what Undo did.
+func undoSummary(result snapshots.Result) string {
+	var b strings.Builder
+	if len(result.Turns) == 1 {
+		b.WriteString("Undid the last turn.")
+	} else {
+		fmt.Fprintf(&b, "Undid the last %d turns.", len(result.Turns))
+	}
+	if len(result.Restored) > 0 {
+		fmt.Fprintf(&b, "\n\nRestored:\n%s", fileList(result.Restored))
+	}
+	if len(result.Removed) > 0 {
+		fmt.Fprintf(&b, "\n\nDeleted:\n%s", fileList(result.Removed))
+	}
+	return b.String()
+}
+
+func fileList(paths []string) string {
+	var lines []string
+	for _, p := range paths {
+		lines = append(lines, "- `"+p+"`")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runUndo implements "droid-acp undo <session-id>".
+func runUndo(args []string, out io.Writer) error {
+	const usage = "usage: droid-acp undo <session-id> [--turns N] [--force]"
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(usage)
+	}
+	id, args := args[0], args[1:]
+	n, force := 1, false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if val, ok := flagValue(args, &i, "--turns"); ok {
+			var err error
+			if n, err = strconv.Atoi(val); err != nil || n < 1 {
+				return fmt.Errorf("invalid --turns %q; must be a positive number", val)
+			}
+		} else if args[i] == "--force" {
+			force = true
+		} else {
+			rest = append(rest, args[i])
+		}
+	}
+	cli, err := parseArgs(rest)
+	if err != nil {
+		return err
+	}
+	_, cfg, err := loadSettings(cli)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	store := snapshots.Open(snapshotsDir(cfg.StateDir))
+	if summary, ok, err := undoGitTurns(store, id, n); ok {
+		return printGitUndo(out, summary, err)
+	} else if err != nil {
+		return err
+	}
+	result, err := store.Undo(id, n, snapshots.OSFS{}, force)
+	if errors.Is(err, snapshots.ErrConflict) {
+		return fmt.Errorf("these files changed since droid-acp wrote them; use --force to restore them anyway:\n%s", fileList(result.Conflicts))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, undoSummary(result))
+	return nil
+}
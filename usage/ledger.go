@@ -0,0 +1,152 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is one turn in the ledger.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"sessionId"`
+	Cwd       string    `json:"cwd,omitempty"`
+	Model     string    `json:"model"`
+	Tokens    Tokens    `json:"tokens"`
+	// Cost is the estimated cost in USD; nil when the model has no price.
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+// Ledger appends entries to a JSONL file. It is safe for concurrent use.
+type Ledger struct {
+	mu   sync.Mutex
+	path string
+}
+
+// OpenLedger returns a ledger at path; the file and its directory are
+// created on the first Append.
+func OpenLedger(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+func (l *Ledger) Append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read parses a ledger, skipping lines it cannot decode.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Summary totals the entries of one month and model.
+type Summary struct {
+	Month    string
+	Model    string
+	Turns    int
+	Sessions int
+	Tokens   Tokens
+	Cost     float64
+	// Unpriced counts turns whose cost is unknown.
+	Unpriced int
+}
+
+// Report groups entries by month (YYYY-MM, local time) and model. A
+// non-empty month keeps only that month.
+func Report(entries []Entry, month string) []Summary {
+	type key struct{ month, model string }
+	sums := make(map[key]*Summary)
+	sessions := make(map[key]map[string]bool)
+	for _, e := range entries {
+		k := key{e.Time.Local().Format("2006-01"), e.Model}
+		if month != "" && k.month != month {
+			continue
+		}
+		s := sums[k]
+		if s == nil {
+			s = &Summary{Month: k.month, Model: k.model}
+			sums[k] = s
+			sessions[k] = make(map[string]bool)
+		}
+		s.Turns++
+		s.Tokens = s.Tokens.Add(e.Tokens)
+		if e.Cost != nil {
+			s.Cost += *e.Cost
+		} else {
+			s.Unpriced++
+		}
+		sessions[k][e.SessionID] = true
+		s.Sessions = len(sessions[k])
+	}
+
+	list := make([]Summary, 0, len(sums))
+	for _, s := range sums {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Month != list[j].Month {
+			return list[i].Month < list[j].Month
+		}
+		return list[i].Model < list[j].Model
+	})
+	return list
+}
+
+// WriteReport prints summaries as a table.
+func WriteReport(w io.Writer, summaries []Summary) {
+	if len(summaries) == 0 {
+		fmt.Fprintln(w, "No usage recorded.")
+		return
+	}
+	fmt.Fprintf(w, "%-8s %-32s %8s %6s %10s %10s %10s %10s\n", "MONTH", "MODEL", "SESSIONS", "TURNS", "INPUT", "OUTPUT", "CACHED", "COST")
+	var total float64
+	unpriced := false
+	for _, s := range summaries {
+		cost := FormatCost(s.Cost)
+		if s.Unpriced > 0 {
+			cost += "*"
+			unpriced = true
+		}
+		fmt.Fprintf(w, "%-8s %-32s %8d %6d %10s %10s %10s %10s\n",
+			s.Month, s.Model, s.Sessions, s.Turns,
+			FormatTokens(s.Tokens.Input), FormatTokens(s.Tokens.Output+s.Tokens.Reasoning),
+			FormatTokens(s.Tokens.CacheRead), cost)
+		total += s.Cost
+	}
+	fmt.Fprintf(w, "\nEstimated total: %s\n", FormatCost(total))
+	if unpriced {
+		fmt.Fprintln(w, "* some turns used a model without a known price; set usage.prices to include them")
+	}
+}
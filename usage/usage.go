@@ -0,0 +1,112 @@
+// Package usage tracks token counts and estimated cost of Droid turns and
+// keeps a ledger of them for later reports.
+package usage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tokens counts the tokens of a turn or session.
+type Tokens struct {
+	Input      int64 `json:"input"`
+	Output     int64 `json:"output"`
+	CacheRead  int64 `json:"cacheRead,omitempty"`
+	CacheWrite int64 `json:"cacheWrite,omitempty"`
+	Reasoning  int64 `json:"reasoning,omitempty"`
+}
+
+func (t Tokens) Total() int64 {
+	return t.Input + t.Output + t.CacheRead + t.CacheWrite + t.Reasoning
+}
+
+func (t Tokens) Add(o Tokens) Tokens {
+	return Tokens{
+		Input:      t.Input + o.Input,
+		Output:     t.Output + o.Output,
+		CacheRead:  t.CacheRead + o.CacheRead,
+		CacheWrite: t.CacheWrite + o.CacheWrite,
+		Reasoning:  t.Reasoning + o.Reasoning,
+	}
+}
+
+// Sub returns t - o, for turn usage out of cumulative session counts.
+func (t Tokens) Sub(o Tokens) Tokens {
+	return Tokens{
+		Input:      t.Input - o.Input,
+		Output:     t.Output - o.Output,
+		CacheRead:  t.CacheRead - o.CacheRead,
+		CacheWrite: t.CacheWrite - o.CacheWrite,
+		Reasoning:  t.Reasoning - o.Reasoning,
+	}
+}
+
+// Price is the cost of a model in USD per million tokens. Reasoning tokens
+// are billed as output.
+type Price struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cacheRead"`
+	CacheWrite float64 `json:"cacheWrite"`
+}
+
+// DefaultPrices are list prices of common models, keyed by model ID prefix.
+// They only serve as an estimate; configure usage.prices for exact figures.
+var DefaultPrices = map[string]Price{
+	"claude-opus-4":    {Input: 15, Output: 75, CacheRead: 1.5, CacheWrite: 18.75},
+	"claude-opus-4-5":  {Input: 5, Output: 25, CacheRead: 0.5, CacheWrite: 6.25},
+	"claude-sonnet-4":  {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	"claude-haiku-4":   {Input: 1, Output: 5, CacheRead: 0.1, CacheWrite: 1.25},
+	"gpt-5":            {Input: 1.25, Output: 10, CacheRead: 0.125},
+	"gemini-2.5-pro":   {Input: 1.25, Output: 10, CacheRead: 0.31},
+	"gemini-2.5-flash": {Input: 0.3, Output: 2.5, CacheRead: 0.075},
+}
+
+// Cost estimates the cost of t on model using the longest matching prefix
+// in prices, then in DefaultPrices. ok is false when the model is unknown.
+func Cost(prices map[string]Price, model string, t Tokens) (cost float64, ok bool) {
+	p, ok := lookup(prices, model)
+	if !ok {
+		p, ok = lookup(DefaultPrices, model)
+	}
+	if !ok {
+		return 0, false
+	}
+	cost = float64(t.Input)*p.Input +
+		float64(t.Output+t.Reasoning)*p.Output +
+		float64(t.CacheRead)*p.CacheRead +
+		float64(t.CacheWrite)*p.CacheWrite
+	return cost / 1e6, true
+}
+
+func lookup(prices map[string]Price, model string) (Price, bool) {
+	var best string
+	for prefix := range prices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return prices[best], true
+}
+
+// FormatTokens renders n compactly, e.g. 12.3k or 1.2M.
+func FormatTokens(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+	return fmt.Sprint(n)
+}
+
+// FormatCost renders an estimated cost in USD.
+func FormatCost(cost float64) string {
+	if cost < 0.01 && cost > 0 {
+		return "<$0.01"
+	}
+	return fmt.Sprintf("$%.2f", cost)
+}
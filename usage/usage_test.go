@@ -0,0 +1,42 @@
+package usage
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCost(t *testing.T) {
+	tokens := Tokens{Input: 1_000_000, Output: 100_000, CacheRead: 2_000_000, Reasoning: 100_000}
+
+	cost, ok := Cost(nil, "claude-sonnet-4-5-20250929", tokens)
+	if !ok || math.Abs(cost-(3+0.2*15+2*0.3)) > 1e-9 {
+		t.Errorf("default price cost = %v, %v", cost, ok)
+	}
+	cost, ok = Cost(map[string]Price{"custom:glm": {Input: 1, Output: 2}}, "custom:glm-4.7", tokens)
+	if !ok || math.Abs(cost-1.4) > 1e-9 {
+		t.Errorf("configured price cost = %v, %v", cost, ok)
+	}
+	if _, ok := Cost(nil, "custom:unknown", tokens); ok {
+		t.Error("unknown model has a price")
+	}
+}
+
+func TestReport(t *testing.T) {
+	cost := 0.5
+	oct := time.Date(2026, 10, 3, 12, 0, 0, 0, time.Local)
+	entries := []Entry{
+		{Time: oct, SessionID: "a", Model: "m1", Tokens: Tokens{Input: 10}, Cost: &cost},
+		{Time: oct, SessionID: "a", Model: "m1", Tokens: Tokens{Input: 5}, Cost: &cost},
+		{Time: oct, SessionID: "b", Model: "m1", Tokens: Tokens{Input: 1}},
+		{Time: oct.AddDate(0, 1, 0), SessionID: "c", Model: "m1", Tokens: Tokens{Input: 7}},
+	}
+	got := Report(entries, "2026-10")
+	if len(got) != 1 {
+		t.Fatalf("got %d summaries, want 1", len(got))
+	}
+	s := got[0]
+	if s.Turns != 3 || s.Sessions != 2 || s.Tokens.Input != 16 || s.Cost != 1 || s.Unpriced != 1 {
+		t.Errorf("summary = %+v", s)
+	}
+}